@@ -0,0 +1,113 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GatewayBackend is the protocol the gateway is talked to with.
+// +kubebuilder:validation:Enum=pcp;pcp-cli;natpmp;upnp
+type GatewayBackend string
+
+const (
+	GatewayBackendPCP    GatewayBackend = "pcp"
+	GatewayBackendPCPCLI GatewayBackend = "pcp-cli"
+	GatewayBackendNATPMP GatewayBackend = "natpmp"
+	GatewayBackendUPnP   GatewayBackend = "upnp"
+)
+
+// GatewayConditionReachable tells whether the gateway answered the last probe.
+const GatewayConditionReachable = "Reachable"
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	From int32 `json:"from"`
+
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	To int32 `json:"to"`
+}
+
+// GatewaySpec describes a router and how to talk to it.
+type GatewaySpec struct {
+	// The protocol to talk to the router with.
+	Backend GatewayBackend `json:"backend"`
+
+	// The address of the PCP or NAT-PMP server, or the URL of the UPnP IGD
+	// device description. If empty, it's discovered.
+	// +optional
+	Address string `json:"address,omitempty"`
+
+	// The lifetime to request for the mappings, unless the Service asks
+	// for another one. If not set, the operator default is used.
+	// +optional
+	DefaultLifetime *metav1.Duration `json:"defaultLifetime,omitempty"`
+
+	// The gateway ports the Services can ask for. If empty, any port can
+	// be asked for. The ports chosen by the router are not limited.
+	// +optional
+	AllowedPortRanges []PortRange `json:"allowedPortRanges,omitempty"`
+}
+
+// GatewayStatus is what the router told about itself at the last probe.
+type GatewayStatus struct {
+	// The Reachable condition.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// The external address of the router, if the protocol reports it.
+	// +optional
+	ExternalIP string `json:"externalIP,omitempty"`
+
+	// The server epoch, if the protocol has one.
+	// +optional
+	Epoch *int64 `json:"epoch,omitempty"`
+
+	// The protocols the router can map the ports of.
+	// +optional
+	SupportedProtocols []corev1.Protocol `json:"supportedProtocols,omitempty"`
+
+	// When the router was probed last time.
+	// +optional
+	LastProbeTime *metav1.Time `json:"lastProbeTime,omitempty"`
+
+	// The number of the port mappings the router has, if the protocol
+	// can list them.
+	// +optional
+	Mappings *int32 `json:"mappings,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster,shortName=gw
+//+kubebuilder:printcolumn:name="Backend",type=string,JSONPath=`.spec.backend`
+//+kubebuilder:printcolumn:name="Address",type=string,JSONPath=`.spec.address`
+//+kubebuilder:printcolumn:name="Reachable",type=string,JSONPath=`.status.conditions[?(@.type=="Reachable")].status`
+//+kubebuilder:printcolumn:name="External IP",type=string,JSONPath=`.status.externalIP`
+//+kubebuilder:printcolumn:name="Epoch",type=integer,JSONPath=`.status.epoch`,priority=1
+//+kubebuilder:printcolumn:name="Mappings",type=integer,JSONPath=`.status.mappings`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// Gateway describes a router the operator maps the ports at.
+type Gateway struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GatewaySpec   `json:"spec,omitempty"`
+	Status GatewayStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// GatewayList contains a list of Gateway.
+type GatewayList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Gateway `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Gateway{}, &GatewayList{})
+}
@@ -0,0 +1,104 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ServiceLabel is the label of the PortMappings with the name of
+// the Service they belong to.
+const ServiceLabel = "port-map.mzg.io/service"
+
+// PortMappingSpec describes the Service port the mapping is for.
+type PortMappingSpec struct {
+	// The name of the Service, in the namespace of the PortMapping.
+	ServiceName string `json:"serviceName"`
+
+	// The protocol of the Service port.
+	Protocol corev1.Protocol `json:"protocol"`
+
+	// The Service port.
+	Port int32 `json:"port"`
+
+	// The node port the mapping forwards to.
+	NodePort int32 `json:"nodePort"`
+
+	// The name of the gateway the port is mapped at, empty if the operator
+	// maps the ports at a single gateway.
+	// +optional
+	Gateway string `json:"gateway,omitempty"`
+}
+
+// PortMappingStatus is the state of the mapping at the gateway.
+type PortMappingStatus struct {
+	// The protocol of the mapping.
+	// +optional
+	Protocol corev1.Protocol `json:"protocol,omitempty"`
+
+	// The external address of the gateway.
+	// +optional
+	GatewayIP string `json:"gatewayIP,omitempty"`
+
+	// The gateway port mapped.
+	// +optional
+	GatewayPort int32 `json:"gatewayPort,omitempty"`
+
+	// The address of the node the mapping forwards to.
+	// Empty if it's the node the operator runs at.
+	// +optional
+	InternalIP string `json:"internalIP,omitempty"`
+
+	// The port at the node the mapping forwards to.
+	// +optional
+	InternalPort int32 `json:"internalPort,omitempty"`
+
+	// The lifetime the gateway granted to the mapping.
+	// +optional
+	Lifetime *metav1.Duration `json:"lifetime,omitempty"`
+
+	// When the gateway is going to expire the mapping unless it's renewed.
+	// +optional
+	ExpiryTime *metav1.Time `json:"expiryTime,omitempty"`
+
+	// The error of the last attempt to map the port or to renew
+	// the mapping, empty if it succeeded.
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:shortName=pm
+//+kubebuilder:printcolumn:name="Service",type=string,JSONPath=`.spec.serviceName`
+//+kubebuilder:printcolumn:name="Protocol",type=string,JSONPath=`.spec.protocol`
+//+kubebuilder:printcolumn:name="Gateway",type=string,JSONPath=`.spec.gateway`,priority=1
+//+kubebuilder:printcolumn:name="Gateway IP",type=string,JSONPath=`.status.gatewayIP`
+//+kubebuilder:printcolumn:name="Gateway Port",type=integer,JSONPath=`.status.gatewayPort`
+//+kubebuilder:printcolumn:name="Internal IP",type=string,JSONPath=`.status.internalIP`
+//+kubebuilder:printcolumn:name="Internal Port",type=integer,JSONPath=`.status.internalPort`
+//+kubebuilder:printcolumn:name="Expiry",type=date,JSONPath=`.status.expiryTime`
+//+kubebuilder:printcolumn:name="Error",type=string,JSONPath=`.status.lastError`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// PortMapping mirrors the mapping of a Service port at the gateway.
+// Managed by the operator, one per mapped Service port.
+type PortMapping struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PortMappingSpec   `json:"spec,omitempty"`
+	Status PortMappingStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// PortMappingList contains a list of PortMapping.
+type PortMappingList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PortMapping `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PortMapping{}, &PortMappingList{})
+}
@@ -1,22 +1,33 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	portmapv1alpha1 "github.com/MOZGIII/port-map-operator/api/v1alpha1"
 	"github.com/MOZGIII/port-map-operator/pkg/controllers"
-	"github.com/MOZGIII/port-map-operator/pkg/pcpcliwrap"
+	"github.com/MOZGIII/port-map-operator/pkg/gatewayset"
+	"github.com/MOZGIII/port-map-operator/pkg/lease"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	"github.com/MOZGIII/port-map-operator/pkg/portregistry"
+	"github.com/MOZGIII/port-map-operator/pkg/webhooks"
+	"github.com/MOZGIII/port-map-operator/pkg/workpool"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -25,9 +36,16 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
+var (
+	errLeaderElectionPerNode   = errors.New("leader election can't be used in the per-node mode")
+	errDefaultLifetimeTooShort = errors.New("the default lifetime has to be at least a second")
+	errNoPortRegistryNamespace = errors.New("the namespace of the port registry ConfigMap is not set")
+)
+
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
+	utilruntime.Must(portmapv1alpha1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -35,15 +53,50 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
-	var pcpServerAddr string
-	var pcpCli string
+	var loadBalancerClass string
+	var handleClasslessServices bool
+	var nodeName string
+	var nodeSelector string
+	var defaultLifetime time.Duration
+	var enableWebhook bool
+	var portRegistry string
+	var portRegistryNS string
+	var gatewayNames string
+	var maxConcurrentReconciles int
+	var mapperOpts mapperOptions
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
-	flag.StringVar(&pcpServerAddr, "pcp-server", "", "The address of the PCP server. If omitted, autodiscovery is attempted.")
-	flag.StringVar(&pcpCli, "pcp-cli", "pcp", "The path to the PCP CLI.")
+	flag.StringVar(&loadBalancerClass, "load-balancer-class", "port-map.mzg.io/port-map-operator",
+		"The spec.loadBalancerClass of the Services to handle.")
+	flag.BoolVar(&handleClasslessServices, "handle-classless-services", false,
+		"Handle the LoadBalancer Services without spec.loadBalancerClass. "+
+			"Don't enable this if there are other LoadBalancer controllers in the cluster.")
+	flag.StringVar(&nodeName, "node-name", "",
+		"The node this instance runs at. Enables the per-node mode, where every node runs an instance "+
+			"that only maps the ports of the Services assigned to its node.")
+	flag.StringVar(&nodeSelector, "node-selector", "",
+		"The label selector of the nodes the Services can be assigned to in the per-node mode.")
+	flag.DurationVar(&defaultLifetime, "default-lifetime", 2*time.Minute, // nolint: gomnd
+		"The lifetime to request for the port mappings, unless the Service asks for another one.")
+	flag.StringVar(&portRegistry, "port-registry", "port-map-operator-port-registry",
+		"The name of the ConfigMap to keep the gateway ports granted to the Services at. "+
+			"If empty, the Services asking for the same gateway port are not checked for conflicts.")
+	flag.StringVar(&portRegistryNS, "port-registry-namespace", os.Getenv("POD_NAMESPACE"),
+		"The namespace of the port registry ConfigMap.")
+	flag.BoolVar(&enableWebhook, "enable-webhook", false,
+		"Serve the webhook validating the port-map annotations of the Services. "+
+			"Requires the serving certificates.")
+	flag.StringVar(&gatewayNames, "gateway", "",
+		"The comma-separated names of the Gateway resources to map the ports at, the first one is the default. "+
+			"If set, the mappers are built from the Gateways rather than from the --backend and related flags. "+
+			"With several Gateways, the Services are mapped at all of them, "+
+			"unless they select some with the port-map.mzg.io/gateways annotation.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"How many Services are reconciled at once.")
+	mapperOpts.BindFlags(flag.CommandLine)
 	opts := zap.Options{
 		Development: true,
 	}
@@ -52,6 +105,25 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	if defaultLifetime < time.Second {
+		setupLog.Error(errDefaultLifetimeTooShort, "invalid flags")
+		os.Exit(1)
+	}
+	if nodeName != "" && enableLeaderElection {
+		setupLog.Error(errLeaderElectionPerNode, "invalid flags")
+		os.Exit(1)
+	}
+	if portRegistry != "" && portRegistryNS == "" {
+		setupLog.Error(errNoPortRegistryNamespace, "invalid flags")
+		os.Exit(1)
+	}
+	nodeLabelSelector, err := parseNodeSelector(nodeSelector)
+	if err != nil {
+		setupLog.Error(err, "unable to parse the node selector")
+		os.Exit(1)
+	}
+	mapperOpts.NodeName = nodeName
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
@@ -65,33 +137,69 @@ func main() {
 		os.Exit(1)
 	}
 
-	pm := pcpcliwrap.New(&pcpcliwrap.Command{
-		CommandName: pcpCli,
-		ServerAddr:  pcpServerAddr,
-	})
+	gateways := splitGatewayNames(gatewayNames)
+	pm, runMapper, err := newMapper(mgr, &mapperOpts, gateways, nodeLabelSelector)
+	if err != nil {
+		setupLog.Error(err, "unable to set up port mapper", "backend", mapperOpts.Backend)
+		os.Exit(1)
+	}
 	stopch := make(chan struct{})
 	donech := make(chan struct{})
 	go func() {
-		mperr := pm.Run(stopch)
+		mperr := runMapper(stopch)
 		if mperr != nil {
 			setupLog.Error(mperr, "port mapper failed")
 		}
 		close(donech)
 	}()
 
+	pool := mapperOpts.newPool()
+	if err = mgr.Add(pool); err != nil {
+		setupLog.Error(err, "unable to set up the mapping workers")
+		os.Exit(1)
+	}
+	// The mapper itself is still used to detect the gateway restarts.
+	queued := &workpool.Mapper{Pool: pool, Mapper: pm}
+
+	leases := lease.NewManager(queued)
+	if err = mgr.Add(leases); err != nil {
+		setupLog.Error(err, "unable to set up the lease manager")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.ServiceReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("Service"),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("Service"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("port-map-operator"),
+
+		PortMap:         queued,
+		DefaultLifetime: portmap.LifetimeFromDuration(defaultLifetime),
+		Gateways:        multiWANGateways(gateways),
+		GatewayRestarts: gatewayRestarts(pm),
+		Leases:          leases,
+		Ports:           newPortRegistry(mgr, portRegistryNS, portRegistry),
+
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		MaxConcurrentMappings:   mapperOpts.Workers,
+
+		LoadBalancerClass:       loadBalancerClass,
+		HandleClasslessServices: handleClasslessServices,
 
-		PortMap:         pm,
-		DefaultLifetime: 120, // nolint: gomnd
+		NodeName:     nodeName,
+		NodeSelector: nodeLabelSelector,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Service")
 		os.Exit(1)
 	}
 	//+kubebuilder:scaffold:builder
 
+	if enableWebhook {
+		mgr.GetWebhookServer().Register(webhooks.ServiceValidatorPath, &webhook.Admission{
+			Handler: &webhooks.ServiceValidator{},
+		})
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -109,3 +217,79 @@ func main() {
 	close(stopch)
 	<-donech
 }
+
+// Builds the mapper from the flags, or, if the Gateway name is set,
+// sets up the controller building it from the Gateway.
+func newMapper(
+	mgr ctrl.Manager,
+	opts *mapperOptions,
+	gatewayNames []string,
+	nodeSelector labels.Selector,
+) (portmap.Mapper, runFunc, error) {
+	if len(gatewayNames) == 0 {
+		return opts.newMapper(mgr)
+	}
+
+	gateways := gatewayset.New(ctrl.Log.WithName("gateways"))
+	if err := mgr.Add(gateways); err != nil {
+		return nil, nil, err
+	}
+	err := (&controllers.GatewayReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("Gateway"),
+		Scheme: mgr.GetScheme(),
+
+		Gateways: gateways,
+		Build:    opts.gatewayBuilder(mgr),
+		Names:    gatewayNames,
+
+		NodeName:     opts.NodeName,
+		NodeSelector: nodeSelector,
+	}).SetupWithManager(mgr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gateways.Mapper(gatewayNames...), noopRun, nil
+}
+
+func splitGatewayNames(names string) []string {
+	gatewayNames := make([]string, 0)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			gatewayNames = append(gatewayNames, name)
+		}
+	}
+	return gatewayNames
+}
+
+// The Services are mapped at the named gateways only with several of them,
+// so that the mappings at a single gateway are recorded the same way
+// regardless of how it's configured.
+func multiWANGateways(gatewayNames []string) []string {
+	if len(gatewayNames) < 2 { // nolint: gomnd
+		return nil
+	}
+	return gatewayNames
+}
+
+// Returns nil if the registry is disabled.
+func newPortRegistry(mgr ctrl.Manager, namespace, name string) *portregistry.ConfigMap {
+	if name == "" {
+		return nil
+	}
+	return &portregistry.ConfigMap{
+		// Not cached, so that the ConfigMaps of the whole cluster are not.
+		Reader:    mgr.GetAPIReader(),
+		Writer:    mgr.GetClient(),
+		Namespace: namespace,
+		Name:      name,
+	}
+}
+
+// Returns nil if the selector is not set, so that all the nodes are used.
+func parseNodeSelector(selector string) (labels.Selector, error) {
+	if selector == "" {
+		return nil, nil
+	}
+	return labels.Parse(selector)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	portmapv1alpha1 "github.com/MOZGIII/port-map-operator/api/v1alpha1"
+	"github.com/MOZGIII/port-map-operator/pkg/controllers"
+	"github.com/MOZGIII/port-map-operator/pkg/fallback"
+	"github.com/MOZGIII/port-map-operator/pkg/gatewayset"
+	"github.com/MOZGIII/port-map-operator/pkg/natpmp"
+	"github.com/MOZGIII/port-map-operator/pkg/noncestore"
+	"github.com/MOZGIII/port-map-operator/pkg/pcp"
+	"github.com/MOZGIII/port-map-operator/pkg/pcpcliwrap"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	"github.com/MOZGIII/port-map-operator/pkg/upnp"
+	"github.com/MOZGIII/port-map-operator/pkg/workpool"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var (
+	errUnknownBackend         = errors.New("unknown backend")
+	errNoNonceSecretNamespace = errors.New("the namespace of the PCP nonce Secret is not set")
+)
+
+type mapperOptions struct {
+	Backend          string
+	ReprobeInterval  time.Duration
+	PCPServerAddr    string
+	PCPAnnounceAddr  string
+	PCPNonceSecret   string
+	PCPNonceSecretNS string
+	PCPCli           string
+	NATPMPServerAddr string
+	UPnPLocation     string
+
+	UPnPPermanentLeases bool
+
+	// How many requests are made to the gateway at once, and how long
+	// each of them can take.
+	Workers int
+	Timeout time.Duration
+
+	// Set in the per-node mode, every instance has a nonce of its own.
+	NodeName string
+
+	// Shared by the PCP clients of all the gateways, as only one of them
+	// can listen for the ANNOUNCE messages at the address.
+	pcpAnnouncesOnce sync.Once
+	pcpAnnounces     *pcp.AnnounceListener
+}
+
+func (o *mapperOptions) BindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Backend, "backend", "pcp",
+		"The port mapping backend to use: pcp, pcp-cli, natpmp or upnp. "+
+			"Several comma-separated backends are probed in order, and the first one the gateway supports is used.")
+	fs.DurationVar(&o.ReprobeInterval, "backend-reprobe-interval", fallback.DefaultReprobeInterval,
+		"How often to probe the backends again, when several are given, to switch to the preferred one.")
+	fs.StringVar(&o.PCPServerAddr, "pcp-server", "", "The address of the PCP server. If omitted, autodiscovery is attempted.")
+	fs.StringVar(&o.PCPAnnounceAddr, "pcp-announce-bind-address", pcp.DefaultAnnounceAddr,
+		"The address to listen for the PCP ANNOUNCE messages at.")
+	fs.StringVar(&o.PCPNonceSecret, "pcp-nonce-secret", "port-map-operator-pcp-nonce",
+		"The name of the Secret to persist the PCP mapping nonce at. If empty, a new nonce is used on every start.")
+	fs.StringVar(&o.PCPNonceSecretNS, "pcp-nonce-secret-namespace", os.Getenv("POD_NAMESPACE"),
+		"The namespace of the Secret to persist the PCP mapping nonce at.")
+	fs.StringVar(&o.PCPCli, "pcp-cli", "pcp", "The path to the PCP CLI, used with the pcp-cli backend.")
+	fs.StringVar(&o.NATPMPServerAddr, "natpmp-server", "",
+		"The address of the NAT-PMP server. If omitted, the default gateway is used.")
+	fs.StringVar(&o.UPnPLocation, "upnp-location", "",
+		"The URL of the UPnP IGD device description. If omitted, SSDP discovery is attempted.")
+	fs.BoolVar(&o.UPnPPermanentLeases, "upnp-permanent-leases", false,
+		"Map the ports permanently at the UPnP IGD devices that only support permanent leases. "+
+			"Such mappings stay at the device if the operator stops without deleting them.")
+	fs.IntVar(&o.Workers, "mapping-workers", workpool.DefaultWorkers,
+		"How many port mapping requests are made to the gateway at once. "+
+			"The renewals of the mappings about to expire are made before the new mappings.")
+	fs.DurationVar(&o.Timeout, "mapping-timeout", workpool.DefaultTimeout,
+		"How long a single port mapping request can take.")
+}
+
+// Returns the pool of the workers to make the requests to the gateway on.
+func (o *mapperOptions) newPool() *workpool.Pool {
+	return workpool.New(o.Workers, o.Timeout)
+}
+
+type runFunc = gatewayset.RunFunc
+
+func (o *mapperOptions) newMapper(mgr manager.Manager) (portmap.Mapper, runFunc, error) {
+	backends := strings.Split(o.Backend, ",")
+	if len(backends) == 1 {
+		return o.build(context.Background(), mgr, o.Backend, o.serverAddr(o.Backend), "")
+	}
+
+	fallbacks := make([]fallback.Backend, 0, len(backends))
+	for _, backend := range backends {
+		backend = strings.TrimSpace(backend)
+		pm, run, err := o.build(context.Background(), mgr, backend, o.serverAddr(backend), "")
+		if err != nil {
+			return nil, nil, err
+		}
+		fallbacks = append(fallbacks, fallback.Backend{Name: backend, Mapper: pm, Run: run})
+	}
+	pm := fallback.New(ctrl.Log.WithName("fallback"), fallbacks...)
+	pm.ReprobeInterval = o.ReprobeInterval
+	return pm, pm.Run, nil
+}
+
+// The address of the server of the backend, or the location of
+// the UPnP device.
+func (o *mapperOptions) serverAddr(backend string) string {
+	switch backend {
+	case "natpmp":
+		return o.NATPMPServerAddr
+	case "upnp":
+		return o.UPnPLocation
+	default:
+		return o.PCPServerAddr
+	}
+}
+
+// Returns the builder of the mappers of the Gateways. The PCP nonce Secrets
+// are suffixed with the Gateway names.
+func (o *mapperOptions) gatewayBuilder(mgr manager.Manager) controllers.MapperBuilder {
+	return func(
+		ctx context.Context,
+		name string,
+		spec *portmapv1alpha1.GatewaySpec,
+	) (portmap.Mapper, gatewayset.RunFunc, error) {
+		return o.build(ctx, mgr, string(spec.Backend), spec.Address, name)
+	}
+}
+
+// The address is the one of the server, or the location of the UPnP device.
+func (o *mapperOptions) build(
+	ctx context.Context,
+	mgr manager.Manager,
+	backend, addr, nonceSuffix string,
+) (portmap.Mapper, runFunc, error) {
+	switch backend {
+	case "pcp":
+		client, err := o.newPCPClient(ctx, mgr, addr, nonceSuffix)
+		if err != nil {
+			return nil, nil, err
+		}
+		client.Announces = o.pcpAnnounceListener()
+		return client, client.Run, nil
+	case "pcp-cli":
+		pm := pcpcliwrap.New(&pcpcliwrap.Command{
+			CommandName: o.PCPCli,
+			ServerAddr:  addr,
+		})
+		// The CLI processes are limited by the pool all the mappers share.
+		return portmap.Adapt(pm, pcpcliwrap.Capabilities), noopRun, nil
+	case "natpmp":
+		return natpmp.New(addr), noopRun, nil
+	case "upnp":
+		client := upnp.New(addr)
+		client.PermanentLeases = o.UPnPPermanentLeases
+		return client, noopRun, nil
+	default:
+		return nil, nil, fmt.Errorf("%w: %q", errUnknownBackend, backend)
+	}
+}
+
+func (o *mapperOptions) newPCPClient(ctx context.Context, mgr manager.Manager, addr, nonceSuffix string) (*pcp.Client, error) {
+	if o.PCPNonceSecret == "" {
+		return pcp.New(addr)
+	}
+	if o.PCPNonceSecretNS == "" {
+		return nil, errNoNonceSecretNamespace
+	}
+
+	name := o.PCPNonceSecret
+	if nonceSuffix != "" {
+		name += "-" + nonceSuffix
+	}
+	if o.NodeName != "" {
+		name += "-" + o.NodeName
+	}
+
+	store := &noncestore.Secret{
+		// The cache is not running yet when the mapper is built from
+		// the flags.
+		Reader:    mgr.GetAPIReader(),
+		Writer:    mgr.GetClient(),
+		Namespace: o.PCPNonceSecretNS,
+		Name:      name,
+	}
+	return pcp.NewWithNonceStore(ctx, addr, store)
+}
+
+func (o *mapperOptions) pcpAnnounceListener() *pcp.AnnounceListener {
+	o.pcpAnnouncesOnce.Do(func() {
+		o.pcpAnnounces = &pcp.AnnounceListener{Addr: o.PCPAnnounceAddr}
+	})
+	return o.pcpAnnounces
+}
+
+func noopRun(stopch <-chan struct{}) error {
+	<-stopch
+	return nil
+}
+
+// Returns nil if the mapper can't detect the gateway restarts.
+func gatewayRestarts(pm portmap.Mapper) <-chan struct{} {
+	if notifier, ok := pm.(portmap.RestartNotifier); ok {
+		return notifier.Restarts()
+	}
+	return nil
+}
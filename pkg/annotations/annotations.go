@@ -4,15 +4,47 @@ import (
 	"encoding/json"
 	"strconv"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/kustomize/kyaml/errors"
 )
 
-const OverridesV1Key = "port-map.mzg.io/overrides-v1"
+const (
+	OverridesV1Key = "port-map.mzg.io/overrides-v1"
+	OverridesV2Key = "port-map.mzg.io/overrides-v2"
+	NodeKey        = "port-map.mzg.io/node"
+	LifetimeKey    = "port-map.mzg.io/lifetime"
+	GatewaysKey    = "port-map.mzg.io/gateways"
+)
+
+// InputKeys are the annotations set by the users to configure the mapping.
+var InputKeys = []string{OverridesV1Key, OverridesV2Key, NodeKey, LifetimeKey, GatewaysKey}
 
 type Annotations struct {
+	// The overrides of the ports by their numbers.
 	Overrides Overrides
+
+	// The overrides of the ports by their names, only set by the v2
+	// overrides.
+	NamedOverrides map[string]*Override
+
+	// The overrides of the port ranges, only set by the v2 overrides.
+	// The ranges don't overlap.
+	RangeOverrides []RangeOverride
+
+	// The name of the node to map the ports to.
+	// Empty means the node the operator runs at.
+	Node string
+
+	// The lifetime to request for the mappings of all the ports.
+	// 0 means the default.
+	Lifetime time.Duration
+
+	// The names of the gateways to map the ports at.
+	// Nil means all of them.
+	Gateways []string
 }
 
 type Overrides map[PortDescriptor]*Override
@@ -23,20 +55,63 @@ type PortDescriptor struct {
 }
 
 type Override struct {
-	Skip bool
-	Port int32 // 0 means no override
+	Skip     bool
+	Port     int32           // 0 means no override
+	Lifetime metav1.Duration // 0 means no override
+	Policy   PortPolicy      // empty means strict
 }
 
+// PortPolicy tells what to do when the gateway maps another port than
+// requested.
+type PortPolicy string
+
+const (
+	// Reject the mapping to another port.
+	PortPolicyStrict PortPolicy = "strict"
+	// Request the port, but accept whatever port the gateway maps.
+	PortPolicyAcceptAlternative PortPolicy = "accept-alternative"
+	// Let the gateway choose the port.
+	PortPolicyAny PortPolicy = "any"
+)
+
 func FromService(service *corev1.Service) (*Annotations, error) {
-	overrides := make(Overrides)
+	ann := &Annotations{
+		Overrides: make(Overrides),
+		Node:      service.GetAnnotations()[NodeKey],
+	}
 
-	if overridesData, ok := service.GetAnnotations()[OverridesV1Key]; ok {
-		if err := json.Unmarshal([]byte(overridesData), &overrides); err != nil {
+	overridesV1Data, hasV1 := service.GetAnnotations()[OverridesV1Key]
+	overridesV2Data, hasV2 := service.GetAnnotations()[OverridesV2Key]
+	switch {
+	case hasV1 && hasV2:
+		return nil, ErrConflictingOverrides
+	case hasV1:
+		if err := json.Unmarshal([]byte(overridesV1Data), &ann.Overrides); err != nil {
+			return nil, err
+		}
+	case hasV2:
+		if err := ann.parseOverridesV2(overridesV2Data); err != nil {
 			return nil, err
 		}
 	}
 
-	return &Annotations{Overrides: overrides}, nil
+	if err := ann.validateOverrides(); err != nil {
+		return nil, err
+	}
+
+	lifetime, err := parseLifetime(service.GetAnnotations()[LifetimeKey])
+	if err != nil {
+		return nil, err
+	}
+	ann.Lifetime = lifetime
+
+	gateways, err := parseGateways(service.GetAnnotations()[GatewaysKey])
+	if err != nil {
+		return nil, err
+	}
+	ann.Gateways = gateways
+
+	return ann, nil
 }
 
 func (o Overrides) UnmarshalJSON(data []byte) error {
@@ -2,6 +2,7 @@ package annotations
 
 import (
 	"encoding/json"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -43,6 +44,212 @@ var _ = Describe("Annotations", func() {
 		})
 	})
 
+	When("the node is set", func() {
+		It("should parse properly", func() {
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Annotations: map[string]string{
+				NodeKey: "worker-1",
+			}}}
+			ann, err := FromService(&service)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ann).To(Equal(&Annotations{Overrides: make(Overrides), Node: "worker-1"}))
+		})
+	})
+
+	When("the lifetimes are set", func() {
+		It("should parse properly", func() {
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Annotations: map[string]string{
+				LifetimeKey:    "1h",
+				OverridesV1Key: `{"TCP/3000": {"lifetime": "10m"}}`,
+			}}}
+			ann, err := FromService(&service)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ann).To(Equal(&Annotations{
+				Overrides: Overrides{
+					PortDescriptor{
+						Protocol: "TCP",
+						Port:     3000,
+					}: &Override{
+						Lifetime: metav1.Duration{Duration: 10 * time.Minute},
+					},
+				},
+				Lifetime: time.Hour,
+			}))
+		})
+
+		It("should reject the non-positive Service lifetime", func() {
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Annotations: map[string]string{
+				LifetimeKey: "0s",
+			}}}
+			ann, err := FromService(&service)
+			Expect(ann).To(BeNil())
+			Expect(err).To(MatchError(ErrInvalidLifetime))
+		})
+
+		It("should reject the negative port lifetime", func() {
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Annotations: map[string]string{
+				OverridesV1Key: `{"TCP/3000": {"lifetime": "-10m"}}`,
+			}}}
+			ann, err := FromService(&service)
+			Expect(ann).To(BeNil())
+			Expect(err).To(MatchError(ErrInvalidLifetime))
+		})
+
+		It("should reject the malformed Service lifetime", func() {
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Annotations: map[string]string{
+				LifetimeKey: "forever",
+			}}}
+			ann, err := FromService(&service)
+			Expect(ann).To(BeNil())
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	When("the port policies are set", func() {
+		It("should parse properly", func() {
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Annotations: map[string]string{
+				OverridesV1Key: `{"TCP/80": {"policy": "accept-alternative"}, "UDP/5000": {"policy": "any"}}`,
+			}}}
+			ann, err := FromService(&service)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ann).To(Equal(&Annotations{
+				Overrides: Overrides{
+					PortDescriptor{Protocol: "TCP", Port: 80}:   &Override{Policy: PortPolicyAcceptAlternative},
+					PortDescriptor{Protocol: "UDP", Port: 5000}: &Override{Policy: PortPolicyAny},
+				},
+			}))
+		})
+
+		It("should reject the unknown policy", func() {
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Annotations: map[string]string{
+				OverridesV1Key: `{"TCP/80": {"policy": "whatever"}}`,
+			}}}
+			ann, err := FromService(&service)
+			Expect(ann).To(BeNil())
+			Expect(err).To(MatchError(ErrInvalidPortPolicy))
+		})
+	})
+
+	When("the gateways are set", func() {
+		It("should parse properly", func() {
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Annotations: map[string]string{
+				GatewaysKey: "fibre, lte",
+			}}}
+			ann, err := FromService(&service)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ann).To(Equal(&Annotations{Overrides: make(Overrides), Gateways: []string{"fibre", "lte"}}))
+		})
+
+		It("should reject the invalid names", func() {
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Annotations: map[string]string{
+				GatewaysKey: "fibre,,LTE",
+			}}}
+			ann, err := FromService(&service)
+			Expect(ann).To(BeNil())
+			Expect(err).To(MatchError(ErrInvalidGateways))
+		})
+	})
+
+	When("the v1 overrides have an unsupported protocol", func() {
+		It("should keep them, as the v2 validation doesn't apply", func() {
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Annotations: map[string]string{
+				OverridesV1Key: `{"tcp/80": {"port": 8080}}`,
+			}}}
+			ann, err := FromService(&service)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ann.Overrides).To(Equal(Overrides{
+				PortDescriptor{Protocol: "tcp", Port: 80}: &Override{Port: 8080},
+			}))
+		})
+	})
+
+	When("the v2 overrides are set", func() {
+		fromOverridesV2 := func(data string) (*Annotations, error) {
+			return FromService(&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Annotations: map[string]string{
+				OverridesV2Key: data,
+			}}})
+		}
+
+		It("should parse properly", func() {
+			ann, err := fromOverridesV2(`{"http": {"port": 80}, "TCP/8443": {"skip": true}, "UDP/30000-30009": {"port": 40000}}`)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ann).To(Equal(&Annotations{
+				Overrides: Overrides{
+					PortDescriptor{Protocol: "TCP", Port: 8443}: &Override{Skip: true},
+				},
+				NamedOverrides: map[string]*Override{
+					"http": {Port: 80},
+				},
+				RangeOverrides: []RangeOverride{
+					{Protocol: "UDP", From: 30000, To: 30009, Override: &Override{Port: 40000}},
+				},
+			}))
+		})
+
+		It("should prefer the names, then the port numbers, then the ranges", func() {
+			ann, err := fromOverridesV2(`{"http": {"port": 80}, "TCP/8080": {"port": 81}, "TCP/8000-8999": {"port": 9000}}`)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			override, ok := ann.OverrideFor(&corev1.ServicePort{Name: "http", Protocol: "TCP", Port: 8080})
+			Expect(ok).To(BeTrue())
+			Expect(override.Port).To(Equal(int32(80)))
+
+			override, ok = ann.OverrideFor(&corev1.ServicePort{Name: "web", Protocol: "TCP", Port: 8080})
+			Expect(ok).To(BeTrue())
+			Expect(override.Port).To(Equal(int32(81)))
+
+			override, ok = ann.OverrideFor(&corev1.ServicePort{Protocol: "TCP", Port: 8005})
+			Expect(ok).To(BeTrue())
+			Expect(override.Port).To(Equal(int32(9005)))
+
+			_, ok = ann.OverrideFor(&corev1.ServicePort{Protocol: "UDP", Port: 8005})
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should accept the SCTP ports", func() {
+			ann, err := fromOverridesV2(`{"SCTP/80": {"port": 8080}, "SCTP/9000-9009": {}}`)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ann.Overrides).To(Equal(Overrides{
+				PortDescriptor{Protocol: "SCTP", Port: 80}: &Override{Port: 8080},
+			}))
+			Expect(ann.RangeOverrides).To(Equal([]RangeOverride{
+				{Protocol: "SCTP", From: 9000, To: 9009, Override: &Override{}},
+			}))
+		})
+
+		It("should reject the v1 overrides alongside", func() {
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Annotations: map[string]string{
+				OverridesV1Key: `{}`,
+				OverridesV2Key: `{}`,
+			}}}
+			ann, err := FromService(&service)
+			Expect(ann).To(BeNil())
+			Expect(err).To(MatchError(ErrConflictingOverrides))
+		})
+
+		for _, invalid := range []struct{ name, data string }{
+			{"unknown field", `{"TCP/80": {"prot": 8080}}`},
+			{"unsupported protocol", `{"ICMP/80": {"port": 8080}}`},
+			{"lowercase protocol", `{"tcp/80": {"port": 8080}}`},
+			{"invalid port", `{"TCP/http": {"port": 8080}}`},
+			{"zero port", `{"TCP/0": {"port": 8080}}`},
+			{"port out of range", `{"TCP/65536": {"port": 8080}}`},
+			{"invalid port name", `{"HTTP_PORT": {"port": 8080}}`},
+			{"empty range", `{"TCP/90-80": {}}`},
+			{"overlapping ranges", `{"TCP/80-90": {}, "TCP/90-100": {}}`},
+			{"same port twice", `{"TCP/80": {}, "TCP/080": {}, "TCP/80-80": {}}`},
+			{"gateway ports out of range", `{"TCP/80-90": {"port": 65530}}`},
+			{"invalid gateway port", `{"TCP/80": {"port": 70000}}`},
+			{"malformed JSON", `{`},
+		} {
+			invalid := invalid
+			It("should reject the "+invalid.name, func() {
+				ann, err := fromOverridesV2(invalid.data)
+				Expect(ann).To(BeNil())
+				Expect(err).To(MatchError(ErrInvalidOverride))
+			})
+		}
+	})
+
 	When("set to an invalid value", func() {
 		It("should return a JSON parsing error", func() {
 			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Annotations: map[string]string{
@@ -0,0 +1,28 @@
+package annotations
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var ErrInvalidGateways = errors.New("invalid gateway names")
+
+// Returns nil if the gateways are not set.
+func parseGateways(data string) ([]string, error) {
+	if data == "" {
+		return nil, nil
+	}
+
+	gateways := make([]string, 0)
+	for _, name := range strings.Split(data, ",") {
+		name = strings.TrimSpace(name)
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			return nil, fmt.Errorf("%w: %q: %s", ErrInvalidGateways, name, strings.Join(errs, ", "))
+		}
+		gateways = append(gateways, name)
+	}
+	return gateways, nil
+}
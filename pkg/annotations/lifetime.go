@@ -0,0 +1,32 @@
+package annotations
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidLifetime = errors.New("lifetime must be positive")
+
+// Returns 0 if the lifetime is not set.
+func parseLifetime(data string) (time.Duration, error) {
+	if data == "" {
+		return 0, nil
+	}
+
+	lifetime, err := time.ParseDuration(data)
+	if err != nil {
+		return 0, err
+	}
+	if lifetime <= 0 {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidLifetime, lifetime)
+	}
+	return lifetime, nil
+}
+
+func (o *Override) validateLifetime(key string) error {
+	if o.Lifetime.Duration < 0 {
+		return fmt.Errorf("%w: %s: %s", ErrInvalidLifetime, key, o.Lifetime.Duration)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package annotations
+
+import (
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// MappedV1Key is the annotation the operator records the port mappings
+// it has created for the Service at, so they can be deleted later.
+const MappedV1Key = "port-map.mzg.io/mapped-v1"
+
+type Mapping struct {
+	// The name of the gateway, empty for the default one.
+	Gateway     string          `json:"gateway,omitempty"`
+	Protocol    corev1.Protocol `json:"protocol"`
+	NodePort    int32           `json:"nodePort"`
+	GatewayPort int32           `json:"gatewayPort"`
+	InternalIP  string          `json:"internalIP,omitempty"`
+}
+
+func MappedFromService(service *corev1.Service) ([]Mapping, error) {
+	data, ok := service.GetAnnotations()[MappedV1Key]
+	if !ok {
+		return nil, nil
+	}
+
+	var mapped []Mapping
+	if err := json.Unmarshal([]byte(data), &mapped); err != nil {
+		return nil, err
+	}
+	return mapped, nil
+}
+
+// SetMapped records the mappings at the Service, removing the annotation
+// if there are none.
+func SetMapped(service *corev1.Service, mapped []Mapping) error {
+	if len(mapped) == 0 {
+		delete(service.Annotations, MappedV1Key)
+		return nil
+	}
+
+	data, err := json.Marshal(mapped)
+	if err != nil {
+		return err
+	}
+
+	if service.Annotations == nil {
+		service.Annotations = make(map[string]string)
+	}
+	service.Annotations[MappedV1Key] = string(data)
+	return nil
+}
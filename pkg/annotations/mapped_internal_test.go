@@ -0,0 +1,47 @@
+package annotations
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Mapped", func() {
+	When("not set", func() {
+		It("should be empty", func() {
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service"}}
+			mapped, err := MappedFromService(&service)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(mapped).To(BeEmpty())
+		})
+	})
+
+	When("set", func() {
+		It("should round trip", func() {
+			mapped := []Mapping{
+				{Protocol: "TCP", NodePort: 32100, GatewayPort: 80},
+				{Protocol: "UDP", NodePort: 32101, GatewayPort: 53, InternalIP: "192.168.0.10"},
+			}
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service"}}
+			Expect(SetMapped(&service, mapped)).To(Succeed())
+			Expect(service.Annotations).To(HaveKeyWithValue(MappedV1Key,
+				`[{"protocol":"TCP","nodePort":32100,"gatewayPort":80},`+
+					`{"protocol":"UDP","nodePort":32101,"gatewayPort":53,"internalIP":"192.168.0.10"}]`))
+
+			parsed, err := MappedFromService(&service)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(parsed).To(Equal(mapped))
+		})
+	})
+
+	When("set to nothing", func() {
+		It("should remove the annotation", func() {
+			service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Annotations: map[string]string{
+				MappedV1Key: `[{"protocol":"TCP","nodePort":32100,"gatewayPort":80}]`,
+			}}}
+			Expect(SetMapped(&service, nil)).To(Succeed())
+			Expect(service.Annotations).NotTo(HaveKey(MappedV1Key))
+		})
+	})
+})
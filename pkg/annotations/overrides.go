@@ -0,0 +1,269 @@
+package annotations
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var (
+	ErrInvalidOverride      = errors.New("invalid override")
+	ErrConflictingOverrides = errors.New("only one of the v1 and v2 overrides can be set")
+	ErrUnknownPort          = errors.New("the override refers to a port the Service doesn't have")
+
+	errUnsupportedProtocol = errors.New("unsupported protocol")
+	errInvalidPort         = errors.New("invalid port")
+	errEmptyPortRange      = errors.New("empty port range")
+)
+
+// RangeOverride is the override of a contiguous range of ports.
+type RangeOverride struct {
+	Protocol corev1.Protocol
+	From     int32
+	To       int32 // inclusive
+
+	// The port is the gateway port of the first port of the range,
+	// the rest of the range follows it.
+	Override *Override
+}
+
+func (r *RangeOverride) contains(port *corev1.ServicePort) bool {
+	return r.Protocol == port.Protocol && r.From <= port.Port && port.Port <= r.To
+}
+
+// OverrideFor returns the override of the Service port, if any.
+// The overrides by the port name win over the ones by the port number,
+// and those win over the port ranges.
+func (a *Annotations) OverrideFor(port *corev1.ServicePort) (*Override, bool) {
+	if override := a.NamedOverrides[port.Name]; port.Name != "" && override != nil {
+		return override, true
+	}
+	if override := a.Overrides[PortDescriptor{Port: port.Port, Protocol: port.Protocol}]; override != nil {
+		return override, true
+	}
+	for i := range a.RangeOverrides {
+		r := &a.RangeOverrides[i]
+		if !r.contains(port) || r.Override == nil {
+			continue
+		}
+		override := *r.Override
+		if override.Port > 0 {
+			override.Port += port.Port - r.From
+		}
+		return &override, true
+	}
+	return nil, false
+}
+
+// Parses the v2 overrides. The keys are either the port names,
+// or `<protocol>/<port>`, or `<protocol>/<from>-<to>`.
+func (a *Annotations) parseOverridesV2(data string) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidOverride, err)
+	}
+
+	for key, value := range m {
+		override, err := decodeOverride(value)
+		if err != nil {
+			return fmt.Errorf("%w: %q: %v", ErrInvalidOverride, key, err)
+		}
+		if override.Port < 0 || override.Port > math.MaxUint16 {
+			return fmt.Errorf("%w: %q: %v %d", ErrInvalidOverride, key, errInvalidPort, override.Port)
+		}
+		if err := a.addOverrideV2(key, override); err != nil {
+			return err
+		}
+	}
+
+	return a.checkRangeOverlaps()
+}
+
+func decodeOverride(data json.RawMessage) (*Override, error) {
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+
+	var override Override
+	if err := decoder.Decode(&override); err != nil {
+		return nil, err
+	}
+	return &override, nil
+}
+
+func (a *Annotations) addOverrideV2(key string, override *Override) error {
+	split := strings.SplitN(key, "/", 2) // nolint: gomnd
+	if len(split) == 1 {
+		if errs := validation.IsDNS1123Label(key); len(errs) > 0 {
+			return fmt.Errorf("%w: %q: invalid port name: %s", ErrInvalidOverride, key, strings.Join(errs, ", "))
+		}
+		if a.NamedOverrides == nil {
+			a.NamedOverrides = make(map[string]*Override)
+		}
+		a.NamedOverrides[key] = override
+		return nil
+	}
+
+	protocol, err := parseProtocol(split[0])
+	if err != nil {
+		return fmt.Errorf("%w: %q: %v", ErrInvalidOverride, key, err)
+	}
+	from, to, err := parsePortRange(split[1])
+	if err != nil {
+		return fmt.Errorf("%w: %q: %v", ErrInvalidOverride, key, err)
+	}
+
+	if from == to {
+		pd := PortDescriptor{Protocol: protocol, Port: from}
+		if _, ok := a.Overrides[pd]; ok {
+			// Not naming the key, as which of them comes second is up to chance.
+			return fmt.Errorf("%w: the port %s/%d is overridden more than once", ErrInvalidOverride, protocol, from)
+		}
+		a.Overrides[pd] = override
+		return nil
+	}
+	if override.Port > 0 && int64(override.Port)+int64(to-from) > math.MaxUint16 {
+		return fmt.Errorf("%w: %q: the gateway ports go past %d", ErrInvalidOverride, key, math.MaxUint16)
+	}
+	a.RangeOverrides = append(a.RangeOverrides, RangeOverride{
+		Protocol: protocol,
+		From:     from,
+		To:       to,
+		Override: override,
+	})
+	return nil
+}
+
+// The ranges are sorted along the way, so that the outcome doesn't depend
+// on the order of the keys.
+func (a *Annotations) checkRangeOverlaps() error {
+	sort.Slice(a.RangeOverrides, func(i, j int) bool {
+		ri, rj := a.RangeOverrides[i], a.RangeOverrides[j]
+		if ri.Protocol != rj.Protocol {
+			return ri.Protocol < rj.Protocol
+		}
+		return ri.From < rj.From
+	})
+
+	for i := 1; i < len(a.RangeOverrides); i++ {
+		prev, next := a.RangeOverrides[i-1], a.RangeOverrides[i]
+		if prev.Protocol == next.Protocol && next.From <= prev.To {
+			return fmt.Errorf(
+				"%w: the ranges %s/%d-%d and %s/%d-%d overlap", ErrInvalidOverride,
+				prev.Protocol, prev.From, prev.To, next.Protocol, next.From, next.To,
+			)
+		}
+	}
+	return nil
+}
+
+func parseProtocol(data string) (corev1.Protocol, error) {
+	switch protocol := corev1.Protocol(data); protocol {
+	case corev1.ProtocolTCP, corev1.ProtocolUDP, corev1.ProtocolSCTP:
+		return protocol, nil
+	default:
+		return "", fmt.Errorf("%w %q", errUnsupportedProtocol, data)
+	}
+}
+
+func parsePortRange(data string) (from, to int32, err error) {
+	split := strings.SplitN(data, "-", 2) // nolint: gomnd
+	if from, err = parsePort(split[0]); err != nil {
+		return 0, 0, err
+	}
+	if len(split) == 1 {
+		return from, from, nil
+	}
+	if to, err = parsePort(split[1]); err != nil {
+		return 0, 0, err
+	}
+	if to < from {
+		return 0, 0, fmt.Errorf("%w %d-%d", errEmptyPortRange, from, to)
+	}
+	return from, to, nil
+}
+
+func parsePort(data string) (int32, error) {
+	port, err := strconv.ParseUint(data, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("%w %q", errInvalidPort, data)
+	}
+	return int32(port), nil
+}
+
+// Validates the overrides regardless of the version they come from.
+// The v2 ones are checked more strictly as they are parsed, the v1 ones
+// keep the looser checks they have always had.
+func (a *Annotations) validateOverrides() error {
+	for pd, override := range a.Overrides {
+		if err := override.validate(fmt.Sprintf("%s/%d", pd.Protocol, pd.Port)); err != nil {
+			return err
+		}
+	}
+	for name, override := range a.NamedOverrides {
+		if err := override.validate(name); err != nil {
+			return err
+		}
+	}
+	for _, r := range a.RangeOverrides {
+		if err := r.Override.validate(fmt.Sprintf("%s/%d-%d", r.Protocol, r.From, r.To)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Override) validate(key string) error {
+	if o == nil {
+		return nil
+	}
+	if err := o.validateLifetime(key); err != nil {
+		return err
+	}
+	return o.validatePolicy(key)
+}
+
+// CheckPortReferences makes sure every override refers to a port
+// of the Service.
+func (a *Annotations) CheckPortReferences(ports []corev1.ServicePort) error {
+	names := make(map[string]struct{}, len(ports))
+	for i := range ports {
+		names[ports[i].Name] = struct{}{}
+	}
+	for name := range a.NamedOverrides {
+		if _, ok := names[name]; !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownPort, name)
+		}
+	}
+
+	for pd := range a.Overrides {
+		if !hasPort(ports, func(port *corev1.ServicePort) bool {
+			return port.Protocol == pd.Protocol && port.Port == pd.Port
+		}) {
+			return fmt.Errorf("%w: %s/%d", ErrUnknownPort, pd.Protocol, pd.Port)
+		}
+	}
+
+	for i := range a.RangeOverrides {
+		r := &a.RangeOverrides[i]
+		if !hasPort(ports, r.contains) {
+			return fmt.Errorf("%w: %s/%d-%d", ErrUnknownPort, r.Protocol, r.From, r.To)
+		}
+	}
+	return nil
+}
+
+func hasPort(ports []corev1.ServicePort, matches func(port *corev1.ServicePort) bool) bool {
+	for i := range ports {
+		if matches(&ports[i]) {
+			return true
+		}
+	}
+	return false
+}
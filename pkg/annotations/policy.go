@@ -0,0 +1,29 @@
+package annotations
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidPortPolicy = errors.New("invalid port policy")
+
+func (p PortPolicy) valid() bool {
+	switch p {
+	case "", PortPolicyStrict, PortPolicyAcceptAlternative, PortPolicyAny:
+		return true
+	default:
+		return false
+	}
+}
+
+// Flexible tells whether the gateway may map another port than requested.
+func (p PortPolicy) Flexible() bool {
+	return p == PortPolicyAcceptAlternative || p == PortPolicyAny
+}
+
+func (o *Override) validatePolicy(key string) error {
+	if !o.Policy.valid() {
+		return fmt.Errorf("%w: %s: %q", ErrInvalidPortPolicy, key, o.Policy)
+	}
+	return nil
+}
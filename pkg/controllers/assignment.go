@@ -0,0 +1,287 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/MOZGIII/port-map-operator/pkg/annotations"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// In the per-node mode, an instance runs at every node and watches all
+// the Services, but only maps the ports of the ones assigned to its node.
+// The assignment is computed from the cluster state alone, so all
+// the instances agree on it without talking to each other.
+
+// Whether the reconciler runs in the per-node mode.
+func (r *ServiceReconciler) perNode() bool {
+	return r.NodeName != ""
+}
+
+// Returns the node the ports of the Service have to be mapped to, and
+// which of the recorded mappings are up to this instance.
+func (r *ServiceReconciler) assign(
+	ctx context.Context,
+	service *corev1.Service,
+	ann *annotations.Annotations,
+) (string, *mappingOwnership, error) {
+	nodes, err := r.eligibleNodes(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to list the nodes: %w", err)
+	}
+
+	nodeName, err := r.targetNode(ctx, service, ann, nodes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	owners, err := r.mappingOwnership(ctx, nodes)
+	if err != nil {
+		return "", nil, err
+	}
+	return nodeName, owners, nil
+}
+
+// Returns the nodes the Services can be assigned to, sorted by name.
+// Returns nil in the single-instance mode.
+func (r *ServiceReconciler) eligibleNodes(ctx context.Context) ([]corev1.Node, error) {
+	if !r.perNode() {
+		return nil, nil
+	}
+	return listEligibleNodes(ctx, r, r.NodeSelector)
+}
+
+// Lists the ready nodes matching the selector, sorted by name. Nil
+// selector means all the nodes.
+func listEligibleNodes(ctx context.Context, reader client.Reader, selector labels.Selector) ([]corev1.Node, error) {
+	var opts []client.ListOption
+	if selector != nil {
+		opts = append(opts, client.MatchingLabelsSelector{Selector: selector})
+	}
+
+	var nodes corev1.NodeList
+	if err := reader.List(ctx, &nodes, opts...); err != nil {
+		return nil, err
+	}
+
+	eligible := make([]corev1.Node, 0, len(nodes.Items))
+	for i := range nodes.Items {
+		if nodeReady(&nodes.Items[i]) {
+			eligible = append(eligible, nodes.Items[i])
+		}
+	}
+	sort.Slice(eligible, func(i, j int) bool { return eligible[i].Name < eligible[j].Name })
+	return eligible, nil
+}
+
+// Returns the name of the node the ports of the Service have to be
+// mapped to.
+// In the single-instance mode, an empty name means the host the operator
+// runs at. In the per-node mode, it means that no node can take the Service.
+func (r *ServiceReconciler) targetNode(
+	ctx context.Context,
+	service *corev1.Service,
+	ann *annotations.Annotations,
+	nodes []corev1.Node,
+) (string, error) {
+	if ann.Node != "" {
+		return ann.Node, nil
+	}
+
+	candidates := nodeNames(nodes)
+	if followsEndpoints(service, ann) {
+		endpointNodes, err := r.endpointNodes(ctx, service)
+		if err != nil {
+			return "", err
+		}
+		if !r.perNode() {
+			return r.endpointNode(ctx, service, endpointNodes)
+		}
+		candidates = intersectSorted(candidates, endpointNodes)
+	}
+
+	if !r.perNode() {
+		return "", nil
+	}
+	return rendezvousNode(service, candidates), nil
+}
+
+// Picks a node via rendezvous hashing: the Services are spread over
+// the nodes, and only the Services of a node move when it comes or goes.
+func rendezvousNode(service *corev1.Service, nodes []string) string {
+	return rendezvousNodeFor(service.Namespace+"/"+service.Name, nodes)
+}
+
+// Picks a node for whatever the key names via rendezvous hashing.
+func rendezvousNodeFor(key string, nodes []string) string {
+	var (
+		best      string
+		bestScore uint64
+	)
+	for _, node := range nodes {
+		sum := sha256.Sum256([]byte(node + "/" + key))
+		score := binary.BigEndian.Uint64(sum[:8])
+		if best == "" || score > bestScore {
+			best, bestScore = node, score
+		}
+	}
+	return best
+}
+
+func nodeNames(nodes []corev1.Node) []string {
+	names := make([]string, 0, len(nodes))
+	for i := range nodes {
+		names = append(names, nodes[i].Name)
+	}
+	return names
+}
+
+// Both lists are expected to be sorted.
+func intersectSorted(a, b []string) []string {
+	result := make([]string, 0)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+func nodeReady(node *corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func nodeAddress(node *corev1.Node) net.IP {
+	for _, addr := range node.Status.Addresses {
+		if addr.Type != corev1.NodeInternalIP {
+			continue
+		}
+		if ip := net.ParseIP(addr.Address); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// Tells which of the recorded mappings this instance has to delete when
+// they are no longer needed: the ones to its own node, and the orphaned
+// ones, pointing to no eligible node, that nobody else would take care of.
+// Nil means the single-instance mode, where all the mappings are ours.
+type mappingOwnership struct {
+	nodeIP      string
+	eligibleIPs map[string]struct{}
+}
+
+func (r *ServiceReconciler) mappingOwnership(ctx context.Context, nodes []corev1.Node) (*mappingOwnership, error) {
+	if !r.perNode() {
+		return nil, nil
+	}
+
+	nodeIP, err := r.nodeInternalIP(ctx, r.NodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	eligibleIPs := make(map[string]struct{}, len(nodes))
+	for i := range nodes {
+		if ip := nodeAddress(&nodes[i]); ip != nil {
+			eligibleIPs[ip.String()] = struct{}{}
+		}
+	}
+
+	return &mappingOwnership{nodeIP: nodeIP.String(), eligibleIPs: eligibleIPs}, nil
+}
+
+func (o *mappingOwnership) owns(mapping annotations.Mapping) bool {
+	return o == nil || mapping.InternalIP == o.nodeIP || o.orphaned(mapping)
+}
+
+func (o *mappingOwnership) orphaned(mapping annotations.Mapping) bool {
+	if o == nil || mapping.InternalIP == o.nodeIP {
+		return false
+	}
+	_, ok := o.eligibleIPs[mapping.InternalIP]
+	return !ok
+}
+
+// Splits the mappings into ours and the ones of the other nodes.
+func (o *mappingOwnership) split(mapped []annotations.Mapping) (own, others []annotations.Mapping) {
+	own = make([]annotations.Mapping, 0, len(mapped))
+	others = make([]annotations.Mapping, 0)
+	for _, mapping := range mapped {
+		if o.owns(mapping) {
+			own = append(own, mapping)
+		} else {
+			others = append(others, mapping)
+		}
+	}
+	return own, others
+}
+
+// The orphaned mappings that failed to be deleted are forgotten: they
+// were likely created by another instance, so the gateway won't let us
+// delete them, but nobody renews them either, so they expire soon.
+func (o *mappingOwnership) dropOrphans(log logr.Logger, remaining []annotations.Mapping) []annotations.Mapping {
+	kept := make([]annotations.Mapping, 0, len(remaining))
+	for _, mapping := range remaining {
+		if o.orphaned(mapping) {
+			log.Info("unable to delete the orphaned port mapping, leaving it to expire", "mapping", mapping)
+			continue
+		}
+		kept = append(kept, mapping)
+	}
+	return kept
+}
+
+// Passes the Node events that may change the assignment of the Services.
+var nodeAssignmentChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldNode, ok := e.ObjectOld.(*corev1.Node)
+		if !ok {
+			return false
+		}
+		newNode, ok := e.ObjectNew.(*corev1.Node)
+		if !ok {
+			return false
+		}
+		return nodeReady(oldNode) != nodeReady(newNode) ||
+			!nodeAddress(oldNode).Equal(nodeAddress(newNode)) ||
+			!labelsEqual(oldNode.Labels, newNode.Labels)
+	},
+	GenericFunc: func(_ event.GenericEvent) bool {
+		return false
+	},
+}
+
+func labelsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
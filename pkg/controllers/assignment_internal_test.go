@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/MOZGIII/port-map-operator/pkg/annotations"
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+var _ = Describe("Node assignment", func() {
+	serviceNamed := func(name string) *corev1.Service {
+		return &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+	}
+
+	It("Should pick the same node regardless of the order", func() {
+		service := serviceNamed("test")
+		Expect(rendezvousNode(service, []string{"a", "b", "c"})).
+			To(Equal(rendezvousNode(service, []string{"c", "a", "b"})))
+	})
+
+	It("Should pick nothing when there are no nodes", func() {
+		Expect(rendezvousNode(serviceNamed("test"), nil)).To(BeEmpty())
+	})
+
+	It("Should only move the Services of the removed node", func() {
+		nodes := []string{"a", "b", "c"}
+		for i := 0; i < 50; i++ {
+			service := serviceNamed(fmt.Sprintf("test-%d", i))
+			before := rendezvousNode(service, nodes)
+			after := rendezvousNode(service, []string{"a", "c"})
+			if before != "b" {
+				Expect(after).To(Equal(before))
+			}
+		}
+	})
+
+	It("Should spread the Services over the nodes", func() {
+		picked := make(map[string]int)
+		for i := 0; i < 50; i++ {
+			picked[rendezvousNode(serviceNamed(fmt.Sprintf("test-%d", i)), []string{"a", "b", "c"})]++
+		}
+		Expect(picked).To(HaveLen(3))
+	})
+
+	It("Should intersect the node lists", func() {
+		Expect(intersectSorted([]string{"a", "b", "d"}, []string{"b", "c", "d"})).To(Equal([]string{"b", "d"}))
+		Expect(intersectSorted([]string{"a"}, []string{"b"})).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Mapping ownership", func() {
+	var owners *mappingOwnership
+
+	mappingTo := func(ip string) annotations.Mapping {
+		return annotations.Mapping{Protocol: corev1.ProtocolTCP, NodePort: 30000, GatewayPort: 80, InternalIP: ip}
+	}
+
+	BeforeEach(func() {
+		owners = &mappingOwnership{
+			nodeIP:      "192.168.0.10",
+			eligibleIPs: map[string]struct{}{"192.168.0.10": {}, "192.168.0.11": {}},
+		}
+	})
+
+	It("Should own the mappings to its node", func() {
+		Expect(owners.owns(mappingTo("192.168.0.10"))).To(BeTrue())
+		Expect(owners.orphaned(mappingTo("192.168.0.10"))).To(BeFalse())
+	})
+
+	It("Should leave the mappings to other eligible nodes alone", func() {
+		Expect(owners.owns(mappingTo("192.168.0.11"))).To(BeFalse())
+	})
+
+	It("Should own the orphaned mappings", func() {
+		Expect(owners.owns(mappingTo("192.168.0.12"))).To(BeTrue())
+		Expect(owners.orphaned(mappingTo("192.168.0.12"))).To(BeTrue())
+		Expect(owners.owns(mappingTo(""))).To(BeTrue())
+	})
+
+	It("Should split the mappings", func() {
+		own, others := owners.split([]annotations.Mapping{
+			mappingTo("192.168.0.10"), mappingTo("192.168.0.11"), mappingTo("192.168.0.12"),
+		})
+		Expect(own).To(Equal([]annotations.Mapping{mappingTo("192.168.0.10"), mappingTo("192.168.0.12")}))
+		Expect(others).To(Equal([]annotations.Mapping{mappingTo("192.168.0.11")}))
+	})
+
+	It("Should forget the orphaned mappings that failed to be deleted", func() {
+		remaining := owners.dropOrphans(
+			logr.Discard(),
+			[]annotations.Mapping{mappingTo("192.168.0.10"), mappingTo("192.168.0.12")},
+		)
+		Expect(remaining).To(Equal([]annotations.Mapping{mappingTo("192.168.0.10")}))
+	})
+
+	Context("in the single-instance mode", func() {
+		BeforeEach(func() {
+			owners = nil
+		})
+
+		It("Should own all the mappings", func() {
+			own, others := owners.split([]annotations.Mapping{mappingTo("192.168.0.11"), mappingTo("")})
+			Expect(own).To(HaveLen(2))
+			Expect(others).To(BeEmpty())
+			Expect(owners.dropOrphans(logr.Discard(), own)).To(Equal(own))
+		})
+	})
+})
+
+var _ = Describe("Node assignment changes", func() {
+	var oldNode, newNode *corev1.Node
+
+	BeforeEach(func() {
+		oldNode = &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "worker-1", Labels: map[string]string{"role": "gateway"}},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+				Addresses:  []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "192.168.0.10"}},
+			},
+		}
+		newNode = oldNode.DeepCopy()
+	})
+
+	changed := func() bool {
+		return nodeAssignmentChanged.Update(event.UpdateEvent{ObjectOld: oldNode, ObjectNew: newNode})
+	}
+
+	It("Should ignore the irrelevant updates", func() {
+		newNode.Status.Conditions = append(newNode.Status.Conditions, corev1.NodeCondition{
+			Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse,
+		})
+		Expect(changed()).To(BeFalse())
+	})
+
+	It("Should pass the readiness changes", func() {
+		newNode.Status.Conditions[0].Status = corev1.ConditionFalse
+		Expect(changed()).To(BeTrue())
+	})
+
+	It("Should pass the label changes", func() {
+		newNode.Labels["role"] = "worker"
+		Expect(changed()).To(BeTrue())
+	})
+
+	It("Should pass the address changes", func() {
+		newNode.Status.Addresses[0].Address = "192.168.0.11"
+		Expect(changed()).To(BeTrue())
+	})
+})
@@ -0,0 +1,189 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/MOZGIII/port-map-operator/pkg/annotations"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// FinalizerName is the finalizer that keeps the Service around until
+// the port mappings created for it are deleted.
+const FinalizerName = "port-map.mzg.io/cleanup"
+
+var ErrUnmapFailed = errors.New("unable to delete some of the port mappings")
+
+// Deletes the port mappings recorded at the Service, and then releases
+// the finalizer.
+// Used when the Service is deleted or is no longer a LoadBalancer meant
+// for this operator.
+func (r *ServiceReconciler) cleanup(ctx context.Context, log logr.Logger, service *corev1.Service) error {
+	if !controllerutil.ContainsFinalizer(service, FinalizerName) {
+		log.V(1).Info("service is not a LoadBalancer or is being deleted, and has nothing to clean up, skipping")
+		if err := r.releasePorts(ctx, client.ObjectKeyFromObject(service)); err != nil {
+			log.Error(err, "unable to release the gateway ports")
+			return err
+		}
+		if err := r.deletePortMappings(ctx, service, nil); err != nil {
+			log.Error(err, "unable to delete the PortMappings")
+			return err
+		}
+		// The ingress might be set by some other controller,
+		// but the condition is ours for sure.
+		return r.clearStatus(ctx, service, false)
+	}
+
+	nodes, err := r.eligibleNodes(ctx)
+	if err != nil {
+		log.Error(err, "unable to list the nodes")
+		return err
+	}
+	owners, err := r.mappingOwnership(ctx, nodes)
+	if err != nil {
+		log.Error(err, "unable to determine the address of the node", "node", r.NodeName)
+		return err
+	}
+
+	serviceCopy, err := r.releaseMappings(ctx, log, service, owners)
+	if err != nil {
+		// Retry with a backoff.
+		return err
+	}
+
+	if controllerutil.ContainsFinalizer(serviceCopy, FinalizerName) {
+		log.V(1).Info("the port mappings of the other nodes are left for their instances to clean up")
+		return nil
+	}
+
+	log.Info("port mappings cleaned up")
+	// The gateway ports are free now, hand them over.
+	if err := r.releasePorts(ctx, client.ObjectKeyFromObject(service)); err != nil {
+		log.Error(err, "unable to release the gateway ports")
+		return err
+	}
+	if err := r.deletePortMappings(ctx, service, nil); err != nil {
+		log.Error(err, "unable to delete the PortMappings")
+		return err
+	}
+	return r.clearStatus(ctx, serviceCopy, true)
+}
+
+// Deletes the recorded port mappings this instance is responsible for,
+// and updates the record, releasing the finalizer once it's empty.
+// Returns the updated Service.
+func (r *ServiceReconciler) releaseMappings(
+	ctx context.Context,
+	log logr.Logger,
+	service *corev1.Service,
+	owners *mappingOwnership,
+) (*corev1.Service, error) {
+	mapped, err := annotations.MappedFromService(service)
+	if err != nil {
+		// Not much we can do here, the mappings will expire eventually.
+		log.Error(err, "unable to parse the recorded mappings, leaving them to expire")
+	}
+
+	own, others := owners.split(mapped)
+	remaining := owners.dropOrphans(log, r.unmapPorts(ctx, log, service, own))
+	others = append(others, remaining...)
+	record := others
+
+	serviceCopy := service.DeepCopy()
+	if err := annotations.SetMapped(serviceCopy, record); err != nil {
+		return nil, err
+	}
+	if len(record) == 0 {
+		controllerutil.RemoveFinalizer(serviceCopy, FinalizerName)
+	}
+
+	if err := r.updateMetadata(ctx, service, serviceCopy); err != nil {
+		log.Error(err, "unable to update the Service after deleting the port mappings")
+		return nil, err
+	}
+
+	if len(remaining) > 0 {
+		return serviceCopy, fmt.Errorf("%w: %d left", ErrUnmapFailed, len(remaining))
+	}
+	return serviceCopy, nil
+}
+
+// Removes the condition, and optionally the ingress points, from
+// the Service that is no longer handled.
+func (r *ServiceReconciler) clearStatus(ctx context.Context, service *corev1.Service, clearIngress bool) error {
+	if !service.DeletionTimestamp.IsZero() {
+		return nil
+	}
+
+	serviceCopy := service.DeepCopy()
+	if clearIngress {
+		serviceCopy.Status.LoadBalancer.Ingress = nil
+	}
+	meta.RemoveStatusCondition(&serviceCopy.Status.Conditions, ConditionPortsMapped)
+
+	if equality.Semantic.DeepEqual(service.Status, serviceCopy.Status) {
+		return nil
+	}
+	return r.Status().Update(ctx, serviceCopy)
+}
+
+// Returns the mappings that failed to be deleted.
+func (r *ServiceReconciler) unmapPorts(
+	ctx context.Context,
+	log logr.Logger,
+	service *corev1.Service,
+	mapped []annotations.Mapping,
+) []annotations.Mapping {
+	remaining := make([]annotations.Mapping, 0)
+
+	for _, mapping := range mapped {
+		pmreq, ok := unmapRequest(mapping)
+		if !ok {
+			log.Info("unexpected protocol in the recorded mapping, forgetting it", "mapping", mapping)
+			continue
+		}
+
+		r.Leases.Forget(types.NamespacedName{Namespace: service.Namespace, Name: service.Name}, pmreq)
+
+		log.V(1).Info("deleting port mapping", "request", pmreq)
+		if err := r.PortMap.Unmap(ctx, pmreq); err != nil {
+			log.Error(err, "unable to delete the port mapping", "request", pmreq)
+			r.Recorder.Eventf(
+				service, corev1.EventTypeWarning, EventReasonMappingFailed,
+				"Unable to delete the mapping of %s port %d%s: %v", mapping.Protocol, mapping.GatewayPort, atGateway(mapping.Gateway), err,
+			)
+			remaining = append(remaining, mapping)
+			continue
+		}
+		r.Recorder.Eventf(
+			service, corev1.EventTypeNormal, EventReasonMappingDeleted,
+			"Deleted the mapping of %s port %d%s", mapping.Protocol, mapping.GatewayPort, atGateway(mapping.Gateway),
+		)
+	}
+
+	return remaining
+}
+
+func unmapRequest(mapping annotations.Mapping) (*portmap.Request, bool) {
+	protocol, ok := portmapProtocol(mapping.Protocol)
+	if !ok {
+		return nil, false
+	}
+
+	return &portmap.Request{
+		Gateway:     mapping.Gateway,
+		Protocol:    protocol,
+		NodePort:    portmap.Port(mapping.NodePort),
+		GatewayPort: portmap.Port(mapping.GatewayPort),
+		InternalIP:  net.ParseIP(mapping.InternalIP),
+	}, true
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/MOZGIII/port-map-operator/pkg/annotations"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var ErrNoReadyEndpoints = errors.New("no node has ready endpoints for the Service")
+
+// Whether the ports of the Service have to be mapped to a node that
+// has the endpoints, since with `externalTrafficPolicy: Local` the NodePort
+// only answers at such nodes.
+func followsEndpoints(service *corev1.Service, ann *annotations.Annotations) bool {
+	return ann.Node == "" && service.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal
+}
+
+// Returns the sorted names of the nodes that have ready endpoints for
+// the Service.
+func (r *ServiceReconciler) endpointNodes(ctx context.Context, service *corev1.Service) ([]string, error) {
+	var slices discoveryv1.EndpointSliceList
+	if err := r.List(
+		ctx, &slices,
+		client.InNamespace(service.Namespace),
+		client.MatchingLabels{discoveryv1.LabelServiceName: service.Name},
+	); err != nil {
+		return nil, err
+	}
+
+	nodes := readyEndpointNodes(slices.Items)
+	if len(nodes) == 0 {
+		return nil, ErrNoReadyEndpoints
+	}
+	return nodes, nil
+}
+
+// Picks the node of the endpoints to map the ports to. The node the ports
+// are mapped to is kept while it has ready endpoints, so that the mappings
+// don't move every time the endpoints come up at another node.
+func (r *ServiceReconciler) endpointNode(ctx context.Context, service *corev1.Service, endpointNodes []string) (string, error) {
+	mapped, err := annotations.MappedFromService(service)
+	if err != nil || len(mapped) == 0 {
+		// The unparsable mappings are forgotten anyway.
+		return endpointNodes[0], nil
+	}
+	mappedIPs := make(map[string]struct{}, len(mapped))
+	for _, mapping := range mapped {
+		mappedIPs[mapping.InternalIP] = struct{}{}
+	}
+
+	for _, nodeName := range endpointNodes {
+		ip, err := r.nodeInternalIP(ctx, nodeName)
+		if apierrors.IsNotFound(err) || errors.Is(err, ErrNoNodeInternalIP) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, ok := mappedIPs[ip.String()]; ok {
+			return nodeName, nil
+		}
+	}
+	return endpointNodes[0], nil
+}
+
+// Returns the sorted names of the nodes that have ready endpoints.
+func readyEndpointNodes(slices []discoveryv1.EndpointSlice) []string {
+	seen := make(map[string]struct{})
+	nodes := make([]string, 0)
+
+	for i := range slices {
+		for _, endpoint := range slices[i].Endpoints {
+			// Nil means ready, see `discoveryv1.EndpointConditions`.
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			if endpoint.NodeName == nil || *endpoint.NodeName == "" {
+				continue
+			}
+			if _, ok := seen[*endpoint.NodeName]; ok {
+				continue
+			}
+			seen[*endpoint.NodeName] = struct{}{}
+			nodes = append(nodes, *endpoint.NodeName)
+		}
+	}
+
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Enqueues the Service of the EndpointSlice, if its mappings follow
+// the endpoints.
+func (r *ServiceReconciler) endpointSliceService(obj client.Object) []reconcile.Request {
+	serviceName, ok := obj.GetLabels()[discoveryv1.LabelServiceName]
+	if !ok {
+		return nil
+	}
+
+	key := types.NamespacedName{Namespace: obj.GetNamespace(), Name: serviceName}
+	var service corev1.Service
+	if err := r.Get(context.Background(), key, &service); err != nil {
+		// The Service will be reconciled when it appears.
+		return nil
+	}
+
+	ann, err := annotations.FromService(&service)
+	if err != nil || !r.manages(&service) || !followsEndpoints(&service, ann) {
+		return nil
+	}
+
+	return []reconcile.Request{{NamespacedName: key}}
+}
@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/MOZGIII/port-map-operator/pkg/annotations"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The reasons of the Events recorded on the Services.
+const (
+	EventReasonMappingSucceeded      = "MappingSucceeded"
+	EventReasonMappingFailed         = "MappingFailed"
+	EventReasonGatewayPortMismatch   = "GatewayPortMismatch"
+	EventReasonMappingDeleted        = "MappingDeleted"
+	EventReasonPermanentMapping      = "PermanentMapping"
+	EventReasonNoReadyEndpoints      = "NoReadyEndpoints"
+	EventReasonRenewalFailed         = "RenewalFailed"
+	EventReasonMappingExpired        = "MappingExpired"
+	EventReasonInvalidAnnotations    = "InvalidAnnotations"
+	EventReasonGatewayPortTaken      = "GatewayPortTaken"
+	EventReasonGatewayPortNotAllowed = "GatewayPortNotAllowed"
+	EventReasonUnknownGateways       = "UnknownGateways"
+)
+
+// ConditionPortsMapped is the Service condition that tells whether
+// all the ports of the Service are mapped.
+const ConditionPortsMapped = "port-map.mzg.io/PortsMapped"
+
+// The reasons of the `ConditionPortsMapped`.
+const (
+	ConditionReasonMapped                = "Mapped"
+	ConditionReasonMappingFailed         = "MappingFailed"
+	ConditionReasonGatewayPortMismatch   = "GatewayPortMismatch"
+	ConditionReasonGatewayPortTaken      = "GatewayPortTaken"
+	ConditionReasonGatewayPortNotAllowed = "GatewayPortNotAllowed"
+	ConditionReasonUnknownGateways       = "UnknownGateways"
+)
+
+// Records the Events for the new mappings, and for all the failures.
+func (r *ServiceReconciler) recordMappingEvents(
+	service *corev1.Service,
+	previouslyMapped []annotations.Mapping,
+	internalIP net.IP,
+	pmreslist []*portmap.Response,
+	pmerrlist []error,
+) {
+	for i, mapping := range mappingsFromResponses(pmreslist, internalIP) {
+		if hasMapping(previouslyMapped, mapping) {
+			continue
+		}
+		r.Recorder.Eventf(
+			service, corev1.EventTypeNormal, EventReasonMappingSucceeded,
+			"Mapped %s port %d at %s to node port %d",
+			mapping.Protocol, mapping.GatewayPort, pmreslist[i].GatewayIP, mapping.NodePort,
+		)
+	}
+
+	for _, pmerr := range pmerrlist {
+		reason := EventReasonMappingFailed
+		switch portErrorReason(pmerr) {
+		case PortErrorGatewayPortMismatch:
+			reason = EventReasonGatewayPortMismatch
+		case PortErrorGatewayPortTaken:
+			reason = EventReasonGatewayPortTaken
+		case PortErrorGatewayPortNotAllowed:
+			reason = EventReasonGatewayPortNotAllowed
+		}
+		r.Recorder.Event(service, corev1.EventTypeWarning, reason, capitalize(pmerr.Error()))
+	}
+}
+
+// Sets the `ConditionPortsMapped` according to the mapping outcome.
+func setPortsMappedCondition(service *corev1.Service, pmreslist []*portmap.Response, pmerrlist []error) {
+	condition := metav1.Condition{
+		Type:               ConditionPortsMapped,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: service.Generation,
+		Reason:             ConditionReasonMapped,
+		Message:            fmt.Sprintf("All %d ports are mapped", len(pmreslist)),
+	}
+
+	if len(pmerrlist) > 0 {
+		messages := make([]string, 0, len(pmerrlist))
+		for _, pmerr := range pmerrlist {
+			messages = append(messages, pmerr.Error())
+		}
+
+		condition.Status = metav1.ConditionFalse
+		switch portErrorReason(pmerrlist[0]) {
+		case PortErrorGatewayPortMismatch:
+			condition.Reason = ConditionReasonGatewayPortMismatch
+		case PortErrorGatewayPortTaken:
+			condition.Reason = ConditionReasonGatewayPortTaken
+		case PortErrorGatewayPortNotAllowed:
+			condition.Reason = ConditionReasonGatewayPortNotAllowed
+		default:
+			condition.Reason = ConditionReasonMappingFailed
+		}
+		condition.Message = capitalize(strings.Join(messages, "; "))
+	}
+
+	meta.SetStatusCondition(&service.Status.Conditions, condition)
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -0,0 +1,283 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	portmapv1alpha1 "github.com/MOZGIII/port-map-operator/api/v1alpha1"
+	"github.com/MOZGIII/port-map-operator/pkg/gatewayset"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// DefaultGatewayProbeInterval is how often the Gateways are probed by default.
+const DefaultGatewayProbeInterval = time.Minute
+
+// The reasons of the `portmapv1alpha1.GatewayConditionReachable`.
+const (
+	GatewayReasonProbeSucceeded   = "ProbeSucceeded"
+	GatewayReasonProbeFailed      = "ProbeFailed"
+	GatewayReasonProbeUnsupported = "ProbeUnsupported"
+	GatewayReasonInvalidSpec      = "InvalidSpec"
+)
+
+// MapperBuilder builds the mapper of a Gateway.
+type MapperBuilder func(
+	ctx context.Context,
+	name string,
+	spec *portmapv1alpha1.GatewaySpec,
+) (portmap.Mapper, gatewayset.RunFunc, error)
+
+// GatewayReconciler builds the mappers of the Gateways, and reports what
+// the routers tell about themselves at the Gateway status.
+type GatewayReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	// Where the mappers are kept for the Services to use.
+	Gateways *gatewayset.Set
+	Build    MapperBuilder
+
+	// If zero, `DefaultGatewayProbeInterval` is used.
+	ProbeInterval time.Duration
+
+	// The Gateways the ports are mapped at, the others are left alone.
+	// Empty means all of them.
+	Names []string
+
+	// Set in the per-node mode, where only the instance at one of
+	// the eligible nodes probes the Gateway and reports its status,
+	// while all of them build its mapper. See `ServiceReconciler`.
+	NodeName     string
+	NodeSelector labels.Selector
+}
+
+//+kubebuilder:rbac:groups=port-map.mzg.io,resources=gateways,verbs=get;list;watch
+//+kubebuilder:rbac:groups=port-map.mzg.io,resources=gateways/status,verbs=get;update;patch
+
+// Reconcile rebuilds the mapper of the Gateway when its spec changes,
+// and probes the router.
+func (r *GatewayReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("gateway", req.Name)
+
+	var gateway portmapv1alpha1.Gateway
+	if err := r.Get(ctx, req.NamespacedName, &gateway); err != nil {
+		if apierrors.IsNotFound(err) {
+			log.Info("gateway is gone, stopping its mapper")
+			r.Gateways.Remove(req.Name)
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Checked every time, since the instance reporting the status
+	// changes as the nodes come and go.
+	reports, err := r.reportsStatus(ctx, gateway.Name)
+	if err != nil {
+		log.Error(err, "unable to tell whether to report the Gateway status")
+		return ctrl.Result{}, err
+	}
+
+	status := gateway.Status.DeepCopy()
+	if generation, ok := r.Gateways.Generation(gateway.Name); !ok || generation != gateway.Generation {
+		log.Info("building the gateway mapper", "backend", gateway.Spec.Backend)
+		mapper, run, buildErr := r.Build(ctx, gateway.Name, &gateway.Spec)
+		if buildErr != nil {
+			log.Error(buildErr, "unable to build the gateway mapper")
+			r.Gateways.Remove(gateway.Name)
+			if !reports {
+				return ctrl.Result{}, nil
+			}
+			setReachableCondition(status, gateway.Generation, metav1.ConditionFalse, GatewayReasonInvalidSpec, capitalize(buildErr.Error()))
+			// Retried when the spec changes.
+			return ctrl.Result{}, r.updateStatus(ctx, &gateway, status)
+		}
+		r.Gateways.Put(gateway.Name, gateway.Generation, mapper, run, configFromSpec(&gateway.Spec))
+	}
+
+	interval := r.ProbeInterval
+	if interval == 0 {
+		interval = DefaultGatewayProbeInterval
+	}
+	if !reports {
+		return ctrl.Result{RequeueAfter: interval}, nil
+	}
+
+	r.probe(ctx, log, &gateway, status)
+	if err := r.updateStatus(ctx, &gateway, status); err != nil {
+		log.Error(err, "unable to update the Gateway status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: interval}, nil
+}
+
+// Whether this instance probes the Gateway and reports its status.
+// In the per-node mode, it's the instance at the node picked for
+// the Gateway, so that the instances don't overwrite each other.
+func (r *GatewayReconciler) reportsStatus(ctx context.Context, name string) (bool, error) {
+	if r.NodeName == "" {
+		return true, nil
+	}
+	nodes, err := listEligibleNodes(ctx, r, r.NodeSelector)
+	if err != nil {
+		return false, err
+	}
+	return rendezvousNodeFor(name, nodeNames(nodes)) == r.NodeName, nil
+}
+
+// Whether the Gateway is one of the ones the ports are mapped at.
+func (r *GatewayReconciler) handles(obj client.Object) bool {
+	if len(r.Names) == 0 {
+		return true
+	}
+	for _, name := range r.Names {
+		if obj.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Probes the router, if its mapper can do that, and updates the status.
+func (r *GatewayReconciler) probe(
+	ctx context.Context,
+	log logr.Logger,
+	gateway *portmapv1alpha1.Gateway,
+	status *portmapv1alpha1.GatewayStatus,
+) {
+	mapper, _ := r.Gateways.Get(gateway.Name)
+	capabilities := mapper.Capabilities()
+	_, canProbe := mapper.(portmap.Prober)
+	if !canProbe && !capabilities.ExternalAddress {
+		setReachableCondition(status, gateway.Generation, metav1.ConditionUnknown, GatewayReasonProbeUnsupported,
+			"The backend can't be probed without mapping a port")
+		return
+	}
+
+	now := metav1.Now()
+	status.LastProbeTime = &now
+
+	info, err := probeGateway(ctx, mapper)
+	if err != nil {
+		log.Error(err, "unable to probe the gateway")
+		setReachableCondition(status, gateway.Generation, metav1.ConditionFalse, GatewayReasonProbeFailed, capitalize(err.Error()))
+		return
+	}
+
+	setReachableCondition(status, gateway.Generation, metav1.ConditionTrue, GatewayReasonProbeSucceeded, "The router responded")
+	status.ExternalIP = ""
+	if info.ExternalIP != nil {
+		status.ExternalIP = info.ExternalIP.String()
+	}
+	status.Epoch = nil
+	if info.Epoch != nil {
+		epoch := int64(*info.Epoch)
+		status.Epoch = &epoch
+	}
+	protocols := info.Protocols
+	if len(protocols) == 0 {
+		protocols = capabilities.Protocols
+	}
+	status.SupportedProtocols = make([]corev1.Protocol, 0, len(protocols))
+	for _, protocol := range protocols {
+		status.SupportedProtocols = append(status.SupportedProtocols, serviceProtocol(protocol))
+	}
+
+	status.Mappings = nil
+	if capabilities.ListMappings {
+		status.Mappings = countMappings(ctx, log, mapper)
+	}
+}
+
+// Counts the mappings the router lists, nil if it can't list them.
+func countMappings(ctx context.Context, log logr.Logger, mapper portmap.Mapper) *int32 {
+	mappings, err := mapper.ListMappings(ctx)
+	if err != nil {
+		if !errors.Is(err, portmap.ErrUnsupported) {
+			log.Error(err, "unable to list the gateway mappings")
+		}
+		return nil
+	}
+	count := int32(len(mappings))
+	return &count
+}
+
+// Probes the gateway, or asks for its external address if it can't be
+// probed.
+func probeGateway(ctx context.Context, mapper portmap.Mapper) (*portmap.GatewayInfo, error) {
+	if prober, ok := mapper.(portmap.Prober); ok {
+		return prober.Probe(ctx)
+	}
+	ip, err := mapper.ExternalAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &portmap.GatewayInfo{ExternalIP: ip}, nil
+}
+
+func (r *GatewayReconciler) updateStatus(
+	ctx context.Context,
+	gateway *portmapv1alpha1.Gateway,
+	status *portmapv1alpha1.GatewayStatus,
+) error {
+	if equality.Semantic.DeepEqual(gateway.Status, *status) {
+		return nil
+	}
+	gateway.Status = *status
+	return client.IgnoreNotFound(r.Status().Update(ctx, gateway))
+}
+
+func setReachableCondition(
+	status *portmapv1alpha1.GatewayStatus,
+	generation int64,
+	conditionStatus metav1.ConditionStatus,
+	reason, message string,
+) {
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               portmapv1alpha1.GatewayConditionReachable,
+		Status:             conditionStatus,
+		ObservedGeneration: generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+func configFromSpec(spec *portmapv1alpha1.GatewaySpec) gatewayset.Config {
+	var config gatewayset.Config
+	if spec.DefaultLifetime != nil {
+		config.DefaultLifetime = portmap.LifetimeFromDuration(spec.DefaultLifetime.Duration)
+	}
+	for _, r := range spec.AllowedPortRanges {
+		config.AllowedPorts = append(config.AllowedPorts, gatewayset.PortRange{
+			From: portmap.Port(r.From),
+			To:   portmap.Port(r.To),
+		})
+	}
+	return config
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *GatewayReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// The status updates are not worth reconciling, the Gateways are
+	// probed periodically anyway. The mappers of the Gateways the ports
+	// are not mapped at are not built, so that they don't take the PCP
+	// announce port or the nonce Secrets.
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&portmapv1alpha1.Gateway{}, builder.WithPredicates(
+			predicate.NewPredicateFuncs(r.handles),
+			predicate.GenerationChangedPredicate{},
+		)).
+		Complete(r)
+}
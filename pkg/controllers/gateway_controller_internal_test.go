@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	portmapv1alpha1 "github.com/MOZGIII/port-map-operator/api/v1alpha1"
+	"github.com/MOZGIII/port-map-operator/pkg/gatewayset"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var errFakeBuildFailed = errors.New("unable to build the mapper")
+
+// Reports the address of the Gateway as the external one.
+type fakeGatewayMapper struct {
+	externalIP net.IP
+}
+
+func (m *fakeGatewayMapper) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
+	return &portmap.Response{
+		Protocol:    req.Protocol,
+		NodePort:    req.NodePort,
+		GatewayPort: req.GatewayPort,
+		GatewayIP:   m.externalIP,
+		Lifetime:    req.Lifetime,
+	}, nil
+}
+
+func (m *fakeGatewayMapper) Probe(ctx context.Context) (*portmap.GatewayInfo, error) {
+	epoch := uint32(1000)
+	return &portmap.GatewayInfo{
+		ExternalIP: m.externalIP,
+		Epoch:      &epoch,
+		Protocols:  []portmap.Protocol{portmap.ProtocolTCP, portmap.ProtocolUDP},
+	}, nil
+}
+
+func (m *fakeGatewayMapper) Unmap(ctx context.Context, req *portmap.Request) error {
+	return nil
+}
+
+func (m *fakeGatewayMapper) ListMappings(ctx context.Context) ([]portmap.Mapping, error) {
+	return []portmap.Mapping{{Protocol: portmap.ProtocolTCP, GatewayPort: 80, NodePort: 30000}}, nil
+}
+
+func (m *fakeGatewayMapper) ExternalAddress(ctx context.Context) (net.IP, error) {
+	return m.externalIP, nil
+}
+
+func (m *fakeGatewayMapper) Capabilities() portmap.Capabilities {
+	return portmap.Capabilities{ListMappings: true, ExternalAddress: true}
+}
+
+// Only builds the NAT-PMP mappers, so that the other backends can be used
+// to test the failures.
+func buildFakeGatewayMapper(
+	_ context.Context,
+	_ string,
+	spec *portmapv1alpha1.GatewaySpec,
+) (portmap.Mapper, gatewayset.RunFunc, error) {
+	if spec.Backend != portmapv1alpha1.GatewayBackendNATPMP {
+		return nil, nil, errFakeBuildFailed
+	}
+	mapper := &fakeGatewayMapper{externalIP: net.ParseIP(spec.Address)}
+	return mapper, func(stopch <-chan struct{}) error {
+		<-stopch
+		return nil
+	}, nil
+}
+
+var _ = Describe("Gateway controller", func() {
+	const (
+		timeout  = time.Second * 10
+		interval = time.Millisecond * 250
+	)
+
+	var (
+		ctx         context.Context
+		gatewayName string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		gatewayName = "test-gateway-" + randStringRunes(5)
+	})
+
+	reachableCondition := func() (*metav1.Condition, error) {
+		var gateway portmapv1alpha1.Gateway
+		if err := k8sClient.Get(ctx, types.NamespacedName{Name: gatewayName}, &gateway); err != nil {
+			return nil, err
+		}
+		return meta.FindStatusCondition(gateway.Status.Conditions, portmapv1alpha1.GatewayConditionReachable), nil
+	}
+
+	Context("When a Gateway is created", func() {
+		It("Should build its mapper and report the probe results", func() {
+			gateway := &portmapv1alpha1.Gateway{
+				ObjectMeta: metav1.ObjectMeta{Name: gatewayName},
+				Spec: portmapv1alpha1.GatewaySpec{
+					Backend:         portmapv1alpha1.GatewayBackendNATPMP,
+					Address:         "1.2.3.4",
+					DefaultLifetime: &metav1.Duration{Duration: time.Hour},
+					AllowedPortRanges: []portmapv1alpha1.PortRange{
+						{From: 8000, To: 8999},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, gateway)).Should(Succeed())
+
+			By("By waiting for the Gateway to be reported as reachable")
+			Eventually(func() (metav1.ConditionStatus, error) {
+				condition, err := reachableCondition()
+				if condition == nil {
+					return "", err
+				}
+				return condition.Status, err
+			}, timeout, interval).Should(Equal(metav1.ConditionTrue))
+
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: gatewayName}, gateway)).Should(Succeed())
+			Expect(gateway.Status.ExternalIP).To(Equal("1.2.3.4"))
+			Expect(gateway.Status.Epoch).To(Equal(func() *int64 { epoch := int64(1000); return &epoch }()))
+			Expect(gateway.Status.SupportedProtocols).To(Equal([]corev1.Protocol{corev1.ProtocolTCP, corev1.ProtocolUDP}))
+			Expect(gateway.Status.LastProbeTime).NotTo(BeNil())
+			Expect(gateway.Status.Mappings).To(Equal(func() *int32 { mappings := int32(1); return &mappings }()))
+
+			By("By checking the mapper uses the Gateway configuration")
+			config, ok := gatewaySet.Mapper(gatewayName).GatewayConfig("")
+			Expect(ok).To(BeTrue())
+			Expect(config.DefaultLifetime).To(Equal(portmap.Lifetime(3600)))
+			Expect(config.Allows(8080)).To(BeTrue())
+			Expect(config.Allows(80)).To(BeFalse())
+
+			By("By deleting the Gateway")
+			Expect(k8sClient.Delete(ctx, gateway)).Should(Succeed())
+			Eventually(func() bool {
+				_, ok := gatewaySet.Get(gatewayName)
+				return ok
+			}, timeout, interval).Should(BeFalse())
+		})
+	})
+
+	Context("When the mapper of a Gateway can't be built", func() {
+		It("Should report the Gateway as unreachable", func() {
+			gateway := &portmapv1alpha1.Gateway{
+				ObjectMeta: metav1.ObjectMeta{Name: gatewayName},
+				Spec: portmapv1alpha1.GatewaySpec{
+					Backend: portmapv1alpha1.GatewayBackendUPnP,
+				},
+			}
+			Expect(k8sClient.Create(ctx, gateway)).Should(Succeed())
+
+			Eventually(func() (string, error) {
+				condition, err := reachableCondition()
+				if condition == nil {
+					return "", err
+				}
+				return condition.Reason, err
+			}, timeout, interval).Should(Equal(GatewayReasonInvalidSpec))
+
+			_, ok := gatewaySet.Get(gatewayName)
+			Expect(ok).To(BeFalse())
+
+			Expect(k8sClient.Delete(ctx, gateway)).Should(Succeed())
+		})
+	})
+
+	Context("When the Gateways are named", func() {
+		It("Should only handle the named ones", func() {
+			r := &GatewayReconciler{Names: []string{"wan1", "wan2"}}
+			Expect(r.handles(&portmapv1alpha1.Gateway{ObjectMeta: metav1.ObjectMeta{Name: "wan2"}})).To(BeTrue())
+			Expect(r.handles(&portmapv1alpha1.Gateway{ObjectMeta: metav1.ObjectMeta{Name: "spare"}})).To(BeFalse())
+			Expect((&GatewayReconciler{}).handles(&portmapv1alpha1.Gateway{ObjectMeta: metav1.ObjectMeta{Name: "spare"}})).
+				To(BeTrue())
+		})
+	})
+})
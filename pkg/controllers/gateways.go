@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/MOZGIII/port-map-operator/pkg/annotations"
+	"github.com/MOZGIII/port-map-operator/pkg/gatewayset"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	ErrGatewayPortNotAllowed = errors.New("the gateway port is not allowed by the Gateway")
+	ErrUnknownGateways       = errors.New("the Service selects the gateways the ports are not mapped at")
+)
+
+// Implemented by the mappers of the Gateway resources.
+type configuredMapper interface {
+	GatewayConfig(name string) (gatewayset.Config, bool)
+}
+
+// The configuration of the Gateway the ports are mapped at, empty if
+// the mapper is not configured via a Gateway.
+func (r *ServiceReconciler) gatewayConfig(gateway string) gatewayset.Config {
+	if mapper, ok := r.PortMap.(configuredMapper); ok {
+		if config, ok := mapper.GatewayConfig(gateway); ok {
+			return config
+		}
+	}
+	return gatewayset.Config{}
+}
+
+// The Gateway default lifetime wins over the operator one.
+func (r *ServiceReconciler) defaultLifetime(gateway string) portmap.Lifetime {
+	if lifetime := r.gatewayConfig(gateway).DefaultLifetime; lifetime != 0 {
+		return lifetime
+	}
+	return r.DefaultLifetime
+}
+
+// The gateways to map the ports of the Service at: the ones it asks for,
+// or all of them. Only the default gateway without the multi-WAN.
+func (r *ServiceReconciler) serviceGateways(ann *annotations.Annotations) []string {
+	if len(r.Gateways) == 0 {
+		return []string{""}
+	}
+	if ann.Gateways == nil {
+		return r.Gateways
+	}
+
+	gateways := make([]string, 0, len(ann.Gateways))
+	for _, gateway := range r.Gateways {
+		for _, wanted := range ann.Gateways {
+			if gateway == wanted {
+				gateways = append(gateways, gateway)
+				break
+			}
+		}
+	}
+	return gateways
+}
+
+// The gateways the Service asks for that are not among the configured ones.
+// None without the multi-WAN, where the annotation doesn't apply.
+func (r *ServiceReconciler) unknownGateways(ann *annotations.Annotations) []string {
+	unknown := make([]string, 0)
+	if len(r.Gateways) == 0 {
+		return unknown
+	}
+OuterLoop:
+	for _, wanted := range ann.Gateways {
+		for _, gateway := range r.Gateways {
+			if gateway == wanted {
+				continue OuterLoop
+			}
+		}
+		unknown = append(unknown, wanted)
+	}
+	return unknown
+}
+
+// Reports the Service asking for the gateways that are not configured,
+// most likely misspelled. The mappings are left as they are, rather than
+// deleting the ones at the gateways the Service no longer seems to ask for.
+// Returns whether the Service was reported.
+func (r *ServiceReconciler) reportUnknownGateways(
+	ctx context.Context,
+	log logr.Logger,
+	service *corev1.Service,
+	ann *annotations.Annotations,
+) (bool, error) {
+	unknown := r.unknownGateways(ann)
+	if len(unknown) == 0 {
+		return false, nil
+	}
+
+	err := fmt.Errorf("%w: %s", ErrUnknownGateways, strings.Join(unknown, ", "))
+	log.Error(err, "leaving the port mappings as is")
+	message := capitalize(err.Error()) + ", the ports are left as is"
+	r.Recorder.Event(service, corev1.EventTypeWarning, EventReasonUnknownGateways, message)
+
+	serviceCopy := service.DeepCopy()
+	meta.SetStatusCondition(&serviceCopy.Status.Conditions, metav1.Condition{
+		Type:               ConditionPortsMapped,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: service.Generation,
+		Reason:             ConditionReasonUnknownGateways,
+		Message:            message,
+	})
+	if equality.Semantic.DeepEqual(service.Status, serviceCopy.Status) {
+		return true, nil
+	}
+	return true, r.Status().Update(ctx, serviceCopy)
+}
+
+// Makes the requests to map the ports of the Service at every gateway
+// it's mapped at.
+func (r *ServiceReconciler) makeRequests(
+	log logr.Logger,
+	service *corev1.Service,
+	ann *annotations.Annotations,
+	internalIP net.IP,
+) []*portRequest {
+	pmreqlist := make([]*portRequest, 0, len(service.Spec.Ports))
+	for _, gateway := range r.serviceGateways(ann) {
+		for _, pmreq := range makePortmapRequests(log, service, ann, internalIP, r.defaultLifetime(gateway)) {
+			pmreq.Gateway = gateway
+			pmreqlist = append(pmreqlist, pmreq)
+		}
+	}
+	return pmreqlist
+}
+
+// Names the gateway in the messages, unless it's the default one.
+func atGateway(gateway string) string {
+	if gateway == "" {
+		return ""
+	}
+	return " at " + gateway
+}
+
+// Turns the requests for the gateway ports the Gateway doesn't allow into
+// errors, unless they accept alternative ports, in which case the gateway
+// picks another port.
+func (r *ServiceReconciler) filterAllowedPorts(log logr.Logger, pmreqlist []*portRequest) ([]*portRequest, []error) {
+	kept := make([]*portRequest, 0, len(pmreqlist))
+	pmerrlist := make([]error, 0)
+	for _, pmreq := range pmreqlist {
+		config := r.gatewayConfig(pmreq.Gateway)
+		switch {
+		case config.Allows(pmreq.GatewayPort):
+			kept = append(kept, pmreq)
+		case pmreq.Flexible:
+			log.Info("the gateway port is not allowed, letting the gateway pick another one", "request", pmreq.Request)
+			pmreq.GatewayPort = portmap.PortAny
+			kept = append(kept, pmreq)
+		default:
+			pmerrlist = append(pmerrlist, &PortMapError{
+				Request: pmreq.Request,
+				Err:     fmt.Errorf("%w: %d", ErrGatewayPortNotAllowed, pmreq.GatewayPort),
+			})
+		}
+	}
+	return kept, pmerrlist
+}
@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+
+	"github.com/MOZGIII/port-map-operator/pkg/lease"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// Reports the mappings the lease manager failed to renew at their Services,
+// and has the Services reconciled when the mappings are lost.
+// The renewals are reported at the PortMappings.
+func (r *ServiceReconciler) forwardLeaseFailures(ctx context.Context, events chan<- event.GenericEvent) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case failure := <-r.Leases.Failures():
+			r.recordRenewal(ctx, &failure.Lease, failure.Err)
+			r.reportLeaseFailure(ctx, &failure, events)
+		case renewed := <-r.Leases.Renewals():
+			r.recordRenewal(ctx, &renewed, nil)
+		}
+	}
+}
+
+func (r *ServiceReconciler) reportLeaseFailure(ctx context.Context, failure *lease.Failure, events chan<- event.GenericEvent) {
+	log := r.Log.WithValues("service", failure.Lease.Owner)
+
+	var service corev1.Service
+	if err := r.Get(ctx, failure.Lease.Owner, &service); err != nil {
+		log.Error(err, "unable to fetch the Service of the failed renewal")
+		if apierrors.IsNotFound(err) {
+			r.Leases.ForgetOwner(failure.Lease.Owner)
+		}
+		return
+	}
+
+	req := &failure.Lease.Request
+	if failure.Expired {
+		log.Info("port mapping expired", "request", req, "error", failure.Err)
+		r.Recorder.Eventf(
+			&service, corev1.EventTypeWarning, EventReasonMappingExpired,
+			"The mapping of %s port %d%s expired: %v",
+			serviceProtocol(req.Protocol), req.GatewayPort, atGateway(req.Gateway), failure.Err,
+		)
+	} else {
+		log.Error(failure.Err, "unable to renew the port mapping", "request", req)
+		r.Recorder.Eventf(
+			&service, corev1.EventTypeWarning, EventReasonRenewalFailed,
+			"Unable to renew the mapping of %s port %d%s: %v",
+			serviceProtocol(req.Protocol), req.GatewayPort, atGateway(req.Gateway), failure.Err,
+		)
+	}
+
+	// The other failures are retried by the lease manager.
+	if !failure.Expired && !errors.Is(failure.Err, lease.ErrGatewayPortChanged) {
+		return
+	}
+	select {
+	case events <- event.GenericEvent{Object: &service}:
+	case <-ctx.Done():
+	}
+}
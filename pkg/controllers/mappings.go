@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/MOZGIII/port-map-operator/pkg/annotations"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func newMapping(
+	gateway string,
+	protocol portmap.Protocol,
+	nodePort, gatewayPort portmap.Port,
+	internalIP net.IP,
+) annotations.Mapping {
+	mapping := annotations.Mapping{
+		Gateway:     gateway,
+		Protocol:    serviceProtocol(protocol),
+		NodePort:    int32(nodePort),
+		GatewayPort: int32(gatewayPort),
+	}
+	if internalIP != nil {
+		mapping.InternalIP = internalIP.String()
+	}
+	return mapping
+}
+
+func mappingFromRequest(pmreq *portRequest) annotations.Mapping {
+	return newMapping(pmreq.Gateway, pmreq.Protocol, pmreq.NodePort, pmreq.GatewayPort, pmreq.InternalIP)
+}
+
+func mappingsFromResponses(pmreslist []*portmap.Response, internalIP net.IP) []annotations.Mapping {
+	mappings := make([]annotations.Mapping, 0, len(pmreslist))
+	for _, pmres := range pmreslist {
+		mappings = append(mappings, newMapping(pmres.Gateway, pmres.Protocol, pmres.NodePort, pmres.GatewayPort, internalIP))
+	}
+	return mappings
+}
+
+// Splits the recorded mappings into the ones that are still desired,
+// and the stale ones that have to be deleted.
+func splitStaleMappings(mapped []annotations.Mapping, pmreqlist []*portRequest) (kept, stale []annotations.Mapping) {
+	kept = make([]annotations.Mapping, 0, len(mapped))
+	stale = make([]annotations.Mapping, 0)
+
+	for _, mapping := range mapped {
+		if requestFor(pmreqlist, mapping) != nil {
+			kept = append(kept, mapping)
+		} else {
+			stale = append(stale, mapping)
+		}
+	}
+	return kept, stale
+}
+
+// Returns the request the mapping satisfies, if any. The mappings of
+// the flexible requests may have any gateway port.
+func requestFor(pmreqlist []*portRequest, mapping annotations.Mapping) *portRequest {
+	for _, pmreq := range pmreqlist {
+		desired := mappingFromRequest(pmreq)
+		if desired == mapping || (pmreq.Flexible && sameTarget(desired, mapping)) {
+			return pmreq
+		}
+	}
+	return nil
+}
+
+// Whether the mappings forward to the same place, regardless of
+// the gateway port.
+func sameTarget(a, b annotations.Mapping) bool {
+	a.GatewayPort, b.GatewayPort = 0, 0
+	return a == b
+}
+
+// Has the flexible requests ask for the gateway ports they already have,
+// so that the ports don't change on every renewal.
+func suggestMappedPorts(pmreqlist []*portRequest, mapped []annotations.Mapping) {
+	for _, mapping := range mapped {
+		if pmreq := requestFor(pmreqlist, mapping); pmreq != nil && pmreq.Flexible {
+			pmreq.GatewayPort = portmap.Port(mapping.GatewayPort)
+		}
+	}
+}
+
+// Splits out the recorded mappings of the flexible requests that
+// the gateway has mapped to another port this time.
+func splitSupersededMappings(
+	mapped []annotations.Mapping,
+	pmreqlist []*portRequest,
+	added []annotations.Mapping,
+) (kept, superseded []annotations.Mapping) {
+	kept = make([]annotations.Mapping, 0, len(mapped))
+	superseded = make([]annotations.Mapping, 0)
+
+	for _, mapping := range mapped {
+		if isSuperseded(mapping, pmreqlist, added) {
+			superseded = append(superseded, mapping)
+		} else {
+			kept = append(kept, mapping)
+		}
+	}
+	return kept, superseded
+}
+
+func isSuperseded(mapping annotations.Mapping, pmreqlist []*portRequest, added []annotations.Mapping) bool {
+	if pmreq := requestFor(pmreqlist, mapping); pmreq == nil || !pmreq.Flexible {
+		return false
+	}
+	for _, addedMapping := range added {
+		if sameTarget(addedMapping, mapping) && addedMapping != mapping {
+			return true
+		}
+	}
+	return false
+}
+
+// Appends the new mappings that are not in the list yet.
+func mergeMappings(mapped []annotations.Mapping, added []annotations.Mapping) []annotations.Mapping {
+	merged := append(make([]annotations.Mapping, 0, len(mapped)+len(added)), mapped...)
+
+	for _, mapping := range added {
+		if !hasMapping(merged, mapping) {
+			merged = append(merged, mapping)
+		}
+	}
+	return merged
+}
+
+func hasMapping(mapped []annotations.Mapping, mapping annotations.Mapping) bool {
+	for _, existing := range mapped {
+		if existing == mapping {
+			return true
+		}
+	}
+	return false
+}
+
+func portmapProtocol(protocol corev1.Protocol) (portmap.Protocol, bool) {
+	switch protocol {
+	case corev1.ProtocolTCP:
+		return portmap.ProtocolTCP, true
+	case corev1.ProtocolUDP:
+		return portmap.ProtocolUDP, true
+	case corev1.ProtocolSCTP:
+		return portmap.ProtocolSCTP, true
+	default:
+		return portmap.ProtocolAny, false
+	}
+}
+
+func serviceProtocol(protocol portmap.Protocol) corev1.Protocol {
+	switch protocol { // nolint: exhaustive
+	case portmap.ProtocolTCP:
+		return corev1.ProtocolTCP
+	case portmap.ProtocolUDP:
+		return corev1.ProtocolUDP
+	case portmap.ProtocolSCTP:
+		return corev1.ProtocolSCTP
+	default:
+		return corev1.Protocol(fmt.Sprint(protocol))
+	}
+}
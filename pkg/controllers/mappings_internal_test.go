@@ -0,0 +1,227 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/annotations"
+	"github.com/MOZGIII/port-map-operator/pkg/lease"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+var _ = Describe("Flexible port mappings", func() {
+	mappingAt := func(gatewayPort int32) annotations.Mapping {
+		return annotations.Mapping{Protocol: corev1.ProtocolTCP, NodePort: 30000, GatewayPort: gatewayPort}
+	}
+	portRequestAt := func(gatewayPort portmap.Port, flexible bool) *portRequest {
+		return &portRequest{
+			Request:  &portmap.Request{Protocol: portmap.ProtocolTCP, NodePort: 30000, GatewayPort: gatewayPort},
+			Flexible: flexible,
+		}
+	}
+
+	It("Should keep the mappings at the alternative ports", func() {
+		kept, stale := splitStaleMappings([]annotations.Mapping{mappingAt(1024)}, []*portRequest{portRequestAt(80, true)})
+		Expect(kept).To(Equal([]annotations.Mapping{mappingAt(1024)}))
+		Expect(stale).To(BeEmpty())
+	})
+
+	It("Should delete the mappings at the alternative ports of strict requests", func() {
+		kept, stale := splitStaleMappings([]annotations.Mapping{mappingAt(1024)}, []*portRequest{portRequestAt(80, false)})
+		Expect(kept).To(BeEmpty())
+		Expect(stale).To(Equal([]annotations.Mapping{mappingAt(1024)}))
+	})
+
+	It("Should ask for the ports already mapped", func() {
+		pmreq := portRequestAt(portmap.PortAny, true)
+		suggestMappedPorts([]*portRequest{pmreq}, []annotations.Mapping{mappingAt(1024)})
+		Expect(pmreq.GatewayPort).To(Equal(portmap.Port(1024)))
+	})
+
+	It("Should forget the mappings the gateway has moved", func() {
+		kept, superseded := splitSupersededMappings(
+			[]annotations.Mapping{mappingAt(1024)},
+			[]*portRequest{portRequestAt(1024, true)},
+			[]annotations.Mapping{mappingAt(1025)},
+		)
+		Expect(kept).To(BeEmpty())
+		Expect(superseded).To(Equal([]annotations.Mapping{mappingAt(1024)}))
+	})
+
+	It("Should keep the mappings the gateway has renewed", func() {
+		kept, superseded := splitSupersededMappings(
+			[]annotations.Mapping{mappingAt(1024)},
+			[]*portRequest{portRequestAt(1024, true)},
+			[]annotations.Mapping{mappingAt(1024)},
+		)
+		Expect(kept).To(Equal([]annotations.Mapping{mappingAt(1024)}))
+		Expect(superseded).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Multi-WAN port mappings", func() {
+	It("Should map the ports at the gateways the Service selects", func() {
+		r := &ServiceReconciler{Gateways: []string{"wan1", "wan2", "wan3"}}
+		Expect(r.serviceGateways(&annotations.Annotations{})).To(Equal([]string{"wan1", "wan2", "wan3"}))
+		Expect(r.serviceGateways(&annotations.Annotations{Gateways: []string{"wan3", "wan1", "lte"}})).
+			To(Equal([]string{"wan1", "wan3"}))
+	})
+
+	It("Should map the ports at the default gateway without the multi-WAN", func() {
+		r := &ServiceReconciler{}
+		Expect(r.serviceGateways(&annotations.Annotations{Gateways: []string{"wan1"}})).To(Equal([]string{""}))
+	})
+
+	It("Should tell the gateways that are not configured", func() {
+		r := &ServiceReconciler{Gateways: []string{"wan1", "wan2"}}
+		Expect(r.unknownGateways(&annotations.Annotations{})).To(BeEmpty())
+		Expect(r.unknownGateways(&annotations.Annotations{Gateways: []string{"wan2", "wan3", "lte"}})).
+			To(Equal([]string{"wan3", "lte"}))
+		Expect((&ServiceReconciler{}).unknownGateways(&annotations.Annotations{Gateways: []string{"wan3"}})).
+			To(BeEmpty())
+	})
+
+	It("Should tell the mappings at different gateways apart", func() {
+		pmreq := &portRequest{Request: &portmap.Request{
+			Gateway: "wan2", Protocol: portmap.ProtocolTCP, NodePort: 30000, GatewayPort: 80,
+		}}
+		mapping := annotations.Mapping{Gateway: "wan1", Protocol: corev1.ProtocolTCP, NodePort: 30000, GatewayPort: 80}
+		kept, stale := splitStaleMappings([]annotations.Mapping{mapping}, []*portRequest{pmreq})
+		Expect(kept).To(BeEmpty())
+		Expect(stale).To(Equal([]annotations.Mapping{mapping}))
+	})
+
+	It("Should report the failed ports at the gateway they failed at", func() {
+		pmreslist := []*portmap.Response{
+			{Gateway: "wan1", Protocol: portmap.ProtocolTCP, GatewayIP: net.IPv4(1, 1, 1, 1), GatewayPort: 80},
+			{Gateway: "wan2", Protocol: portmap.ProtocolTCP, GatewayIP: net.IPv4(2, 2, 2, 2), GatewayPort: 80},
+		}
+		pmerrlist := []error{&PortMapError{
+			Request: &portmap.Request{Gateway: "wan2", Protocol: portmap.ProtocolUDP, GatewayPort: 53},
+			Err:     ErrGatewayPortTaken,
+		}}
+
+		ingress := makeIngress(nil, nil, pmreslist, pmerrlist)
+		Expect(ingress).To(HaveLen(2))
+		Expect(ingress[0].IP).To(Equal("1.1.1.1"))
+		Expect(ingress[0].Ports).To(HaveLen(1))
+		Expect(ingress[1].IP).To(Equal("2.2.2.2"))
+		Expect(ingress[1].Ports).To(HaveLen(2))
+		Expect(ingress[1].Ports[1].Port).To(Equal(int32(53)))
+	})
+
+	It("Should report the failed ports at the IPs they were mapped at before", func() {
+		previous := []corev1.LoadBalancerIngress{
+			{IP: "1.1.1.1", Ports: []corev1.PortStatus{{Port: 80, Protocol: corev1.ProtocolTCP}}},
+			{IP: "2.2.2.2", Ports: []corev1.PortStatus{{Port: 80, Protocol: corev1.ProtocolTCP}}},
+		}
+		mapped := []annotations.Mapping{
+			{Gateway: "wan1", Protocol: corev1.ProtocolTCP, NodePort: 30000, GatewayPort: 80},
+			{Gateway: "wan2", Protocol: corev1.ProtocolTCP, NodePort: 30000, GatewayPort: 80},
+		}
+		pmreslist := []*portmap.Response{
+			{Gateway: "wan1", Protocol: portmap.ProtocolTCP, GatewayIP: net.IPv4(1, 1, 1, 1), NodePort: 30000, GatewayPort: 80},
+		}
+		pmerrlist := []error{&PortMapError{
+			Request: &portmap.Request{Gateway: "wan2", Protocol: portmap.ProtocolTCP, NodePort: 30000, GatewayPort: 80},
+			Err:     context.DeadlineExceeded,
+		}}
+
+		ingress := makeIngress(previous, mapped, pmreslist, pmerrlist)
+		Expect(ingress).To(HaveLen(2))
+		Expect(ingress[0].IP).To(Equal("1.1.1.1"))
+		Expect(ingress[0].Ports).To(HaveLen(1))
+		Expect(ingress[0].Ports[0].Error).To(BeNil())
+		Expect(ingress[1].IP).To(Equal("2.2.2.2"))
+		Expect(ingress[1].Ports).To(HaveLen(1))
+		Expect(ingress[1].Ports[0].Error).NotTo(BeNil())
+
+		By("forgetting the IPs of the ports no longer mapped")
+		Expect(makeIngress(previous, mapped[:1], nil, pmerrlist)).To(BeEmpty())
+	})
+})
+
+// Takes a while to map a port, and records how many ports it maps at once,
+// and the expiries the requests are marked with.
+type slowMapper struct {
+	mu       sync.Mutex
+	running  int
+	most     int
+	expiries map[portmap.Port]time.Time
+}
+
+func (m *slowMapper) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
+	m.mu.Lock()
+	m.running++
+	if m.running > m.most {
+		m.most = m.running
+	}
+	if expiry, ok := portmap.ExpiryFrom(ctx); ok {
+		m.expiries[req.GatewayPort] = expiry
+	}
+	m.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	m.mu.Lock()
+	m.running--
+	m.mu.Unlock()
+
+	if req.GatewayPort == 53 {
+		return nil, ErrGatewayPortTaken
+	}
+	return &portmap.Response{
+		Protocol:    req.Protocol,
+		NodePort:    req.NodePort,
+		GatewayPort: req.GatewayPort,
+		GatewayIP:   net.IPv4(1, 2, 3, 4),
+		Lifetime:    req.Lifetime,
+	}, nil
+}
+
+var _ = Describe("Concurrent port mappings", func() {
+	owner := types.NamespacedName{Namespace: "default", Name: "test"}
+	portRequestAt := func(gatewayPort portmap.Port) *portRequest {
+		return &portRequest{Request: &portmap.Request{
+			Protocol: portmap.ProtocolTCP, NodePort: 30000 + gatewayPort, GatewayPort: gatewayPort, Lifetime: 120,
+		}}
+	}
+
+	It("Should map the ports at once, keeping their order, and remap the leased ones first", func() {
+		mapper := &slowMapper{expiries: make(map[portmap.Port]time.Time)}
+		leases := lease.NewManager(mapper)
+		r := &ServiceReconciler{
+			Log:                   ctrl.Log.WithName("test"),
+			PortMap:               portmap.Adapt(mapper, portmap.Capabilities{}),
+			Leases:                leases,
+			MaxConcurrentMappings: 3,
+		}
+
+		leased := portRequestAt(80)
+		leases.Track(owner, leased.Request, &portmap.Response{GatewayPort: 80, Lifetime: 120})
+		expiry, ok := leases.Expiry(owner, leased.Request)
+		Expect(ok).To(BeTrue())
+
+		pmreqlist := []*portRequest{leased, portRequestAt(443), portRequestAt(53), portRequestAt(8080)}
+		pmreslist, pmerrlist := r.mapPorts(context.Background(), r.Log, owner, pmreqlist)
+
+		Expect(pmreslist).To(HaveLen(3))
+		Expect(pmreslist[0].GatewayPort).To(Equal(portmap.Port(80)))
+		Expect(pmreslist[1].GatewayPort).To(Equal(portmap.Port(443)))
+		Expect(pmreslist[2].GatewayPort).To(Equal(portmap.Port(8080)))
+		Expect(pmerrlist).To(HaveLen(1))
+		Expect(pmerrlist[0]).To(MatchError(ErrGatewayPortTaken))
+
+		Expect(mapper.most).To(BeNumerically(">", 1))
+		Expect(mapper.most).To(BeNumerically("<=", 3))
+		Expect(mapper.expiries).To(Equal(map[portmap.Port]time.Time{80: expiry}))
+		Expect(leases.Leases(owner)).To(HaveLen(3))
+	})
+})
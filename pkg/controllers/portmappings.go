@@ -0,0 +1,267 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	portmapv1alpha1 "github.com/MOZGIII/port-map-operator/api/v1alpha1"
+	"github.com/MOZGIII/port-map-operator/pkg/lease"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// Mirrors the outcome of mapping the ports of the Service in
+// the PortMappings, one per port, and deletes the ones of the ports
+// that are no longer mapped.
+func (r *ServiceReconciler) syncPortMappings(
+	ctx context.Context,
+	service *corev1.Service,
+	internalIP net.IP,
+	pmreslist []*portmap.Response,
+	pmerrlist []error,
+) error {
+	keep := make(map[string]struct{}, len(pmreslist)+len(pmerrlist))
+	now := time.Now()
+
+	for _, pmres := range pmreslist {
+		pmres := pmres
+		desired := newPortMapping(service, pmres.Gateway, pmres.Protocol, pmres.NodePort)
+		if desired == nil {
+			continue
+		}
+		keep[desired.Name] = struct{}{}
+		err := r.applyPortMapping(ctx, service, desired, func(status *portmapv1alpha1.PortMappingStatus) {
+			*status = portmapv1alpha1.PortMappingStatus{
+				Protocol:     desired.Spec.Protocol,
+				GatewayIP:    pmres.GatewayIP.String(),
+				GatewayPort:  int32(pmres.GatewayPort),
+				InternalIP:   ipString(internalIP),
+				InternalPort: int32(pmres.NodePort),
+			}
+			setStatusLifetime(status, now, pmres.Lifetime)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, pmerr := range pmerrlist {
+		var perr *PortMapError
+		if !errors.As(pmerr, &perr) {
+			continue
+		}
+		desired := newPortMapping(service, perr.Request.Gateway, perr.Request.Protocol, perr.Request.NodePort)
+		if desired == nil {
+			continue
+		}
+		keep[desired.Name] = struct{}{}
+		// The status of the previous mapping stays, it might be still there.
+		err := r.applyPortMapping(ctx, service, desired, func(status *portmapv1alpha1.PortMappingStatus) {
+			status.Protocol = desired.Spec.Protocol
+			status.InternalIP = ipString(internalIP)
+			status.InternalPort = desired.Spec.NodePort
+			status.LastError = perr.Err.Error()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.deletePortMappings(ctx, service, keep)
+}
+
+// Returns nil if the Service doesn't have the port.
+func newPortMapping(
+	service *corev1.Service,
+	gateway string,
+	protocol portmap.Protocol,
+	nodePort portmap.Port,
+) *portmapv1alpha1.PortMapping {
+	for _, servicePort := range service.Spec.Ports {
+		if servicePort.Protocol != serviceProtocol(protocol) || servicePort.NodePort != int32(nodePort) {
+			continue
+		}
+		return &portmapv1alpha1.PortMapping{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: service.Namespace,
+				Name:      portMappingName(service.Name, servicePort.Protocol, servicePort.Port, gateway),
+				Labels:    map[string]string{portmapv1alpha1.ServiceLabel: service.Name},
+			},
+			Spec: portmapv1alpha1.PortMappingSpec{
+				ServiceName: service.Name,
+				Protocol:    servicePort.Protocol,
+				Port:        servicePort.Port,
+				NodePort:    servicePort.NodePort,
+				Gateway:     gateway,
+			},
+		}
+	}
+	return nil
+}
+
+// The length of the hash the names that don't fit are suffixed with.
+const portMappingNameHashLength = 10
+
+// The PortMappings of the gateways other than the default one are
+// suffixed with the gateway name. The names too long for an object name
+// are cut, and suffixed with the hash of the whole name to keep them apart.
+func portMappingName(serviceName string, protocol corev1.Protocol, port int32, gateway string) string {
+	name := fmt.Sprintf("%s-%s-%d", serviceName, strings.ToLower(string(protocol)), port)
+	if gateway != "" {
+		name += "-" + gateway
+	}
+	if len(name) <= validation.DNS1123SubdomainMaxLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:portMappingNameHashLength]
+	prefix := strings.TrimRight(name[:validation.DNS1123SubdomainMaxLength-len(hash)-1], "-.")
+	return prefix + "-" + hash
+}
+
+// Creates or updates the PortMapping, and updates its status.
+func (r *ServiceReconciler) applyPortMapping(
+	ctx context.Context,
+	service *corev1.Service,
+	desired *portmapv1alpha1.PortMapping,
+	updateStatus func(status *portmapv1alpha1.PortMappingStatus),
+) error {
+	var portMapping portmapv1alpha1.PortMapping
+	err := r.Get(ctx, client.ObjectKeyFromObject(desired), &portMapping)
+	switch {
+	case apierrors.IsNotFound(err):
+		portMapping = *desired.DeepCopy()
+		if err := controllerutil.SetControllerReference(service, &portMapping, r.Scheme); err != nil {
+			return err
+		}
+		if err := r.Create(ctx, &portMapping); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case !equality.Semantic.DeepEqual(portMapping.Spec, desired.Spec) ||
+		portMapping.Labels[portmapv1alpha1.ServiceLabel] != service.Name:
+		portMapping.Spec = desired.Spec
+		portMapping.Labels = desired.Labels
+		if err := r.Update(ctx, &portMapping); err != nil {
+			return err
+		}
+	}
+
+	status := portMapping.Status.DeepCopy()
+	updateStatus(status)
+	if sameStatus(status, &portMapping.Status) {
+		return nil
+	}
+	portMapping.Status = *status
+	return r.Status().Update(ctx, &portMapping)
+}
+
+// Whether the statuses only differ by the expiry time, which moves along
+// with every reconciliation. The renewals of the mappings are recorded by
+// `recordRenewal` anyway.
+func sameStatus(a, b *portmapv1alpha1.PortMappingStatus) bool {
+	if (a.ExpiryTime == nil) != (b.ExpiryTime == nil) {
+		return false
+	}
+	a, b = a.DeepCopy(), b.DeepCopy()
+	a.ExpiryTime, b.ExpiryTime = nil, nil
+	return equality.Semantic.DeepEqual(a, b)
+}
+
+// Deletes the PortMappings of the Service, except for the ones to keep.
+func (r *ServiceReconciler) deletePortMappings(ctx context.Context, service *corev1.Service, keep map[string]struct{}) error {
+	var portMappings portmapv1alpha1.PortMappingList
+	if err := r.List(
+		ctx, &portMappings,
+		client.InNamespace(service.Namespace),
+		client.MatchingLabels{portmapv1alpha1.ServiceLabel: service.Name},
+	); err != nil {
+		return err
+	}
+
+	for i := range portMappings.Items {
+		if _, ok := keep[portMappings.Items[i].Name]; ok {
+			continue
+		}
+		if err := r.Delete(ctx, &portMappings.Items[i]); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Updates the PortMapping of the lease after a renewal attempt.
+func (r *ServiceReconciler) recordRenewal(ctx context.Context, renewed *lease.Lease, err error) {
+	log := r.Log.WithValues("service", renewed.Owner)
+
+	var portMappings portmapv1alpha1.PortMappingList
+	if err := r.List(
+		ctx, &portMappings,
+		client.InNamespace(renewed.Owner.Namespace),
+		client.MatchingLabels{portmapv1alpha1.ServiceLabel: renewed.Owner.Name},
+	); err != nil {
+		log.Error(err, "unable to list the PortMappings")
+		return
+	}
+
+	for i := range portMappings.Items {
+		portMapping := &portMappings.Items[i]
+		if portMapping.Spec.Protocol != serviceProtocol(renewed.Request.Protocol) ||
+			portMapping.Spec.NodePort != int32(renewed.Request.NodePort) ||
+			portMapping.Spec.Gateway != renewed.Request.Gateway {
+			continue
+		}
+
+		status := portMapping.Status.DeepCopy()
+		if err != nil {
+			status.LastError = err.Error()
+		} else {
+			// As precise as the API keeps it, so that it can be compared.
+			expiry := metav1.NewTime(renewed.Expiry).Rfc3339Copy()
+			status.LastError = ""
+			status.ExpiryTime = &expiry
+		}
+		if equality.Semantic.DeepEqual(*status, portMapping.Status) {
+			return
+		}
+		portMapping.Status = *status
+		if err := r.Status().Update(ctx, portMapping); client.IgnoreNotFound(err) != nil {
+			log.Error(err, "unable to update the PortMapping", "portMapping", types.NamespacedName{
+				Namespace: portMapping.Namespace, Name: portMapping.Name,
+			})
+		}
+		return
+	}
+}
+
+func setStatusLifetime(status *portmapv1alpha1.PortMappingStatus, now time.Time, lifetime portmap.Lifetime) {
+	status.Lifetime = nil
+	status.ExpiryTime = nil
+	if lifetime == 0 {
+		return
+	}
+	duration := time.Duration(lifetime) * time.Second
+	status.Lifetime = &metav1.Duration{Duration: duration}
+	status.ExpiryTime = &metav1.Time{Time: now.Add(duration)}
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
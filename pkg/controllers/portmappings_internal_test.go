@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	portmapv1alpha1 "github.com/MOZGIII/port-map-operator/api/v1alpha1"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("PortMappings", func() {
+	Context("Names", func() {
+		It("Should keep the short names as they are", func() {
+			Expect(portMappingName("test", corev1.ProtocolTCP, 80, "")).To(Equal("test-tcp-80"))
+		})
+
+		It("Should cut the long names and keep them apart", func() {
+			long := strings.Repeat("a", validation.DNS1123SubdomainMaxLength)
+			tcp := portMappingName(long, corev1.ProtocolTCP, 80, "")
+			udp := portMappingName(long, corev1.ProtocolUDP, 80, "")
+			other := portMappingName(long, corev1.ProtocolTCP, 80, "other")
+
+			for _, name := range []string{tcp, udp, other} {
+				Expect(len(name)).To(BeNumerically("<=", validation.DNS1123SubdomainMaxLength))
+				Expect(validation.IsDNS1123Subdomain(name)).To(BeEmpty())
+			}
+			Expect(tcp).NotTo(Equal(udp))
+			Expect(tcp).NotTo(Equal(other))
+		})
+
+		It("Should not end the cut names with a separator", func() {
+			long := strings.Repeat("a.", validation.DNS1123SubdomainMaxLength)
+			Expect(validation.IsDNS1123Subdomain(portMappingName(long, corev1.ProtocolTCP, 80, ""))).To(BeEmpty())
+		})
+	})
+
+	Context("Status", func() {
+		var (
+			ctx        context.Context
+			reconciler *ServiceReconciler
+			service    *corev1.Service
+			desired    *portmapv1alpha1.PortMapping
+		)
+
+		BeforeEach(func() {
+			ctx = context.Background()
+
+			scheme := runtime.NewScheme()
+			Expect(corev1.AddToScheme(scheme)).To(Succeed())
+			Expect(portmapv1alpha1.AddToScheme(scheme)).To(Succeed())
+
+			service = &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test", UID: "test"}}
+			desired = &portmapv1alpha1.PortMapping{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Name:      portMappingName(service.Name, corev1.ProtocolTCP, 80, ""),
+					Labels:    map[string]string{portmapv1alpha1.ServiceLabel: service.Name},
+				},
+			}
+			reconciler = &ServiceReconciler{
+				Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(service).Build(),
+				Scheme: scheme,
+			}
+		})
+
+		expiringIn := func(duration time.Duration) func(status *portmapv1alpha1.PortMappingStatus) {
+			return func(status *portmapv1alpha1.PortMappingStatus) {
+				status.GatewayPort = 80
+				expiry := metav1.NewTime(time.Now().Add(duration))
+				status.ExpiryTime = &expiry
+			}
+		}
+
+		It("Should not update the status that only moved the expiry", func() {
+			Expect(reconciler.applyPortMapping(ctx, service, desired, expiringIn(time.Minute))).To(Succeed())
+			var before portmapv1alpha1.PortMapping
+			Expect(reconciler.Get(ctx, client.ObjectKeyFromObject(desired), &before)).To(Succeed())
+
+			Expect(reconciler.applyPortMapping(ctx, service, desired, expiringIn(time.Hour))).To(Succeed())
+			var after portmapv1alpha1.PortMapping
+			Expect(reconciler.Get(ctx, client.ObjectKeyFromObject(desired), &after)).To(Succeed())
+			Expect(after.ResourceVersion).To(Equal(before.ResourceVersion))
+		})
+
+		It("Should update the status that changed", func() {
+			Expect(reconciler.applyPortMapping(ctx, service, desired, expiringIn(time.Minute))).To(Succeed())
+			var before portmapv1alpha1.PortMapping
+			Expect(reconciler.Get(ctx, client.ObjectKeyFromObject(desired), &before)).To(Succeed())
+
+			Expect(reconciler.applyPortMapping(ctx, service, desired, func(status *portmapv1alpha1.PortMappingStatus) {
+				status.LastError = "failed"
+			})).To(Succeed())
+			var after portmapv1alpha1.PortMapping
+			Expect(reconciler.Get(ctx, client.ObjectKeyFromObject(desired), &after)).To(Succeed())
+			Expect(after.ResourceVersion).NotTo(Equal(before.ResourceVersion))
+			Expect(after.Status.LastError).To(Equal("failed"))
+		})
+	})
+})
@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	"github.com/MOZGIII/port-map-operator/pkg/portregistry"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+var ErrGatewayPortTaken = errors.New("the gateway port is taken by another Service")
+
+// Claims the requested gateway ports at the registry. The requests for
+// the ports held by other Services are turned into errors, unless they
+// accept alternative ports, in which case the gateway picks another port.
+func (r *ServiceReconciler) claimPorts(
+	ctx context.Context,
+	log logr.Logger,
+	service *corev1.Service,
+	pmreqlist []*portRequest,
+) ([]*portRequest, []error, error) {
+	if r.Ports == nil {
+		return pmreqlist, nil, nil
+	}
+
+	owner := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+	ports := make([]portregistry.Port, 0, len(pmreqlist))
+	for _, pmreq := range pmreqlist {
+		if pmreq.GatewayPort != portmap.PortAny {
+			ports = append(ports, registryPort(pmreq.Request))
+		}
+	}
+
+	denied, err := r.Ports.Sync(ctx, owner, ports)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(denied) > 0 && r.evictGoneHolders(ctx, log, denied) {
+		if denied, err = r.Ports.Sync(ctx, owner, ports); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	kept := make([]*portRequest, 0, len(pmreqlist))
+	pmerrlist := make([]error, 0)
+	for _, pmreq := range pmreqlist {
+		holder, taken := denied[registryPort(pmreq.Request)]
+		switch {
+		case !taken || pmreq.GatewayPort == portmap.PortAny:
+			kept = append(kept, pmreq)
+		case pmreq.Flexible:
+			log.Info("the gateway port is taken, letting the gateway pick another one", "request", pmreq.Request, "holder", holder)
+			pmreq.GatewayPort = portmap.PortAny
+			kept = append(kept, pmreq)
+		default:
+			pmerrlist = append(pmerrlist, &PortMapError{
+				Request: pmreq.Request,
+				Err:     fmt.Errorf("%w: %s", ErrGatewayPortTaken, holder),
+			})
+		}
+	}
+	return kept, pmerrlist, nil
+}
+
+// Claims the gateway ports the gateway has picked for the flexible
+// requests, so that the other Services are not granted them. The recorded
+// mappings have these ports claimed up front on the next reconciliation,
+// so the failures are only logged.
+func (r *ServiceReconciler) claimPickedPorts(
+	ctx context.Context,
+	log logr.Logger,
+	service *corev1.Service,
+	pmreqlist []*portRequest,
+	pmreslist []*portmap.Response,
+) {
+	if r.Ports == nil {
+		return
+	}
+
+	claimed := make(map[portregistry.Port]struct{}, len(pmreqlist))
+	for _, pmreq := range pmreqlist {
+		if pmreq.GatewayPort != portmap.PortAny {
+			claimed[registryPort(pmreq.Request)] = struct{}{}
+		}
+	}
+	picked := make([]portregistry.Port, 0)
+	for _, pmres := range pmreslist {
+		if _, ok := claimed[responsePort(pmres)]; !ok {
+			picked = append(picked, responsePort(pmres))
+		}
+	}
+	if len(picked) == 0 {
+		return
+	}
+
+	owner := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+	denied, err := r.Ports.Claim(ctx, owner, picked)
+	if err != nil {
+		log.Error(err, "unable to claim the gateway ports picked by the gateway", "ports", picked)
+		return
+	}
+	for port, holder := range denied {
+		log.Info("the gateway has picked a gateway port held by another Service", "port", port, "holder", holder)
+	}
+}
+
+// Releases the ports held by the Services that are gone or no longer
+// handled, in case the ports were not released back then.
+// Returns whether any ports were released.
+func (r *ServiceReconciler) evictGoneHolders(
+	ctx context.Context,
+	log logr.Logger,
+	denied map[portregistry.Port]types.NamespacedName,
+) bool {
+	evicted := make(map[types.NamespacedName]struct{})
+	for _, holder := range denied {
+		if _, ok := evicted[holder]; ok {
+			continue
+		}
+		var service corev1.Service
+		err := r.Get(ctx, holder, &service)
+		if err != nil && !apierrors.IsNotFound(err) {
+			continue
+		}
+		// The ones with the finalizer will release the ports on their own.
+		if err == nil && (r.manages(&service) || controllerutil.ContainsFinalizer(&service, FinalizerName)) {
+			continue
+		}
+		log.Info("the Service holding the gateway ports is gone, releasing them", "holder", holder)
+		if err := r.Ports.Release(ctx, holder); err != nil {
+			log.Error(err, "unable to release the gateway ports", "holder", holder)
+			continue
+		}
+		evicted[holder] = struct{}{}
+	}
+	return len(evicted) > 0
+}
+
+// Releases the gateway ports of the Service, if the registry is used.
+func (r *ServiceReconciler) releasePorts(ctx context.Context, owner types.NamespacedName) error {
+	if r.Ports == nil {
+		return nil
+	}
+	return r.Ports.Release(ctx, owner)
+}
+
+// Has the Services that were denied the gateway ports reconciled when
+// the ports are released.
+func (r *ServiceReconciler) forwardHandovers(ctx context.Context, events chan<- event.GenericEvent) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case owner := <-r.Ports.Handovers():
+			r.Log.V(1).Info("the gateway port is released, handing it over", "service", owner)
+			service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: owner.Namespace, Name: owner.Name}}
+			select {
+			case events <- event.GenericEvent{Object: service}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+func registryPort(pmreq *portmap.Request) portregistry.Port {
+	return portregistry.Port{
+		Gateway:  pmreq.Gateway,
+		Protocol: serviceProtocol(pmreq.Protocol),
+		Port:     int32(pmreq.GatewayPort),
+	}
+}
+
+func responsePort(pmres *portmap.Response) portregistry.Port {
+	return portregistry.Port{
+		Gateway:  pmres.Gateway,
+		Protocol: serviceProtocol(pmres.Protocol),
+		Port:     int32(pmres.GatewayPort),
+	}
+}
@@ -2,31 +2,91 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/MOZGIII/port-map-operator/pkg/annotations"
+	"github.com/MOZGIII/port-map-operator/pkg/lease"
 	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	"github.com/MOZGIII/port-map-operator/pkg/portregistry"
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 // ServiceReconciler reconciles a Service object.
 type ServiceReconciler struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
 
 	PortMap         portmap.Mapper
 	DefaultLifetime portmap.Lifetime
+
+	// The names of the gateways the `PortMap` maps the ports at, see
+	// `portmap.Request.Gateway`. Empty means the single default gateway.
+	Gateways []string
+
+	// Renews the mappings before they expire. It has to be run separately,
+	// and use the same `PortMap`.
+	Leases *lease.Manager
+
+	// How many Services are reconciled at once. Zero means one.
+	MaxConcurrentReconciles int
+	// How many ports of a Service are mapped at once. Zero means one,
+	// in the order of the ports.
+	MaxConcurrentMappings int
+
+	// Grants the gateway ports to the Services first come first served.
+	// Nil means the Services are not checked for conflicts.
+	Ports *portregistry.ConfigMap
+
+	// Only the Services with this `spec.loadBalancerClass` are handled.
+	LoadBalancerClass string
+	// Whether to handle the Services without `spec.loadBalancerClass`.
+	HandleClasslessServices bool
+
+	// When the gateway loses its mappings, all the LoadBalancer Services
+	// are reconciled immediately instead of waiting for the renewal.
+	GatewayRestarts <-chan struct{}
+
+	// The node this instance runs at, set in the per-node mode, where
+	// only the ports of the Services assigned to this node are mapped.
+	NodeName string
+	// Selects the nodes the Services can be assigned to in the per-node
+	// mode. Nil means all the nodes.
+	NodeSelector labels.Selector
 }
 
 //+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=services/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=core,resources=services/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch
+//+kubebuilder:rbac:groups=port-map.mzg.io,resources=portmappings,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=port-map.mzg.io,resources=portmappings/status,verbs=get;update;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -36,76 +96,310 @@ func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	var service corev1.Service
 	if err := r.Get(ctx, req.NamespacedName, &service); err != nil {
 		log.Error(err, "unable to fetch Service, skipping")
+		if apierrors.IsNotFound(err) {
+			// Normally the mappings are deleted before the Service is gone,
+			// but if the finalizer was removed by hand, let them expire.
+			r.Leases.ForgetOwner(req.NamespacedName)
+			if err := r.releasePorts(ctx, req.NamespacedName); err != nil {
+				log.Error(err, "unable to release the gateway ports")
+			}
+		}
 		// We'll ignore not-found errors, since they can't be fixed by
 		// an immediate requeue (we'll need to wait for a new notification),
 		// and we can get them on deleted requests.
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
-		log.V(1).Info("service type is not LoadBalancer, skipping")
-		return ctrl.Result{}, nil
+	if !service.DeletionTimestamp.IsZero() || !r.manages(&service) {
+		return ctrl.Result{}, r.cleanup(ctx, log, &service)
 	}
 
 	ann, err := annotations.FromService(&service)
 	if err != nil {
 		log.Error(err, "Service annotations parsing error, skipping...")
+		r.Recorder.Event(&service, corev1.EventTypeWarning, EventReasonInvalidAnnotations, capitalize(err.Error()))
 		return ctrl.Result{}, nil
 	}
+	if reported, err := r.reportUnknownGateways(ctx, log, &service, ann); reported || err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
 
-	pmreqlist := makePortmapRequests(log, &service, ann, r.DefaultLifetime)
-	pmreslist, pmerrlist := r.mapPorts(ctx, log, pmreqlist)
-	log.Info("port mapping procedute finished", "errors", pmerrlist, "responses", pmreslist)
+	nodeName, owners, err := r.assign(ctx, &service, ann)
+	if errors.Is(err, ErrNoReadyEndpoints) {
+		// Nothing would answer at the NodePort anyway, wait for
+		// the endpoints to appear.
+		log.Info("no ready endpoints, leaving the port mappings as is")
+		r.Recorder.Event(&service, corev1.EventTypeWarning, EventReasonNoReadyEndpoints,
+			"No node has ready endpoints for the Service, the ports are left as is")
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		log.Error(err, "unable to assign the Service to a node")
+		return ctrl.Result{}, err
+	}
+
+	if r.perNode() && nodeName != r.NodeName {
+		log.V(1).Info("service is assigned to another node, releasing the port mappings", "assignedNode", nodeName)
+		_, err = r.releaseMappings(ctx, log, &service, owners)
+		return ctrl.Result{}, err
+	}
+
+	internalIP, err := r.nodeInternalIP(ctx, nodeName)
+	if err != nil {
+		log.Error(err, "unable to determine the node address", "node", nodeName)
+		return ctrl.Result{}, err
+	}
+
+	original := service.DeepCopy()
+
+	mapped, err := annotations.MappedFromService(&service)
+	if err != nil {
+		log.Error(err, "unable to parse the recorded mappings, forgetting them")
+	}
+	// The mappings of the other nodes are up to their instances.
+	mapped, others := owners.split(mapped)
+
+	pmreqlist := r.makeRequests(log, &service, ann, internalIP)
+	mapped, pmreslist, pmerrlist, err := r.syncMappings(ctx, log, &service, owners, mapped, pmreqlist, internalIP)
+	if err != nil {
+		log.Error(err, "unable to claim the gateway ports")
+		return ctrl.Result{}, err
+	}
+	if err := recordMappings(&service, append(others, mapped...)); err != nil {
+		log.Error(err, "unable to record the mappings")
+		return ctrl.Result{}, err
+	}
 
-	err = r.updateStatus(ctx, &service, pmreslist, pmerrlist)
+	err = r.updateMetadata(ctx, original, &service)
 	if err != nil {
+		log.Error(err, "unable to update the Service")
+	} else if err = r.updateStatus(ctx, &service, pmreslist, pmerrlist); err != nil {
 		log.Error(err, "unable to update the Service status")
+	} else if err = r.syncPortMappings(ctx, &service, internalIP, pmreslist, pmerrlist); err != nil {
+		log.Error(err, "unable to update the PortMappings")
 	} else {
 		log.V(1).Info("status updated successfully")
 	}
 
-	requeueAfter := r.DefaultLifetime - 2 // nolint: gomnd
-	const twelveHoursInSecs = 12 * 60
-	if requeueAfter > twelveHoursInSecs {
-		requeueAfter = twelveHoursInSecs
+	// The mapped ports are renewed by the lease manager, but the failed
+	// ones have to be retried.
+	var result ctrl.Result
+	if len(pmerrlist) > 0 {
+		result.RequeueAfter = MappingRetryInterval
+	}
+	return result, client.IgnoreNotFound(err)
+}
+
+// Claims the gateway ports, deletes the stale mappings, maps the ports,
+// and returns the mappings to record.
+func (r *ServiceReconciler) syncMappings(
+	ctx context.Context,
+	log logr.Logger,
+	service *corev1.Service,
+	owners *mappingOwnership,
+	mapped []annotations.Mapping,
+	pmreqlist []*portRequest,
+	internalIP net.IP,
+) ([]annotations.Mapping, []*portmap.Response, []error, error) {
+	owner := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+
+	// The flexible requests ask for the ports they have, and these are
+	// checked and claimed along with the rest.
+	suggestMappedPorts(pmreqlist, mapped)
+	pmreqlist, rejectErrs := r.filterAllowedPorts(log, pmreqlist)
+	pmreqlist, claimErrs, err := r.claimPorts(ctx, log, service, pmreqlist)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// The stale mappings go first, so that they don't conflict with
+	// the new ones for the same gateway ports.
+	mapped, stale := splitStaleMappings(mapped, pmreqlist)
+	if len(stale) > 0 {
+		log.Info("deleting stale port mappings", "mappings", stale)
+		// The ones that failed to be deleted are retried next time.
+		mapped = append(mapped, owners.dropOrphans(log, r.unmapPorts(ctx, log, service, stale))...)
+	}
+
+	pmreslist, pmerrlist := r.mapPorts(ctx, log, owner, pmreqlist)
+	r.claimPickedPorts(ctx, log, service, pmreqlist, pmreslist)
+	pmerrlist = append(pmerrlist, rejectErrs...)
+	pmerrlist = append(pmerrlist, claimErrs...)
+	log.Info("port mapping procedute finished", "errors", pmerrlist, "responses", pmreslist)
+	r.recordMappingEvents(service, mapped, internalIP, pmreslist, pmerrlist)
+
+	added := mappingsFromResponses(pmreslist, internalIP)
+	mapped, superseded := splitSupersededMappings(mapped, pmreqlist, added)
+	for _, mapping := range superseded {
+		// With some protocols deleting the mapping would delete the one
+		// that has superseded it, so let it expire instead.
+		log.Info("the gateway has moved the port mapping, forgetting the previous one", "mapping", mapping)
+		if pmreq, ok := unmapRequest(mapping); ok {
+			r.Leases.Forget(owner, pmreq)
+		}
 	}
 
-	return ctrl.Result{
-		// Force reqeue this service to renew the port map lifetime.
-		RequeueAfter: time.Second * time.Duration(requeueAfter),
-	}, client.IgnoreNotFound(err)
+	return mergeMappings(mapped, added), pmreslist, pmerrlist, nil
+}
+
+// MappingRetryInterval is how soon the ports that failed to map are retried.
+const MappingRetryInterval = time.Minute
+
+// Whether the Service is a LoadBalancer meant for this operator.
+func (r *ServiceReconciler) manages(service *corev1.Service) bool {
+	if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return false
+	}
+	if service.Spec.LoadBalancerClass == nil {
+		return r.HandleClasslessServices
+	}
+	return *service.Spec.LoadBalancerClass == r.LoadBalancerClass
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Service{}).
+	bldr := ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Service{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			service, ok := obj.(*corev1.Service)
+			if !ok {
+				return false
+			}
+			// The ones with the finalizer still have to be cleaned up.
+			return r.manages(service) || controllerutil.ContainsFinalizer(service, FinalizerName)
+		}))).
+		Watches(
+			&source.Kind{Type: &discoveryv1.EndpointSlice{}},
+			handler.EnqueueRequestsFromMapFunc(r.endpointSliceService),
+		)
+
+	if r.perNode() {
+		// The Services move between the nodes as they come and go.
+		bldr = bldr.Watches(
+			&source.Kind{Type: &corev1.Node{}},
+			handler.EnqueueRequestsFromMapFunc(r.allLoadBalancerServices),
+			builder.WithPredicates(nodeAssignmentChanged),
+		)
+	}
+
+	if r.GatewayRestarts != nil {
+		events := make(chan event.GenericEvent)
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			return r.forwardGatewayRestarts(ctx, events)
+		})); err != nil {
+			return err
+		}
+		bldr = bldr.Watches(
+			&source.Channel{Source: events},
+			handler.EnqueueRequestsFromMapFunc(r.allLoadBalancerServices),
+		)
+	}
+
+	leaseEvents := make(chan event.GenericEvent)
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		return r.forwardLeaseFailures(ctx, leaseEvents)
+	})); err != nil {
+		return err
+	}
+	bldr = bldr.Watches(&source.Channel{Source: leaseEvents}, &handler.EnqueueRequestForObject{})
+
+	if r.Ports != nil {
+		handoverEvents := make(chan event.GenericEvent)
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			return r.forwardHandovers(ctx, handoverEvents)
+		})); err != nil {
+			return err
+		}
+		bldr = bldr.Watches(&source.Channel{Source: handoverEvents}, &handler.EnqueueRequestForObject{})
+	}
+
+	return bldr.
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
 
+func (r *ServiceReconciler) forwardGatewayRestarts(ctx context.Context, events chan<- event.GenericEvent) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-r.GatewayRestarts:
+			r.Log.Info("gateway restart detected, remapping all the services")
+			// The object is irrelevant, all the services are enqueued.
+			select {
+			case events <- event.GenericEvent{Object: &corev1.Service{}}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+func (r *ServiceReconciler) allLoadBalancerServices(_ client.Object) []reconcile.Request {
+	var services corev1.ServiceList
+	if err := r.List(context.Background(), &services); err != nil {
+		r.Log.Error(err, "unable to list Services")
+		return nil
+	}
+
+	reqs := make([]reconcile.Request, 0, len(services.Items))
+	for i := range services.Items {
+		service := &services.Items[i]
+		if !r.manages(service) {
+			continue
+		}
+		reqs = append(reqs, reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: service.Namespace, Name: service.Name},
+		})
+	}
+	return reqs
+}
+
+var ErrNoNodeInternalIP = errors.New("node has no internal IP address")
+
+// Returns nil if the node is not set, leaving it up to the mapper
+// to use the address of the host it runs at.
+func (r *ServiceReconciler) nodeInternalIP(ctx context.Context, nodeName string) (net.IP, error) {
+	if nodeName == "" {
+		return nil, nil
+	}
+
+	var node corev1.Node
+	if err := r.Get(ctx, types.NamespacedName{Name: nodeName}, &node); err != nil {
+		return nil, err
+	}
+
+	if ip := nodeAddress(&node); ip != nil {
+		return ip, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoNodeInternalIP, nodeName)
+}
+
+// The request to map a Service port.
+type portRequest struct {
+	*portmap.Request
+
+	// Whether the gateway may map another gateway port than requested.
+	Flexible bool
+}
+
 func makePortmapRequests(
 	log logr.Logger,
 	service *corev1.Service,
 	ann *annotations.Annotations,
+	internalIP net.IP,
 	defaultLifetime portmap.Lifetime,
-) []*portmap.Request {
-	pmreqlist := make([]*portmap.Request, 0, len(service.Spec.Ports))
+) []*portRequest {
+	pmreqlist := make([]*portRequest, 0, len(service.Spec.Ports))
 
-	for _, servicePort := range service.Spec.Ports {
-		override, hasOverride := ann.Overrides[annotations.PortDescriptor{Port: servicePort.Port, Protocol: servicePort.Protocol}]
+	for i := range service.Spec.Ports {
+		servicePort := &service.Spec.Ports[i]
+		override, hasOverride := ann.OverrideFor(servicePort)
 		if hasOverride && override.Skip {
 			continue
 		}
 
-		var protocol portmap.Protocol
-		switch servicePort.Protocol {
-		case corev1.ProtocolTCP:
-			protocol = portmap.ProtocolTCP
-		case corev1.ProtocolUDP:
-			protocol = portmap.ProtocolUDP
-		case corev1.ProtocolSCTP:
-			protocol = portmap.ProtocolSCTP
-		default:
+		protocol, ok := portmapProtocol(servicePort.Protocol)
+		if !ok {
 			log.Info("unexpected protocol", "protocol", servicePort.Protocol)
 		}
 
@@ -114,36 +408,119 @@ func makePortmapRequests(
 		if hasOverride && override.Port > 0 {
 			gatewayPort = override.Port
 		}
+		if hasOverride && override.Policy == annotations.PortPolicyAny {
+			gatewayPort = int32(portmap.PortAny)
+		}
 
 		pmreq := &portmap.Request{
 			Protocol:    protocol,
 			NodePort:    portmap.Port(servicePort.NodePort),
 			GatewayPort: portmap.Port(gatewayPort),
-			Lifetime:    defaultLifetime,
+			Lifetime:    requestLifetime(ann, override, defaultLifetime),
+			Description: fmt.Sprintf("%s/%s", service.Namespace, service.Name),
+			InternalIP:  internalIP,
 		}
-		pmreqlist = append(pmreqlist, pmreq)
+		pmreqlist = append(pmreqlist, &portRequest{
+			Request:  pmreq,
+			Flexible: hasOverride && override.Policy.Flexible(),
+		})
 	}
 
 	return pmreqlist
 }
 
-func (r *ServiceReconciler) mapPorts(ctx context.Context, log logr.Logger, pmreqlist []*portmap.Request) ([]*portmap.Response, []error) {
+// The lifetime of the port override wins over the one of the Service.
+func requestLifetime(
+	ann *annotations.Annotations,
+	override *annotations.Override,
+	defaultLifetime portmap.Lifetime,
+) portmap.Lifetime {
+	switch {
+	case override != nil && override.Lifetime.Duration > 0:
+		return portmap.LifetimeFromDuration(override.Lifetime.Duration)
+	case ann.Lifetime > 0:
+		return portmap.LifetimeFromDuration(ann.Lifetime)
+	default:
+		return defaultLifetime
+	}
+}
+
+func (r *ServiceReconciler) mapPorts(
+	ctx context.Context,
+	log logr.Logger,
+	owner types.NamespacedName,
+	pmreqlist []*portRequest,
+) ([]*portmap.Response, []error) {
 	log.V(1).Info("mapping ports", "requests", pmreqlist)
 
+	results := make([]*portmap.Response, len(pmreqlist))
+	errs := make([]error, len(pmreqlist))
+	r.forEachConcurrently(len(pmreqlist), func(i int) {
+		pmreq := pmreqlist[i]
+		reqctx := ctx
+		if expiry, ok := r.Leases.Expiry(owner, pmreq.Request); ok {
+			// Remapped before the new ones, like the renewals.
+			reqctx = portmap.WithExpiry(ctx, expiry)
+		}
+		results[i], errs[i] = r.mapPort(reqctx, log, pmreq)
+	})
+
 	pmreslist := make([]*portmap.Response, 0, len(pmreqlist))
 	pmerrlist := make([]error, 0)
-
-	for _, pmreq := range pmreqlist {
-		pmres, err := r.mapPort(ctx, log, pmreq)
-		if err != nil {
-			pmerrlist = append(pmerrlist, err)
+	for i, pmreq := range pmreqlist {
+		if errs[i] != nil {
+			pmerrlist = append(pmerrlist, &PortMapError{Request: pmreq.Request, Err: errs[i]})
 			continue
 		}
-		pmreslist = append(pmreslist, pmres)
+		r.Leases.Track(owner, pmreq.Request, results[i])
+		pmreslist = append(pmreslist, results[i])
 	}
 	return pmreslist, pmerrlist
 }
 
+// Calls fn for the indices up to n, at most `MaxConcurrentMappings`
+// of them at once, and waits for all of them.
+func (r *ServiceReconciler) forEachConcurrently(n int, fn func(i int)) {
+	if r.MaxConcurrentMappings <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	sem := make(chan struct{}, r.MaxConcurrentMappings)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// PortMapError is the error mapping a particular port.
+type PortMapError struct {
+	Request *portmap.Request
+	Err     error
+}
+
+var _ error = (*PortMapError)(nil)
+
+func (e *PortMapError) Error() string {
+	return fmt.Sprintf(
+		"unable to map %s port %d%s: %v",
+		serviceProtocol(e.Request.Protocol), e.Request.GatewayPort, atGateway(e.Request.Gateway), e.Err,
+	)
+}
+
+func (e *PortMapError) Unwrap() error {
+	return e.Err
+}
+
 type ErrMappedGatewayPortMismatch struct {
 	RequestedGatewayPort portmap.Port
 	MappedGatewayPort    portmap.Port
@@ -158,40 +535,58 @@ func (e *ErrMappedGatewayPortMismatch) Error() string {
 	)
 }
 
-func (r *ServiceReconciler) mapPort(ctx context.Context, log logr.Logger, pmreq *portmap.Request) (*portmap.Response, error) {
-	log.V(1).Info("mapping port", "request", pmreq)
+func (r *ServiceReconciler) mapPort(ctx context.Context, log logr.Logger, pmreq *portRequest) (*portmap.Response, error) {
+	log.V(1).Info("mapping port", "request", pmreq.Request)
 
-	pmres, err := r.PortMap.Map(ctx, pmreq)
+	pmres, err := r.PortMap.Map(ctx, pmreq.Request)
 	if err != nil {
-		log.Error(err, "unable to map the port", "request", pmreq)
+		log.Error(err, "unable to map the port", "request", pmreq.Request)
 		return nil, err
 	}
-
-	if err := checkRequestResponseCoherence(pmreq, pmres); err != nil {
-		log.Error(err, "the response was not coherent to the request", "request", pmreq, "response", pmres)
-
-		cancelreq := &portmap.Request{
-			Protocol:    pmres.Protocol,
-			NodePort:    pmres.NodePort,
-			GatewayPort: pmres.GatewayPort,
-			Lifetime:    portmap.LifetimeDelete,
-		}
-		cancelres, cancelerr := r.PortMap.Map(ctx, cancelreq)
-		if cancelerr != nil {
-			log.Error(
-				cancelerr,
-				"failed to cancel incoherent port map",
-				"request", pmreq, "response", pmres,
-				"cancelreq", cancelreq, "cancelres", cancelres,
-			)
+	pmres.Gateway = pmreq.Gateway
+
+	if pmreq.Flexible {
+		// The requested port is checked up front, but the one the gateway
+		// picks can only be checked now.
+		if config := r.gatewayConfig(pmreq.Gateway); !config.Allows(pmres.GatewayPort) {
+			err := fmt.Errorf("%w: %d, picked by the gateway", ErrGatewayPortNotAllowed, pmres.GatewayPort)
+			log.Error(err, "the gateway picked a port the Gateway doesn't allow", "request", pmreq, "response", pmres)
+			r.cancelMapping(ctx, log, pmreq, pmres)
+			return nil, err
 		}
+		return pmres, nil
+	}
 
+	if err := checkRequestResponseCoherence(pmreq.Request, pmres); err != nil {
+		log.Error(err, "the response was not coherent to the request", "request", pmreq, "response", pmres)
+		r.cancelMapping(ctx, log, pmreq, pmres)
 		return nil, err
 	}
 
+	if pmres.Permanent {
+		log.Info("the gateway has mapped the port permanently, it stays until deleted", "response", pmres)
+	}
 	return pmres, nil
 }
 
+// Deletes the mapping the gateway has made, but that can't be kept.
+func (r *ServiceReconciler) cancelMapping(ctx context.Context, log logr.Logger, pmreq *portRequest, pmres *portmap.Response) {
+	cancelreq := &portmap.Request{
+		Gateway:     pmreq.Gateway,
+		Protocol:    pmres.Protocol,
+		NodePort:    pmres.NodePort,
+		GatewayPort: pmres.GatewayPort,
+		InternalIP:  pmreq.InternalIP,
+	}
+	if cancelerr := r.PortMap.Unmap(ctx, cancelreq); cancelerr != nil {
+		log.Error(
+			cancelerr,
+			"failed to cancel the port map",
+			"request", pmreq, "response", pmres, "cancelreq", cancelreq,
+		)
+	}
+}
+
 func checkRequestResponseCoherence(pmreq *portmap.Request, pmres *portmap.Response) error {
 	if pmres.GatewayPort != pmreq.GatewayPort {
 		return &ErrMappedGatewayPortMismatch{
@@ -202,31 +597,164 @@ func checkRequestResponseCoherence(pmreq *portmap.Request, pmres *portmap.Respon
 	return nil
 }
 
+// The finalizer is added along with the record of the mappings,
+// so that we have something to clean up when it comes to that.
+func recordMappings(service *corev1.Service, mapped []annotations.Mapping) error {
+	if err := annotations.SetMapped(service, mapped); err != nil {
+		return err
+	}
+	if len(mapped) > 0 {
+		controllerutil.AddFinalizer(service, FinalizerName)
+	}
+	return nil
+}
+
+// Persists the changes to the Service metadata, if any.
+func (r *ServiceReconciler) updateMetadata(ctx context.Context, original, service *corev1.Service) error {
+	if equality.Semantic.DeepEqual(original.ObjectMeta, service.ObjectMeta) {
+		return nil
+	}
+	return r.Update(ctx, service)
+}
+
+// The errors reported at the Service status ports.
+// See `corev1.PortStatus` for the format.
+const (
+	PortErrorGatewayPortMismatch   = "port-map.mzg.io/GatewayPortMismatch"
+	PortErrorGatewayPortTaken      = "port-map.mzg.io/GatewayPortTaken"
+	PortErrorGatewayPortNotAllowed = "port-map.mzg.io/GatewayPortNotAllowed"
+	PortErrorMappingFailed         = "port-map.mzg.io/MappingFailed"
+)
+
 func (r *ServiceReconciler) updateStatus(
 	ctx context.Context,
 	service *corev1.Service,
 	pmreslist []*portmap.Response,
-	pmerrlist []error, // nolint: unparam // TODO
+	pmerrlist []error,
 ) error {
 	serviceCopy := service.DeepCopy()
+	// Recorded by now, the failed ones included if they were mapped before.
+	mapped, _ := annotations.MappedFromService(service)
+	serviceCopy.Status.LoadBalancer.Ingress = makeIngress(service.Status.LoadBalancer.Ingress, mapped, pmreslist, pmerrlist)
+	setPortsMappedCondition(serviceCopy, pmreslist, pmerrlist)
+
+	if equality.Semantic.DeepEqual(service.Status, serviceCopy.Status) {
+		return nil
+	}
+	return r.Status().Update(ctx, serviceCopy)
+}
 
-	extenralIPs := make([]string, 0, len(pmreslist))
+// Produces an ingress point per gateway IP, listing all the mapped ports
+// of that gateway, and the ports that failed to map. The failed ports that
+// are still recorded as mapped keep the IPs of the previous ingress, so that
+// the gateways failing altogether are still reported, and a transient
+// failure doesn't take the IPs away.
+func makeIngress(
+	previous []corev1.LoadBalancerIngress,
+	mapped []annotations.Mapping,
+	pmreslist []*portmap.Response,
+	pmerrlist []error,
+) []corev1.LoadBalancerIngress {
+	ingress := make([]corev1.LoadBalancerIngress, 0)
+	// The IPs of every gateway, to report the failed ports at.
+	gatewayIPs := make(map[string]map[string]struct{})
 
 OuterLoop:
 	for _, pmres := range pmreslist {
+		if gatewayIPs[pmres.Gateway] == nil {
+			gatewayIPs[pmres.Gateway] = make(map[string]struct{})
+		}
+		gatewayIPs[pmres.Gateway][pmres.GatewayIP.String()] = struct{}{}
+
+		portStatus := corev1.PortStatus{
+			Port:     int32(pmres.GatewayPort),
+			Protocol: serviceProtocol(pmres.Protocol),
+		}
+
 		ip := pmres.GatewayIP.String()
-		for _, existingIP := range extenralIPs {
-			if ip == existingIP {
+		for i := range ingress {
+			if ingress[i].IP == ip {
+				ingress[i].Ports = append(ingress[i].Ports, portStatus)
 				continue OuterLoop
 			}
 		}
-		extenralIPs = append(extenralIPs, ip)
+		ingress = append(ingress, corev1.LoadBalancerIngress{
+			IP:    ip,
+			Ports: []corev1.PortStatus{portStatus},
+		})
 	}
 
-	serviceCopy.Spec.ExternalIPs = extenralIPs
+	for _, pmerr := range pmerrlist {
+		var perr *PortMapError
+		if !errors.As(pmerr, &perr) || perr.Request.GatewayPort == portmap.PortAny {
+			// There's no port to report the error at.
+			continue
+		}
 
-	// TODO: set load balancer ingresses
-	// TODO: set proper conditions
+		pmreq := perr.Request
+		mapping := newMapping(pmreq.Gateway, pmreq.Protocol, pmreq.NodePort, pmreq.GatewayPort, pmreq.InternalIP)
+		if len(gatewayIPs[pmreq.Gateway]) == 0 && hasMapping(mapped, mapping) {
+			for _, ip := range previousIPs(previous, pmreq, gatewayIPs) {
+				if gatewayIPs[pmreq.Gateway] == nil {
+					gatewayIPs[pmreq.Gateway] = make(map[string]struct{})
+				}
+				gatewayIPs[pmreq.Gateway][ip] = struct{}{}
+				ingress = append(ingress, corev1.LoadBalancerIngress{IP: ip, Ports: []corev1.PortStatus{}})
+			}
+		}
 
-	return r.Update(ctx, serviceCopy)
+		reason := portErrorReason(perr.Err)
+		portStatus := corev1.PortStatus{
+			Port:     int32(perr.Request.GatewayPort),
+			Protocol: serviceProtocol(perr.Request.Protocol),
+			Error:    &reason,
+		}
+
+		for i := range ingress {
+			if _, ok := gatewayIPs[perr.Request.Gateway][ingress[i].IP]; ok {
+				ingress[i].Ports = append(ingress[i].Ports, portStatus)
+			}
+		}
+	}
+
+	return ingress
+}
+
+// The IPs of the previous ingress the port was listed at, other than
+// the ones known to belong to other gateways.
+func previousIPs(
+	previous []corev1.LoadBalancerIngress,
+	pmreq *portmap.Request,
+	gatewayIPs map[string]map[string]struct{},
+) []string {
+	ips := make([]string, 0)
+OuterLoop:
+	for i := range previous {
+		for gateway, known := range gatewayIPs {
+			if _, ok := known[previous[i].IP]; ok && gateway != pmreq.Gateway {
+				continue OuterLoop
+			}
+		}
+		for _, port := range previous[i].Ports {
+			if port.Port == int32(pmreq.GatewayPort) && port.Protocol == serviceProtocol(pmreq.Protocol) {
+				ips = append(ips, previous[i].IP)
+				break
+			}
+		}
+	}
+	return ips
+}
+
+func portErrorReason(err error) string {
+	var mismatchErr *ErrMappedGatewayPortMismatch
+	if errors.As(err, &mismatchErr) {
+		return PortErrorGatewayPortMismatch
+	}
+	if errors.Is(err, ErrGatewayPortTaken) {
+		return PortErrorGatewayPortTaken
+	}
+	if errors.Is(err, ErrGatewayPortNotAllowed) {
+		return PortErrorGatewayPortNotAllowed
+	}
+	return PortErrorMappingFailed
 }
@@ -6,13 +6,21 @@ import (
 	"net"
 	"time"
 
+	portmapv1alpha1 "github.com/MOZGIII/port-map-operator/api/v1alpha1"
 	"github.com/MOZGIII/port-map-operator/pkg/annotations"
+	"github.com/MOZGIII/port-map-operator/pkg/gatewayset"
 	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	"github.com/MOZGIII/port-map-operator/pkg/portregistry"
+	"github.com/go-logr/logr"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 var _ = Describe("Service controller", func() {
@@ -49,6 +57,18 @@ var _ = Describe("Service controller", func() {
 		}, timeout, interval).Should(Succeed(), "failed to delete test namespace")
 	})
 
+	// Deletes the Service and waits for the finalizer to be released,
+	// letting the mock handle the cleanup requests.
+	deleteService := func(service *corev1.Service) {
+		autostopch := pmmockctl.Auto()
+		defer close(autostopch)
+		Expect(k8sClient.Delete(ctx, service)).Should(Succeed())
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(service), &corev1.Service{})
+			return apierrors.IsNotFound(err)
+		}, timeout, interval).Should(BeTrue(), "should be gone")
+	}
+
 	Context("When mapping ports for LoadBalancer Service", func() {
 		It("Should issue proper port map requests", func() {
 			By("By creating a new Service")
@@ -92,6 +112,7 @@ var _ = Describe("Service controller", func() {
 				NodePort:    portmap.Port(32100),
 				GatewayPort: portmap.Port(1234),
 				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
 			}, timeout)
 			pmmockctl.Inject(&portmap.Response{
 				Protocol:    portmap.ProtocolTCP,
@@ -101,20 +122,49 @@ var _ = Describe("Service controller", func() {
 				Lifetime:    portmap.Lifetime(120),
 			}, timeout)
 
-			By("By checking that the ExternalIPs is updated")
-			Eventually(func() ([]string, error) {
+			By("By checking that the load balancer ingress is updated")
+			Eventually(func() ([]corev1.LoadBalancerIngress, error) {
 				err := k8sClient.Get(ctx, serviceLookupKey, createdService)
 				if err != nil {
 					return nil, err
 				}
 
-				return createdService.Spec.ExternalIPs, nil
-			}, timeout, interval).Should(ConsistOf("1.2.3.4"), "should list the mapped IP in the external IPs")
+				return createdService.Status.LoadBalancer.Ingress, nil
+			}, timeout, interval).Should(Equal([]corev1.LoadBalancerIngress{
+				{
+					IP: "1.2.3.4",
+					Ports: []corev1.PortStatus{
+						{Port: 1234, Protocol: corev1.ProtocolTCP},
+					},
+				},
+			}), "should list the mapped IP in the ingress")
+
+			By("By checking that the external IPs are left intact")
+			Expect(createdService.Spec.ExternalIPs).To(BeEmpty())
+
+			By("By checking that the condition is set")
+			condition := meta.FindStatusCondition(createdService.Status.Conditions, ConditionPortsMapped)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+			Expect(condition.Reason).To(Equal(ConditionReasonMapped))
+
+			By("By checking that the PortMapping mirrors the mapping")
+			portMapping := &portmapv1alpha1.PortMapping{}
+			Eventually(func() (string, error) {
+				err := k8sClient.Get(ctx, types.NamespacedName{Name: serviceName + "-tcp-1234", Namespace: serviceNamespace}, portMapping)
+				return portMapping.Status.GatewayIP, err
+			}, timeout, interval).Should(Equal("1.2.3.4"))
+			Expect(portMapping.Labels).To(HaveKeyWithValue(portmapv1alpha1.ServiceLabel, serviceName))
+			Expect(metav1.IsControlledBy(portMapping, createdService)).To(BeTrue())
+			Expect(portMapping.Spec.NodePort).To(Equal(int32(32100)))
+			Expect(portMapping.Status.GatewayPort).To(Equal(int32(1234)))
+			Expect(portMapping.Status.InternalPort).To(Equal(int32(32100)))
+			Expect(portMapping.Status.Lifetime).To(Equal(&metav1.Duration{Duration: 120 * time.Second}))
+			Expect(portMapping.Status.ExpiryTime).NotTo(BeNil())
+			Expect(portMapping.Status.LastError).To(BeEmpty())
 
 			By("Deleting the service after the test is done")
-			autostopch := pmmockctl.Auto()
-			defer close(autostopch)
-			Expect(k8sClient.Delete(ctx, service)).Should(Succeed())
+			deleteService(service)
 		})
 	})
 
@@ -161,6 +211,7 @@ var _ = Describe("Service controller", func() {
 				NodePort:    portmap.Port(32100),
 				GatewayPort: portmap.Port(256),
 				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
 			}, timeout)
 			By("By injecting a mock port mapper response with non-matching gateway port")
 			pmmockctl.Inject(&portmap.Response{
@@ -187,20 +238,227 @@ var _ = Describe("Service controller", func() {
 				Lifetime:    portmap.LifetimeDelete,
 			}, timeout)
 
-			By("By checking that the ExternalIPs is not updated")
-			Eventually(func() ([]string, error) {
+			By("By checking that the load balancer ingress is not updated")
+			Eventually(func() ([]corev1.LoadBalancerIngress, error) {
 				err := k8sClient.Get(ctx, serviceLookupKey, createdService)
 				if err != nil {
 					return nil, err
 				}
 
-				return createdService.Spec.ExternalIPs, nil
+				return createdService.Status.LoadBalancer.Ingress, nil
 			}, timeout, interval).Should(BeEmpty(), "should be empty")
 
 			By("Deleting the service after the test is done")
+			deleteService(service)
+		})
+	})
+
+	Context("When the gateway maps another port than requested for a flexible port", func() {
+		It("Should accept the mapping", func() {
+			By("By creating a new Service")
+			service := &corev1.Service{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: corev1.SchemeGroupVersion.Version,
+					Kind:       "Service",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      serviceName,
+					Namespace: serviceNamespace,
+					Annotations: map[string]string{
+						annotations.OverridesV1Key: `{"TCP/256":{"policy":"accept-alternative"},"TCP/257":{"policy":"any"}}`,
+					},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{
+							Name:     "test1",
+							Protocol: "TCP",
+							Port:     256,
+							NodePort: 32100,
+						},
+						{
+							Name:     "test2",
+							Protocol: "TCP",
+							Port:     257,
+							NodePort: 32101,
+						},
+					},
+					Selector: map[string]string{
+						"app": "test",
+					},
+					Type: corev1.ServiceTypeLoadBalancer,
+				},
+			}
+			Expect(k8sClient.Create(ctx, service)).Should(Succeed())
+			serviceLookupKey := types.NamespacedName{Name: serviceName, Namespace: serviceNamespace}
+
+			By("By waiting for the created Service to appear at the API")
+			createdService := &corev1.Service{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, serviceLookupKey, createdService)
+			}, timeout, interval).Should(Succeed())
+			Expect(createdService.ObjectMeta.Name).Should(Equal(serviceName))
+
+			By("By waiting for the mock port mapper to receive the port map requests")
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(256),
+				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
+			}, timeout)
+			By("By injecting a mock port mapper response with another gateway port")
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1024),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(120),
+			}, timeout)
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32101),
+				GatewayPort: portmap.PortAny,
+				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
+			}, timeout)
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32101),
+				GatewayPort: portmap.Port(1025),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(120),
+			}, timeout)
+
+			By("By checking that the load balancer ingress lists the mapped ports")
+			Eventually(func() ([]corev1.LoadBalancerIngress, error) {
+				err := k8sClient.Get(ctx, serviceLookupKey, createdService)
+				if err != nil {
+					return nil, err
+				}
+
+				return createdService.Status.LoadBalancer.Ingress, nil
+			}, timeout, interval).Should(Equal([]corev1.LoadBalancerIngress{
+				{
+					IP: "1.2.3.4",
+					Ports: []corev1.PortStatus{
+						{Port: 1024, Protocol: corev1.ProtocolTCP},
+						{Port: 1025, Protocol: corev1.ProtocolTCP},
+					},
+				},
+			}), "should list the mapped ports in the ingress")
+
+			By("By checking that the mappings are recorded")
+			mapped, err := annotations.MappedFromService(createdService)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(mapped).To(ConsistOf(
+				annotations.Mapping{Protocol: corev1.ProtocolTCP, NodePort: 32100, GatewayPort: 1024},
+				annotations.Mapping{Protocol: corev1.ProtocolTCP, NodePort: 32101, GatewayPort: 1025},
+			))
+
+			By("By checking that the ports the gateway picked are claimed at the registry")
+			Eventually(func() ([]portregistry.Port, error) {
+				return portRegistry.Holds(ctx, serviceLookupKey)
+			}, timeout, interval).Should(ConsistOf(
+				portregistry.Port{Protocol: corev1.ProtocolTCP, Port: 256},
+				portregistry.Port{Protocol: corev1.ProtocolTCP, Port: 1024},
+				portregistry.Port{Protocol: corev1.ProtocolTCP, Port: 1025},
+			))
+
+			By("Deleting the service after the test is done")
+			deleteService(service)
+
+			By("By checking that the ports are released")
+			Eventually(func() ([]portregistry.Port, error) {
+				return portRegistry.Holds(ctx, serviceLookupKey)
+			}, timeout, interval).Should(BeEmpty())
+		})
+	})
+
+	Context("When two Services ask for the same gateway port", func() {
+		It("Should grant it to the first one, and hand it over when it's gone", func() {
+			newService := func(name string, nodePort int32) *corev1.Service {
+				return &corev1.Service{
+					TypeMeta: metav1.TypeMeta{
+						APIVersion: corev1.SchemeGroupVersion.Version,
+						Kind:       "Service",
+					},
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      name,
+						Namespace: serviceNamespace,
+					},
+					Spec: corev1.ServiceSpec{
+						Ports: []corev1.ServicePort{
+							{
+								Name:     "https",
+								Protocol: "TCP",
+								Port:     443,
+								NodePort: nodePort,
+							},
+						},
+						Selector: map[string]string{
+							"app": "test",
+						},
+						Type: corev1.ServiceTypeLoadBalancer,
+					},
+				}
+			}
+			conditionReasonOf := func(key types.NamespacedName) func() (string, error) {
+				return func() (string, error) {
+					var service corev1.Service
+					if err := k8sClient.Get(ctx, key, &service); err != nil {
+						return "", err
+					}
+					condition := meta.FindStatusCondition(service.Status.Conditions, ConditionPortsMapped)
+					if condition == nil {
+						return "", nil
+					}
+					return condition.Reason, nil
+				}
+			}
+
+			By("By creating the first Service")
+			first := newService(serviceName, 32100)
+			Expect(k8sClient.Create(ctx, first)).Should(Succeed())
+
+			By("By waiting for the mock port mapper to receive and handle the port map request")
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(443),
+				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
+			}, timeout)
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(443),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(120),
+			}, timeout)
+			Eventually(conditionReasonOf(client.ObjectKeyFromObject(first)), timeout, interval).
+				Should(Equal(ConditionReasonMapped))
+
+			By("By creating the second Service")
+			second := newService(serviceName+"-2", 32101)
+			Expect(k8sClient.Create(ctx, second)).Should(Succeed())
+
+			By("By checking that the port is not mapped for the second Service")
+			Eventually(conditionReasonOf(client.ObjectKeyFromObject(second)), timeout, interval).
+				Should(Equal(ConditionReasonGatewayPortTaken))
+			pmmockctl.ExpectNothing(time.Second)
+
+			By("By deleting the first Service")
 			autostopch := pmmockctl.Auto()
-			defer close(autostopch)
-			Expect(k8sClient.Delete(ctx, service)).Should(Succeed())
+			deleteService(first)
+
+			By("By checking that the port is handed over to the second Service")
+			Eventually(conditionReasonOf(client.ObjectKeyFromObject(second)), timeout, interval).
+				Should(Equal(ConditionReasonMapped))
+			close(autostopch)
+
+			By("Deleting the service after the test is done")
+			deleteService(second)
 		})
 	})
 
@@ -253,6 +511,7 @@ var _ = Describe("Service controller", func() {
 				NodePort:    portmap.Port(32100),
 				GatewayPort: portmap.Port(1100),
 				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
 			}, timeout)
 			pmmockctl.Inject(&portmap.Response{
 				Protocol:    portmap.ProtocolTCP,
@@ -268,6 +527,7 @@ var _ = Describe("Service controller", func() {
 				NodePort:    portmap.Port(32101),
 				GatewayPort: portmap.Port(1101),
 				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
 			}, timeout)
 			pmmockctl.Inject(&portmap.Response{
 				Protocol:    portmap.ProtocolTCP,
@@ -277,20 +537,153 @@ var _ = Describe("Service controller", func() {
 				Lifetime:    portmap.Lifetime(120),
 			}, timeout)
 
-			By("By checking that the ExternalIPs contains just one value")
-			Eventually(func() ([]string, error) {
+			By("By checking that the load balancer ingress contains just one value")
+			Eventually(func() ([]corev1.LoadBalancerIngress, error) {
 				err := k8sClient.Get(ctx, serviceLookupKey, createdService)
 				if err != nil {
 					return nil, err
 				}
 
-				return createdService.Spec.ExternalIPs, nil
-			}, timeout, interval).Should(ConsistOf("1.2.3.4"), "should list the mapped IP in the external IPs once")
+				return createdService.Status.LoadBalancer.Ingress, nil
+			}, timeout, interval).Should(Equal([]corev1.LoadBalancerIngress{
+				{
+					IP: "1.2.3.4",
+					Ports: []corev1.PortStatus{
+						{Port: 1100, Protocol: corev1.ProtocolTCP},
+						{Port: 1101, Protocol: corev1.ProtocolTCP},
+					},
+				},
+			}), "should list the mapped IP in the ingress once")
 
 			By("Deleting the service after the test is done")
-			autostopch := pmmockctl.Auto()
-			defer close(autostopch)
-			Expect(k8sClient.Delete(ctx, service)).Should(Succeed())
+			deleteService(service)
+		})
+	})
+
+	Context("When some of the ports fail to map", func() {
+		It("Should report the errors at the ingress ports", func() {
+			By("By creating a new Service")
+			service := &corev1.Service{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: corev1.SchemeGroupVersion.Version,
+					Kind:       "Service",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      serviceName,
+					Namespace: serviceNamespace,
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{
+							Name:     "test1",
+							Protocol: "TCP",
+							Port:     1100,
+							NodePort: 32100,
+						},
+						{
+							Name:     "test2",
+							Protocol: "TCP",
+							Port:     256,
+							NodePort: 32101,
+						},
+					},
+					Selector: map[string]string{
+						"app": "test",
+					},
+					Type: corev1.ServiceTypeLoadBalancer,
+				},
+			}
+			Expect(k8sClient.Create(ctx, service)).Should(Succeed())
+			serviceLookupKey := types.NamespacedName{Name: serviceName, Namespace: serviceNamespace}
+
+			By("By letting the test1 port map")
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1100),
+				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
+			}, timeout)
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1100),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(120),
+			}, timeout)
+
+			By("By mapping the test2 port to a different gateway port")
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32101),
+				GatewayPort: portmap.Port(256),
+				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
+			}, timeout)
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32101),
+				GatewayPort: portmap.Port(1024),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(120),
+			}, timeout)
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32101),
+				GatewayPort: portmap.Port(1024),
+				Lifetime:    portmap.LifetimeDelete,
+			}, timeout)
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32101),
+				GatewayPort: portmap.Port(1024),
+				Lifetime:    portmap.LifetimeDelete,
+			}, timeout)
+
+			By("By checking that the load balancer ingress reports the error")
+			createdService := &corev1.Service{}
+			mismatchErr := PortErrorGatewayPortMismatch
+			Eventually(func() ([]corev1.LoadBalancerIngress, error) {
+				err := k8sClient.Get(ctx, serviceLookupKey, createdService)
+				if err != nil {
+					return nil, err
+				}
+
+				return createdService.Status.LoadBalancer.Ingress, nil
+			}, timeout, interval).Should(Equal([]corev1.LoadBalancerIngress{
+				{
+					IP: "1.2.3.4",
+					Ports: []corev1.PortStatus{
+						{Port: 1100, Protocol: corev1.ProtocolTCP},
+						{Port: 256, Protocol: corev1.ProtocolTCP, Error: &mismatchErr},
+					},
+				},
+			}), "should list the failed port with an error")
+
+			By("By checking that the condition reports the error")
+			condition := meta.FindStatusCondition(createdService.Status.Conditions, ConditionPortsMapped)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal(ConditionReasonGatewayPortMismatch))
+			Expect(condition.Message).To(ContainSubstring("mapped gateway port (1024) is different from the requested port (256)"))
+
+			By("By checking that the Events are recorded")
+			Eventually(func() ([]string, error) {
+				var events corev1.EventList
+				err := k8sClient.List(ctx, &events, client.InNamespace(serviceNamespace))
+				if err != nil {
+					return nil, err
+				}
+
+				reasons := make([]string, 0, len(events.Items))
+				for _, event := range events.Items {
+					reasons = append(reasons, event.Reason)
+				}
+				return reasons, nil
+			}, timeout, interval).Should(ContainElements(EventReasonMappingSucceeded, EventReasonGatewayPortMismatch))
+
+			By("Deleting the service after the test is done")
+			deleteService(service)
 		})
 	})
 
@@ -351,6 +744,7 @@ var _ = Describe("Service controller", func() {
 				NodePort:    portmap.Port(32100),
 				GatewayPort: portmap.Port(1024),
 				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
 			}, timeout)
 			pmmockctl.Inject(&portmap.Response{
 				Protocol:    portmap.ProtocolTCP,
@@ -364,6 +758,7 @@ var _ = Describe("Service controller", func() {
 				NodePort:    portmap.Port(32101),
 				GatewayPort: portmap.Port(3000),
 				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
 			}, timeout)
 			pmmockctl.Inject(&portmap.Response{
 				Protocol:    portmap.ProtocolTCP,
@@ -373,25 +768,31 @@ var _ = Describe("Service controller", func() {
 				Lifetime:    portmap.Lifetime(120),
 			}, timeout)
 
-			By("By checking that the ExternalIPs is updated")
-			Eventually(func() ([]string, error) {
+			By("By checking that the load balancer ingress is updated")
+			Eventually(func() ([]corev1.LoadBalancerIngress, error) {
 				err := k8sClient.Get(ctx, serviceLookupKey, createdService)
 				if err != nil {
 					return nil, err
 				}
 
-				return createdService.Spec.ExternalIPs, nil
-			}, timeout, interval).Should(ConsistOf("1.2.3.4"), "should list the mapped IP in the external IPs")
+				return createdService.Status.LoadBalancer.Ingress, nil
+			}, timeout, interval).Should(Equal([]corev1.LoadBalancerIngress{
+				{
+					IP: "1.2.3.4",
+					Ports: []corev1.PortStatus{
+						{Port: 1024, Protocol: corev1.ProtocolTCP},
+						{Port: 3000, Protocol: corev1.ProtocolTCP},
+					},
+				},
+			}), "should list the mapped IP in the ingress")
 
 			By("Deleting the service after the test is done")
-			autostopch := pmmockctl.Auto()
-			defer close(autostopch)
-			Expect(k8sClient.Delete(ctx, service)).Should(Succeed())
+			deleteService(service)
 		})
 	})
 
-	Context("When encounter a Service with invalid annotations", func() {
-		It("Should skip it", func() {
+	Context("When mapping ports for a Service with v2 overrides", func() {
+		It("Should respect the overrides by the port names and ranges", func() {
 			By("By creating a new Service")
 			service := &corev1.Service{
 				TypeMeta: metav1.TypeMeta{
@@ -402,7 +803,7 @@ var _ = Describe("Service controller", func() {
 					Name:      serviceName,
 					Namespace: serviceNamespace,
 					Annotations: map[string]string{
-						annotations.OverridesV1Key: `{`,
+						annotations.OverridesV2Key: `{"test1":{"skip":true},"test3":{"port":3000},"TCP/1000-1100":{"port":2000}}`,
 					},
 				},
 				Spec: corev1.ServiceSpec{
@@ -410,9 +811,20 @@ var _ = Describe("Service controller", func() {
 						{
 							Name:     "test1",
 							Protocol: "TCP",
+							Port:     5000,
+						},
+						{
+							Name:     "test2",
+							Protocol: "TCP",
 							Port:     1024,
 							NodePort: 32100,
 						},
+						{
+							Name:     "test3",
+							Protocol: "TCP",
+							Port:     80,
+							NodePort: 32101,
+						},
 					},
 					Selector: map[string]string{
 						"app": "test",
@@ -430,13 +842,937 @@ var _ = Describe("Service controller", func() {
 			}, timeout, interval).Should(Succeed())
 			Expect(createdService.ObjectMeta.Name).Should(Equal(serviceName))
 
-			By("By waiting for any potential port map reqests on the mock")
-			pmmockctl.ExpectNothing(timeout)
-
-			By("Deleting the service after the test is done")
-			autostopch := pmmockctl.Auto()
-			defer close(autostopch)
-			Expect(k8sClient.Delete(ctx, service)).Should(Succeed())
-		})
+			By("By waiting for the mock port mapper to receive and handle the port map requests")
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(2024),
+				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
+			}, timeout)
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(2024),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(120),
+			}, timeout)
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32101),
+				GatewayPort: portmap.Port(3000),
+				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
+			}, timeout)
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32101),
+				GatewayPort: portmap.Port(3000),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(120),
+			}, timeout)
+
+			By("By checking that the load balancer ingress is updated")
+			Eventually(func() ([]corev1.LoadBalancerIngress, error) {
+				err := k8sClient.Get(ctx, serviceLookupKey, createdService)
+				if err != nil {
+					return nil, err
+				}
+
+				return createdService.Status.LoadBalancer.Ingress, nil
+			}, timeout, interval).Should(Equal([]corev1.LoadBalancerIngress{
+				{
+					IP: "1.2.3.4",
+					Ports: []corev1.PortStatus{
+						{Port: 2024, Protocol: corev1.ProtocolTCP},
+						{Port: 3000, Protocol: corev1.ProtocolTCP},
+					},
+				},
+			}), "should list the mapped IP in the ingress")
+
+			By("Deleting the service after the test is done")
+			deleteService(service)
+		})
+	})
+
+	Context("When mapping ports for a Service with lifetimes", func() {
+		It("Should request the configured lifetimes", func() {
+			By("By creating a new Service")
+			service := &corev1.Service{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: corev1.SchemeGroupVersion.Version,
+					Kind:       "Service",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      serviceName,
+					Namespace: serviceNamespace,
+					Annotations: map[string]string{
+						annotations.LifetimeKey:    "1h",
+						annotations.OverridesV1Key: `{"TCP/80":{"lifetime":"10m"}}`,
+					},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{
+							Name:     "test1",
+							Protocol: "TCP",
+							Port:     1024,
+							NodePort: 32100,
+						},
+						{
+							Name:     "test2",
+							Protocol: "TCP",
+							Port:     80,
+							NodePort: 32101,
+						},
+					},
+					Selector: map[string]string{
+						"app": "test",
+					},
+					Type: corev1.ServiceTypeLoadBalancer,
+				},
+			}
+			Expect(k8sClient.Create(ctx, service)).Should(Succeed())
+			serviceLookupKey := types.NamespacedName{Name: serviceName, Namespace: serviceNamespace}
+
+			By("By waiting for the created Service to appear at the API")
+			createdService := &corev1.Service{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, serviceLookupKey, createdService)
+			}, timeout, interval).Should(Succeed())
+			Expect(createdService.ObjectMeta.Name).Should(Equal(serviceName))
+
+			By("By waiting for the mock port mapper to receive and handle the port map requests")
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1024),
+				Lifetime:    portmap.Lifetime(3600),
+				Description: serviceNamespace + "/" + serviceName,
+			}, timeout)
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1024),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(3600),
+			}, timeout)
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32101),
+				GatewayPort: portmap.Port(80),
+				Lifetime:    portmap.Lifetime(600),
+				Description: serviceNamespace + "/" + serviceName,
+			}, timeout)
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32101),
+				GatewayPort: portmap.Port(80),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(600),
+			}, timeout)
+
+			By("By checking that the load balancer ingress is updated")
+			Eventually(func() ([]corev1.LoadBalancerIngress, error) {
+				err := k8sClient.Get(ctx, serviceLookupKey, createdService)
+				if err != nil {
+					return nil, err
+				}
+
+				return createdService.Status.LoadBalancer.Ingress, nil
+			}, timeout, interval).Should(Equal([]corev1.LoadBalancerIngress{
+				{
+					IP: "1.2.3.4",
+					Ports: []corev1.PortStatus{
+						{Port: 1024, Protocol: corev1.ProtocolTCP},
+						{Port: 80, Protocol: corev1.ProtocolTCP},
+					},
+				},
+			}), "should list the mapped IP in the ingress")
+
+			By("Deleting the service after the test is done")
+			deleteService(service)
+		})
+	})
+
+	Context("When mapping ports to a specific node", func() {
+		It("Should request the mapping to the node address", func() {
+			By("By creating a new Node")
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: fmt.Sprintf("test-node-%s", randStringRunes(5)),
+				},
+			}
+			Expect(k8sClient.Create(ctx, node)).Should(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, node)).Should(Succeed())
+			}()
+			node.Status.Addresses = []corev1.NodeAddress{
+				{Type: corev1.NodeHostName, Address: node.Name},
+				{Type: corev1.NodeInternalIP, Address: "192.168.0.10"},
+			}
+			Expect(k8sClient.Status().Update(ctx, node)).Should(Succeed())
+
+			By("By creating a new Service")
+			service := &corev1.Service{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: corev1.SchemeGroupVersion.Version,
+					Kind:       "Service",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      serviceName,
+					Namespace: serviceNamespace,
+					Annotations: map[string]string{
+						annotations.NodeKey: node.Name,
+					},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{
+							Name:     "test1",
+							Protocol: "TCP",
+							Port:     1234,
+							NodePort: 32100,
+						},
+					},
+					Selector: map[string]string{
+						"app": "test",
+					},
+					Type: corev1.ServiceTypeLoadBalancer,
+				},
+			}
+			Expect(k8sClient.Create(ctx, service)).Should(Succeed())
+
+			By("By waiting for the mock port mapper to receive the port map request")
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
+				InternalIP:  net.ParseIP("192.168.0.10"),
+			}, timeout)
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(120),
+			}, timeout)
+
+			By("Deleting the service after the test is done")
+			deleteService(service)
+		})
+	})
+
+	Context("When mapping ports for a Service with externalTrafficPolicy: Local", func() {
+		It("Should follow the endpoints", func() {
+			By("By creating the Nodes")
+			nodes := make([]*corev1.Node, 0, 2)
+			for i, ip := range []string{"192.168.0.10", "192.168.0.11"} {
+				node := &corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: fmt.Sprintf("test-node-%d-%s", i, randStringRunes(5)),
+					},
+				}
+				Expect(k8sClient.Create(ctx, node)).Should(Succeed())
+				defer func() {
+					Expect(k8sClient.Delete(ctx, node)).Should(Succeed())
+				}()
+				node.Status.Addresses = []corev1.NodeAddress{
+					{Type: corev1.NodeInternalIP, Address: ip},
+				}
+				Expect(k8sClient.Status().Update(ctx, node)).Should(Succeed())
+				nodes = append(nodes, node)
+			}
+
+			By("By creating the EndpointSlice with a ready endpoint at the first node")
+			ready, notReady := true, false
+			endpointSlice := &discoveryv1.EndpointSlice{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      serviceName + "-abcde",
+					Namespace: serviceNamespace,
+					Labels: map[string]string{
+						discoveryv1.LabelServiceName: serviceName,
+					},
+				},
+				AddressType: discoveryv1.AddressTypeIPv4,
+				Endpoints: []discoveryv1.Endpoint{
+					{
+						Addresses:  []string{"10.0.0.1"},
+						Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+						NodeName:   &nodes[0].Name,
+					},
+					{
+						Addresses:  []string{"10.0.0.2"},
+						Conditions: discoveryv1.EndpointConditions{Ready: &notReady},
+						NodeName:   &nodes[1].Name,
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, endpointSlice)).Should(Succeed())
+
+			By("By creating a new Service")
+			service := &corev1.Service{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: corev1.SchemeGroupVersion.Version,
+					Kind:       "Service",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      serviceName,
+					Namespace: serviceNamespace,
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{
+							Name:     "test1",
+							Protocol: "TCP",
+							Port:     1234,
+							NodePort: 32100,
+						},
+					},
+					Selector: map[string]string{
+						"app": "test",
+					},
+					Type:                  corev1.ServiceTypeLoadBalancer,
+					ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyTypeLocal,
+				},
+			}
+			Expect(k8sClient.Create(ctx, service)).Should(Succeed())
+
+			expectedRequest := &portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
+				InternalIP:  net.ParseIP("192.168.0.10"),
+			}
+			expectedResponse := &portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(120),
+			}
+
+			By("By waiting for the port to be mapped to the first node")
+			pmmockctl.Expect(expectedRequest, timeout)
+			pmmockctl.Inject(expectedResponse, timeout)
+
+			By("By handling the reconcile caused by the Service update")
+			pmmockctl.Expect(expectedRequest, timeout)
+			pmmockctl.Inject(expectedResponse, timeout)
+
+			By("By moving the ready endpoint to the second node")
+			endpointSlice.Endpoints[0].Conditions.Ready = &notReady
+			endpointSlice.Endpoints[1].Conditions.Ready = &ready
+			Expect(k8sClient.Update(ctx, endpointSlice)).Should(Succeed())
+
+			By("By waiting for the mapping to the first node to be deleted")
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				Lifetime:    portmap.LifetimeDelete,
+				InternalIP:  net.ParseIP("192.168.0.10"),
+			}, timeout)
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				Lifetime:    portmap.LifetimeDelete,
+			}, timeout)
+
+			By("By waiting for the port to be mapped to the second node")
+			expectedRequest.InternalIP = net.ParseIP("192.168.0.11")
+			pmmockctl.Expect(expectedRequest, timeout)
+			pmmockctl.Inject(expectedResponse, timeout)
+
+			By("By handling the reconcile caused by the Service update")
+			pmmockctl.Expect(expectedRequest, timeout)
+			pmmockctl.Inject(expectedResponse, timeout)
+
+			By("By making the first node ready again")
+			endpointSlice.Endpoints[0].Conditions.Ready = &ready
+			Expect(k8sClient.Update(ctx, endpointSlice)).Should(Succeed())
+
+			By("By waiting for the port to stay mapped to the second node")
+			pmmockctl.Expect(expectedRequest, timeout)
+			pmmockctl.Inject(expectedResponse, timeout)
+
+			By("Deleting the service after the test is done")
+			deleteService(service)
+		})
+	})
+
+	Context("When a LoadBalancer Service is deleted", func() {
+		It("Should delete the port mappings before letting it go", func() {
+			By("By creating a new Service")
+			service := &corev1.Service{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: corev1.SchemeGroupVersion.Version,
+					Kind:       "Service",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      serviceName,
+					Namespace: serviceNamespace,
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{
+							Name:     "test1",
+							Protocol: "TCP",
+							Port:     1234,
+							NodePort: 32100,
+						},
+					},
+					Selector: map[string]string{
+						"app": "test",
+					},
+					Type: corev1.ServiceTypeLoadBalancer,
+				},
+			}
+			Expect(k8sClient.Create(ctx, service)).Should(Succeed())
+			serviceLookupKey := types.NamespacedName{Name: serviceName, Namespace: serviceNamespace}
+
+			expectedRequest := &portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
+			}
+			expectedResponse := &portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(120),
+			}
+
+			By("By waiting for the port map request")
+			pmmockctl.Expect(expectedRequest, timeout)
+			pmmockctl.Inject(expectedResponse, timeout)
+
+			By("By handling the reconcile caused by the Service update")
+			pmmockctl.Expect(expectedRequest, timeout)
+			pmmockctl.Inject(expectedResponse, timeout)
+
+			By("By checking that the finalizer is added")
+			createdService := &corev1.Service{}
+			Eventually(func() ([]string, error) {
+				err := k8sClient.Get(ctx, serviceLookupKey, createdService)
+				if err != nil {
+					return nil, err
+				}
+
+				return createdService.Finalizers, nil
+			}, timeout, interval).Should(ContainElement(FinalizerName))
+
+			By("By deleting the Service")
+			Expect(k8sClient.Delete(ctx, service)).Should(Succeed())
+
+			By("By waiting for the port map deletion request")
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				Lifetime:    portmap.LifetimeDelete,
+			}, timeout)
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				Lifetime:    portmap.LifetimeDelete,
+			}, timeout)
+
+			By("By checking that the Service is gone")
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, serviceLookupKey, createdService)
+				return apierrors.IsNotFound(err)
+			}, timeout, interval).Should(BeTrue(), "should be gone")
+		})
+	})
+
+	Context("When a Service stops being a LoadBalancer", func() {
+		It("Should delete the port mappings", func() {
+			By("By creating a new Service")
+			service := &corev1.Service{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: corev1.SchemeGroupVersion.Version,
+					Kind:       "Service",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      serviceName,
+					Namespace: serviceNamespace,
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{
+							Name:     "test1",
+							Protocol: "UDP",
+							Port:     1234,
+							NodePort: 32100,
+						},
+					},
+					Selector: map[string]string{
+						"app": "test",
+					},
+					Type: corev1.ServiceTypeLoadBalancer,
+				},
+			}
+			Expect(k8sClient.Create(ctx, service)).Should(Succeed())
+			serviceLookupKey := types.NamespacedName{Name: serviceName, Namespace: serviceNamespace}
+
+			expectedRequest := &portmap.Request{
+				Protocol:    portmap.ProtocolUDP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
+			}
+			expectedResponse := &portmap.Response{
+				Protocol:    portmap.ProtocolUDP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(120),
+			}
+
+			By("By waiting for the port map request")
+			pmmockctl.Expect(expectedRequest, timeout)
+			pmmockctl.Inject(expectedResponse, timeout)
+
+			By("By handling the reconcile caused by the Service update")
+			pmmockctl.Expect(expectedRequest, timeout)
+			pmmockctl.Inject(expectedResponse, timeout)
+
+			By("By changing the Service type to ClusterIP")
+			Eventually(func() error {
+				updatedService := &corev1.Service{}
+				if err := k8sClient.Get(ctx, serviceLookupKey, updatedService); err != nil {
+					return err
+				}
+				updatedService.Spec.Type = corev1.ServiceTypeClusterIP
+				updatedService.Spec.Ports[0].NodePort = 0
+				return k8sClient.Update(ctx, updatedService)
+			}, timeout, interval).Should(Succeed())
+
+			By("By waiting for the port map deletion request")
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolUDP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				Lifetime:    portmap.LifetimeDelete,
+			}, timeout)
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolUDP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				Lifetime:    portmap.LifetimeDelete,
+			}, timeout)
+
+			By("By checking that the finalizer and the record are removed")
+			createdService := &corev1.Service{}
+			Eventually(func() (bool, error) {
+				err := k8sClient.Get(ctx, serviceLookupKey, createdService)
+				if err != nil {
+					return false, err
+				}
+
+				_, recorded := createdService.Annotations[annotations.MappedV1Key]
+				return recorded || len(createdService.Finalizers) > 0, nil
+			}, timeout, interval).Should(BeFalse())
+
+			By("Deleting the service after the test is done")
+			deleteService(service)
+		})
+	})
+
+	Context("When a port is removed from the Service", func() {
+		It("Should delete the stale port mapping", func() {
+			By("By creating a new Service")
+			service := &corev1.Service{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: corev1.SchemeGroupVersion.Version,
+					Kind:       "Service",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      serviceName,
+					Namespace: serviceNamespace,
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{
+							Name:     "test1",
+							Protocol: "TCP",
+							Port:     1100,
+							NodePort: 32100,
+						},
+						{
+							Name:     "test2",
+							Protocol: "TCP",
+							Port:     1101,
+							NodePort: 32101,
+						},
+					},
+					Selector: map[string]string{
+						"app": "test",
+					},
+					Type: corev1.ServiceTypeLoadBalancer,
+				},
+			}
+			Expect(k8sClient.Create(ctx, service)).Should(Succeed())
+			serviceLookupKey := types.NamespacedName{Name: serviceName, Namespace: serviceNamespace}
+
+			expectedRequests := []*portmap.Request{
+				{
+					Protocol:    portmap.ProtocolTCP,
+					NodePort:    portmap.Port(32100),
+					GatewayPort: portmap.Port(1100),
+					Lifetime:    portmap.Lifetime(120),
+					Description: serviceNamespace + "/" + serviceName,
+				},
+				{
+					Protocol:    portmap.ProtocolTCP,
+					NodePort:    portmap.Port(32101),
+					GatewayPort: portmap.Port(1101),
+					Lifetime:    portmap.Lifetime(120),
+					Description: serviceNamespace + "/" + serviceName,
+				},
+			}
+			expectedResponses := []*portmap.Response{
+				{
+					Protocol:    portmap.ProtocolTCP,
+					NodePort:    portmap.Port(32100),
+					GatewayPort: portmap.Port(1100),
+					GatewayIP:   net.IPv4(1, 2, 3, 4),
+					Lifetime:    portmap.Lifetime(120),
+				},
+				{
+					Protocol:    portmap.ProtocolTCP,
+					NodePort:    portmap.Port(32101),
+					GatewayPort: portmap.Port(1101),
+					GatewayIP:   net.IPv4(1, 2, 3, 4),
+					Lifetime:    portmap.Lifetime(120),
+				},
+			}
+
+			By("By waiting for the port map requests")
+			for i := range expectedRequests {
+				pmmockctl.Expect(expectedRequests[i], timeout)
+				pmmockctl.Inject(expectedResponses[i], timeout)
+			}
+
+			By("By handling the reconcile caused by the Service update")
+			for i := range expectedRequests {
+				pmmockctl.Expect(expectedRequests[i], timeout)
+				pmmockctl.Inject(expectedResponses[i], timeout)
+			}
+
+			By("By removing the second port from the Service")
+			Eventually(func() error {
+				updatedService := &corev1.Service{}
+				if err := k8sClient.Get(ctx, serviceLookupKey, updatedService); err != nil {
+					return err
+				}
+				updatedService.Spec.Ports = updatedService.Spec.Ports[:1]
+				return k8sClient.Update(ctx, updatedService)
+			}, timeout, interval).Should(Succeed())
+
+			By("By waiting for the stale port map deletion request")
+			pmmockctl.Expect(&portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32101),
+				GatewayPort: portmap.Port(1101),
+				Lifetime:    portmap.LifetimeDelete,
+			}, timeout)
+			pmmockctl.Inject(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32101),
+				GatewayPort: portmap.Port(1101),
+				Lifetime:    portmap.LifetimeDelete,
+			}, timeout)
+
+			By("By waiting for the remaining port to be mapped again")
+			pmmockctl.Expect(expectedRequests[0], timeout)
+			pmmockctl.Inject(expectedResponses[0], timeout)
+
+			By("By checking that the stale mapping is no longer recorded")
+			createdService := &corev1.Service{}
+			Eventually(func() ([]annotations.Mapping, error) {
+				err := k8sClient.Get(ctx, serviceLookupKey, createdService)
+				if err != nil {
+					return nil, err
+				}
+
+				return annotations.MappedFromService(createdService)
+			}, timeout, interval).Should(Equal([]annotations.Mapping{
+				{Protocol: corev1.ProtocolTCP, NodePort: 32100, GatewayPort: 1100},
+			}))
+
+			By("Deleting the service after the test is done")
+			deleteService(service)
+		})
+	})
+
+	Context("When the gateway restarts", func() {
+		It("Should map the ports again right away", func() {
+			By("By creating a new Service")
+			service := &corev1.Service{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: corev1.SchemeGroupVersion.Version,
+					Kind:       "Service",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      serviceName,
+					Namespace: serviceNamespace,
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{
+							Name:     "test1",
+							Protocol: "TCP",
+							Port:     1234,
+							NodePort: 32100,
+						},
+					},
+					Selector: map[string]string{
+						"app": "test",
+					},
+					Type: corev1.ServiceTypeLoadBalancer,
+				},
+			}
+			Expect(k8sClient.Create(ctx, service)).Should(Succeed())
+
+			expectedRequest := &portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				Lifetime:    portmap.Lifetime(120),
+				Description: serviceNamespace + "/" + serviceName,
+			}
+			expectedResponse := &portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1234),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(120),
+			}
+
+			By("By waiting for the initial port map request")
+			pmmockctl.Expect(expectedRequest, timeout)
+			pmmockctl.Inject(expectedResponse, timeout)
+
+			By("By handling the reconcile caused by the Service update")
+			pmmockctl.Expect(expectedRequest, timeout)
+			pmmockctl.Inject(expectedResponse, timeout)
+			pmmockctl.ExpectNothing(time.Second)
+
+			By("By signaling the gateway restart")
+			gatewayRestarts <- struct{}{}
+
+			By("By waiting for the port map request to be repeated")
+			pmmockctl.Expect(expectedRequest, timeout)
+			pmmockctl.Inject(expectedResponse, timeout)
+
+			By("Deleting the service after the test is done")
+			deleteService(service)
+		})
+	})
+
+	Context("When encounter a Service with invalid annotations", func() {
+		It("Should skip it", func() {
+			By("By creating a new Service")
+			service := &corev1.Service{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: corev1.SchemeGroupVersion.Version,
+					Kind:       "Service",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      serviceName,
+					Namespace: serviceNamespace,
+					Annotations: map[string]string{
+						annotations.OverridesV1Key: `{`,
+					},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{
+							Name:     "test1",
+							Protocol: "TCP",
+							Port:     1024,
+							NodePort: 32100,
+						},
+					},
+					Selector: map[string]string{
+						"app": "test",
+					},
+					Type: corev1.ServiceTypeLoadBalancer,
+				},
+			}
+			Expect(k8sClient.Create(ctx, service)).Should(Succeed())
+			serviceLookupKey := types.NamespacedName{Name: serviceName, Namespace: serviceNamespace}
+
+			By("By waiting for the created Service to appear at the API")
+			createdService := &corev1.Service{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, serviceLookupKey, createdService)
+			}, timeout, interval).Should(Succeed())
+			Expect(createdService.ObjectMeta.Name).Should(Equal(serviceName))
+
+			By("By waiting for any potential port map reqests on the mock")
+			pmmockctl.ExpectNothing(timeout)
+
+			By("Deleting the service after the test is done")
+			deleteService(service)
+		})
+	})
+})
+
+var _ = Describe("Service ingress", func() {
+	It("Should report the failed ports at the IPs they were mapped at before", func() {
+		previous := []corev1.LoadBalancerIngress{
+			{IP: "1.1.1.1", Ports: []corev1.PortStatus{{Port: 80, Protocol: corev1.ProtocolTCP}}},
+		}
+		mapped := []annotations.Mapping{{Protocol: corev1.ProtocolTCP, NodePort: 30000, GatewayPort: 80}}
+		pmerrlist := []error{&PortMapError{
+			Request: &portmap.Request{Protocol: portmap.ProtocolTCP, NodePort: 30000, GatewayPort: 80},
+			Err:     context.DeadlineExceeded,
+		}}
+
+		ingress := makeIngress(previous, mapped, nil, pmerrlist)
+		Expect(ingress).To(HaveLen(1))
+		Expect(ingress[0].IP).To(Equal("1.1.1.1"))
+		Expect(ingress[0].Ports).To(HaveLen(1))
+		Expect(ingress[0].Ports[0].Error).NotTo(BeNil())
+
+		By("forgetting the IPs of the ports no longer mapped")
+		Expect(makeIngress(previous, nil, nil, pmerrlist)).To(BeEmpty())
+	})
+})
+
+// Maps every port at the gateway port it picks, as configured by a Gateway.
+type pickingMapper struct {
+	config   gatewayset.Config
+	picked   portmap.Port
+	requests []portmap.Request
+	unmapped []portmap.Request
+}
+
+func (m *pickingMapper) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
+	m.requests = append(m.requests, *req)
+	return &portmap.Response{
+		Protocol:    req.Protocol,
+		NodePort:    req.NodePort,
+		GatewayPort: m.picked,
+		GatewayIP:   net.IPv4(1, 2, 3, 4),
+		Lifetime:    req.Lifetime,
+	}, nil
+}
+
+func (m *pickingMapper) Unmap(ctx context.Context, req *portmap.Request) error {
+	m.unmapped = append(m.unmapped, *req)
+	return nil
+}
+
+func (m *pickingMapper) ListMappings(ctx context.Context) ([]portmap.Mapping, error) {
+	return nil, portmap.ErrUnsupported
+}
+
+func (m *pickingMapper) ExternalAddress(ctx context.Context) (net.IP, error) {
+	return nil, portmap.ErrUnsupported
+}
+
+func (m *pickingMapper) Capabilities() portmap.Capabilities {
+	return portmap.Capabilities{PortAny: true}
+}
+
+func (m *pickingMapper) GatewayConfig(name string) (gatewayset.Config, bool) {
+	return m.config, true
+}
+
+var _ = Describe("Gateway allowed ports", func() {
+	var (
+		mapper     *pickingMapper
+		reconciler *ServiceReconciler
+		pmreq      *portRequest
+	)
+
+	BeforeEach(func() {
+		mapper = &pickingMapper{
+			config: gatewayset.Config{AllowedPorts: []gatewayset.PortRange{{From: 8000, To: 8999}}},
+			picked: portmap.Port(8080),
+		}
+		reconciler = &ServiceReconciler{PortMap: mapper}
+		pmreq = &portRequest{
+			Request: &portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(30000),
+				GatewayPort: portmap.PortAny,
+				Lifetime:    portmap.Lifetime(120),
+			},
+			Flexible: true,
+		}
+	})
+
+	It("Should keep the allowed ports the gateway picks", func() {
+		pmres, err := reconciler.mapPort(context.Background(), logr.Discard(), pmreq)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(pmres.GatewayPort).To(Equal(portmap.Port(8080)))
+		Expect(mapper.unmapped).To(BeEmpty())
+	})
+
+	It("Should delete the mappings at the ports the Gateway doesn't allow", func() {
+		mapper.picked = portmap.Port(1024)
+
+		_, err := reconciler.mapPort(context.Background(), logr.Discard(), pmreq)
+		Expect(err).To(MatchError(ErrGatewayPortNotAllowed))
+		Expect(mapper.unmapped).To(HaveLen(1))
+		Expect(mapper.unmapped[0].GatewayPort).To(Equal(portmap.Port(1024)))
+	})
+})
+
+var _ = Describe("Service selection", func() {
+	var (
+		reconciler *ServiceReconciler
+		service    *corev1.Service
+	)
+
+	BeforeEach(func() {
+		reconciler = &ServiceReconciler{LoadBalancerClass: loadBalancerClass}
+		service = &corev1.Service{
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+			},
+		}
+	})
+
+	It("Should handle the Services of the configured class", func() {
+		class := loadBalancerClass
+		service.Spec.LoadBalancerClass = &class
+		Expect(reconciler.manages(service)).To(BeTrue())
+	})
+
+	It("Should skip the Services of other classes", func() {
+		class := "metallb.universe.tf/metallb"
+		service.Spec.LoadBalancerClass = &class
+		Expect(reconciler.manages(service)).To(BeFalse())
+	})
+
+	It("Should skip the class-less Services by default", func() {
+		Expect(reconciler.manages(service)).To(BeFalse())
+	})
+
+	It("Should handle the class-less Services when asked to", func() {
+		reconciler.HandleClasslessServices = true
+		Expect(reconciler.manages(service)).To(BeTrue())
+	})
+
+	It("Should skip the Services of other types", func() {
+		reconciler.HandleClasslessServices = true
+		service.Spec.Type = corev1.ServiceTypeNodePort
+		Expect(reconciler.manages(service)).To(BeFalse())
 	})
 })
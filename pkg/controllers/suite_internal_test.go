@@ -6,7 +6,12 @@ import (
 	"testing"
 	"time"
 
+	portmapv1alpha1 "github.com/MOZGIII/port-map-operator/api/v1alpha1"
+	"github.com/MOZGIII/port-map-operator/pkg/gatewayset"
+	"github.com/MOZGIII/port-map-operator/pkg/lease"
 	"github.com/MOZGIII/port-map-operator/pkg/pmmock"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	"github.com/MOZGIII/port-map-operator/pkg/portregistry"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
@@ -27,8 +32,14 @@ var k8sManager ctrl.Manager
 var testEnv *envtest.Environment
 var portMapper *pmmock.MockMapper
 var pmmockctl *pmmock.Control
+var gatewayRestarts chan struct{}
+var portRegistry *portregistry.ConfigMap
+var gatewaySet *gatewayset.Set
 
-const defaultLifetime = 120
+const (
+	defaultLifetime   = 120
+	loadBalancerClass = "port-map.mzg.io/port-map-operator"
+)
 
 func TestAPIs(t *testing.T) {
 	RegisterFailHandler(Fail)
@@ -43,7 +54,7 @@ var _ = BeforeSuite(func(done Done) {
 
 	By("bootstrapping test environment")
 	testEnv = &envtest.Environment{
-		CRDDirectoryPaths:     []string{filepath.Join("..", "config", "crd", "bases")},
+		CRDDirectoryPaths:     []string{filepath.Join("..", "..", "config", "crd", "bases")},
 		ErrorIfCRDPathMissing: false,
 	}
 
@@ -55,9 +66,14 @@ var _ = BeforeSuite(func(done Done) {
 	err = corev1.AddToScheme(scheme.Scheme)
 	Expect(err).NotTo(HaveOccurred())
 
+	err = portmapv1alpha1.AddToScheme(scheme.Scheme)
+	Expect(err).NotTo(HaveOccurred())
+
 	//+kubebuilder:scaffold:scheme
 
 	portMapper, pmmockctl = pmmock.New()
+	gatewayRestarts = make(chan struct{}, 1)
+	gatewaySet = gatewayset.New(ctrl.Log.WithName("gateways"))
 
 	k8sManager, err = ctrl.NewManager(cfg, ctrl.Options{Scheme: scheme.Scheme})
 	Expect(err).ToNot(HaveOccurred())
@@ -66,13 +82,43 @@ var _ = BeforeSuite(func(done Done) {
 	k8sClient = k8sManager.GetClient()
 	Expect(k8sClient).ToNot(BeNil())
 
+	leases := lease.NewManager(portMapper)
+	err = k8sManager.Add(leases)
+	Expect(err).ToNot(HaveOccurred())
+
+	portRegistry = &portregistry.ConfigMap{
+		Reader:    k8sClient,
+		Writer:    k8sClient,
+		Namespace: "default",
+		Name:      "port-map-operator-port-registry",
+	}
+
 	err = (&ServiceReconciler{
+		Client:   k8sClient,
+		Log:      ctrl.Log.WithName("controllers").WithName("Service"),
+		Scheme:   k8sManager.GetScheme(),
+		Recorder: k8sManager.GetEventRecorderFor("port-map-operator"),
+
+		PortMap:         portmap.Adapt(portMapper, portmap.Capabilities{}),
+		DefaultLifetime: defaultLifetime,
+		GatewayRestarts: gatewayRestarts,
+		Leases:          leases,
+		Ports:           portRegistry,
+
+		LoadBalancerClass:       loadBalancerClass,
+		HandleClasslessServices: true,
+	}).SetupWithManager(k8sManager)
+	Expect(err).ToNot(HaveOccurred())
+
+	err = k8sManager.Add(gatewaySet)
+	Expect(err).ToNot(HaveOccurred())
+	err = (&GatewayReconciler{
 		Client: k8sClient,
-		Log:    ctrl.Log.WithName("controllers").WithName("Service"),
+		Log:    ctrl.Log.WithName("controllers").WithName("Gateway"),
 		Scheme: k8sManager.GetScheme(),
 
-		PortMap:         portMapper,
-		DefaultLifetime: defaultLifetime,
+		Gateways: gatewaySet,
+		Build:    buildFakeGatewayMapper,
 	}).SetupWithManager(k8sManager)
 	Expect(err).ToNot(HaveOccurred())
 
@@ -0,0 +1,323 @@
+// Package fallback maps the ports with the first of several backends that
+// works with the gateway, for when it's not known which protocols the gateway
+// speaks.
+//
+// The backends are probed in order, and the first one that responds is used
+// until it fails in a way that means the gateway doesn't speak its protocol.
+// The preceding backends are probed again periodically, so that the preferred
+// one is used again once the gateway supports it.
+package fallback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/natpmp"
+	"github.com/MOZGIII/port-map-operator/pkg/pcp"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	"github.com/MOZGIII/port-map-operator/pkg/upnp"
+	"github.com/go-logr/logr"
+)
+
+var (
+	ErrNoBackends = errors.New("none of the backends works with the gateway")
+	ErrNotProber  = errors.New("the backend can't be probed")
+)
+
+const (
+	// DefaultReprobeInterval is how often the backends are probed again.
+	DefaultReprobeInterval = 10 * time.Minute
+
+	// How long to wait for a backend to respond to a probe.
+	probeTimeout = 5 * time.Second
+)
+
+// Backend is one of the mappers to choose from.
+type Backend struct {
+	// The name to report the backend with, in the logs and the metrics.
+	Name string
+
+	Mapper portmap.Mapper
+
+	// Runs the background work of the mapper until stopch is closed,
+	// nil if there is none.
+	Run func(stopch <-chan struct{}) error
+}
+
+// Mapper maps the ports with the active backend, falling back to the next
+// ones if the gateway doesn't support it.
+type Mapper struct {
+	Log logr.Logger
+
+	// How often to probe the backends again. Zero means
+	// `DefaultReprobeInterval`.
+	ReprobeInterval time.Duration
+
+	backends []Backend
+
+	mu sync.Mutex
+	// The index of the active backend, -1 until one is chosen.
+	active int
+
+	// Signaled when the active backend changes, or loses its mappings.
+	restarts chan struct{}
+}
+
+var (
+	_ portmap.Mapper          = (*Mapper)(nil)
+	_ portmap.RestartNotifier = (*Mapper)(nil)
+	_ portmap.Prober          = (*Mapper)(nil)
+)
+
+// New returns the mapper choosing from the backends, in the order of
+// preference.
+func New(log logr.Logger, backends ...Backend) *Mapper {
+	for _, backend := range backends {
+		backendActive.WithLabelValues(backend.Name).Set(0)
+	}
+	return &Mapper{
+		Log:      log,
+		backends: backends,
+		active:   -1,
+		restarts: make(chan struct{}, 1),
+	}
+}
+
+// Map maps the port with the active backend, choosing one first if needed.
+// If the gateway doesn't support the backend, the request is retried with
+// the next ones, and the first one that succeeds becomes active.
+func (m *Mapper) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
+	first := m.activeIndex()
+	if first < 0 {
+		first = m.choose(ctx)
+	}
+
+	var lastErr error
+	for i := first; i < len(m.backends); i++ {
+		res, err := m.backends[i].Mapper.Map(ctx, req)
+		if err == nil {
+			m.activate(i)
+			return res, nil
+		}
+		if !IsUnsupported(err) {
+			return nil, err
+		}
+		m.Log.V(1).Info("the gateway doesn't support the backend", "backend", m.backends[i].Name, "error", err.Error())
+		lastErr = err
+	}
+	return nil, fmt.Errorf("%w: %v", ErrNoBackends, lastErr)
+}
+
+// Unmap deletes the mapping with the active backend, which has made it,
+// unless the backend has changed since.
+func (m *Mapper) Unmap(ctx context.Context, req *portmap.Request) error {
+	return m.backend(ctx).Unmap(ctx, req)
+}
+
+// ListMappings lists the mappings with the active backend.
+func (m *Mapper) ListMappings(ctx context.Context) ([]portmap.Mapping, error) {
+	return m.backend(ctx).ListMappings(ctx)
+}
+
+// ExternalAddress requests the external address with the active backend.
+func (m *Mapper) ExternalAddress(ctx context.Context) (net.IP, error) {
+	return m.backend(ctx).ExternalAddress(ctx)
+}
+
+// Capabilities of the active backend, none until one is chosen.
+func (m *Mapper) Capabilities() portmap.Capabilities {
+	if i := m.activeIndex(); i >= 0 {
+		return m.backends[i].Mapper.Capabilities()
+	}
+	return portmap.Capabilities{}
+}
+
+// Probe probes the active backend, if it can be probed.
+func (m *Mapper) Probe(ctx context.Context) (*portmap.GatewayInfo, error) {
+	backend := m.backend(ctx)
+	prober, ok := backend.(portmap.Prober)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotProber, m.Active())
+	}
+	return prober.Probe(ctx)
+}
+
+// Restarts reports the active backend changing, since the new one doesn't
+// have the mappings of the previous one, and the active backend detecting
+// the gateway restarts.
+func (m *Mapper) Restarts() <-chan struct{} {
+	return m.restarts
+}
+
+// Active returns the name of the active backend, empty until one is chosen.
+func (m *Mapper) Active() string {
+	if i := m.activeIndex(); i >= 0 {
+		return m.backends[i].Name
+	}
+	return ""
+}
+
+// Run runs the backends, and probes them periodically until stopch is closed.
+func (m *Mapper) Run(stopch <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := range m.backends {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.runBackend(ctx, i, stopch)
+		}()
+	}
+	defer wg.Wait()
+
+	interval := m.ReprobeInterval
+	if interval == 0 {
+		interval = DefaultReprobeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	m.choose(ctx)
+	for {
+		select {
+		case <-stopch:
+			return nil
+		case <-ticker.C:
+			m.choose(ctx)
+		}
+	}
+}
+
+func (m *Mapper) runBackend(ctx context.Context, i int, stopch <-chan struct{}) {
+	backend := &m.backends[i]
+
+	if notifier, ok := backend.Mapper.(portmap.RestartNotifier); ok {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-notifier.Restarts():
+					// The restarts of the inactive backends don't matter.
+					if m.activeIndex() == i {
+						m.signalRestart()
+					}
+				}
+			}
+		}()
+	}
+
+	if backend.Run == nil {
+		return
+	}
+	if err := backend.Run(stopch); err != nil {
+		m.Log.Error(err, "port mapper failed", "backend", backend.Name)
+	}
+}
+
+// Probes the backends in order, and activates the first one that responds.
+// The backends that can't be probed are assumed to work. Returns the active
+// backend, which stays the same if none of them responds.
+func (m *Mapper) choose(ctx context.Context) int {
+	for i := range m.backends {
+		if err := m.probe(ctx, i); err != nil {
+			m.Log.V(1).Info("backend probe failed", "backend", m.backends[i].Name, "error", err.Error())
+			continue
+		}
+		m.activate(i)
+		return i
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active < 0 {
+		m.Log.Info("none of the backends responds, trying them in order")
+		return 0
+	}
+	return m.active
+}
+
+// The active backend, choosing one first if needed.
+func (m *Mapper) backend(ctx context.Context) portmap.Mapper {
+	i := m.activeIndex()
+	if i < 0 {
+		i = m.choose(ctx)
+	}
+	return m.backends[i].Mapper
+}
+
+func (m *Mapper) probe(ctx context.Context, i int) error {
+	prober, ok := m.backends[i].Mapper.(portmap.Prober)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	_, err := prober.Probe(ctx)
+	return err
+}
+
+func (m *Mapper) activeIndex() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active
+}
+
+// Makes the backend active, reporting the change as a restart.
+func (m *Mapper) activate(i int) {
+	m.mu.Lock()
+	prev := m.active
+	m.active = i
+	m.mu.Unlock()
+
+	if prev == i {
+		return
+	}
+
+	backendActive.WithLabelValues(m.backends[i].Name).Set(1)
+	if prev < 0 {
+		m.Log.Info("using the backend", "backend", m.backends[i].Name)
+		return
+	}
+	backendActive.WithLabelValues(m.backends[prev].Name).Set(0)
+	backendSwitches.Inc()
+	m.Log.Info("switched the backend", "backend", m.backends[i].Name, "previous", m.backends[prev].Name)
+	m.signalRestart()
+}
+
+func (m *Mapper) signalRestart() {
+	select {
+	case m.restarts <- struct{}{}:
+	default:
+		// Already signaled.
+	}
+}
+
+// IsUnsupported tells whether the error means that the gateway doesn't
+// support the protocol of the backend at all, rather than the request.
+func IsUnsupported(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	var pcpErr *pcp.ResultError
+	if errors.As(err, &pcpErr) && pcpErr.Code == pcp.ResultUnsuppVersion {
+		return true
+	}
+	var natpmpErr *natpmp.ResultError
+	if errors.As(err, &natpmpErr) && natpmpErr.Code == natpmp.ResultUnsupportedVersion {
+		return true
+	}
+	// The conflicts are about the port asked for, the other backends
+	// wouldn't do better.
+	var soapErr *upnp.SOAPError
+	return errors.As(err, &soapErr) && soapErr.Code != upnp.ErrorCodeConflictInMappingEntry
+}
@@ -0,0 +1,201 @@
+package fallback
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/natpmp"
+	"github.com/MOZGIII/port-map-operator/pkg/pcp"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	"github.com/MOZGIII/port-map-operator/pkg/upnp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// Fails the requests and the probes with the error set, if any.
+type fakeMapper struct {
+	ip net.IP
+
+	mu       sync.Mutex
+	err      error
+	requests int
+}
+
+func (m *fakeMapper) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
+
+func (m *fakeMapper) requestCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requests
+}
+
+func (m *fakeMapper) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests++
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &portmap.Response{
+		Protocol:    req.Protocol,
+		NodePort:    req.NodePort,
+		GatewayPort: req.GatewayPort,
+		GatewayIP:   m.ip,
+		Lifetime:    req.Lifetime,
+	}, nil
+}
+
+func (m *fakeMapper) Unmap(ctx context.Context, req *portmap.Request) error {
+	delreq := *req
+	delreq.Lifetime = portmap.LifetimeDelete
+	_, err := m.Map(ctx, &delreq)
+	return err
+}
+
+func (m *fakeMapper) ListMappings(ctx context.Context) ([]portmap.Mapping, error) {
+	return nil, portmap.ErrUnsupported
+}
+
+func (m *fakeMapper) ExternalAddress(ctx context.Context) (net.IP, error) {
+	return m.ip, nil
+}
+
+func (m *fakeMapper) Capabilities() portmap.Capabilities {
+	return portmap.Capabilities{ExternalAddress: true}
+}
+
+func (m *fakeMapper) Probe(ctx context.Context) (*portmap.GatewayInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &portmap.GatewayInfo{ExternalIP: m.ip}, nil
+}
+
+var errRefused = fmt.Errorf("read udp: %w", syscall.ECONNREFUSED)
+
+var _ = Describe("Mapper", func() {
+	var (
+		first, second *fakeMapper
+		mapper        *Mapper
+		req           *portmap.Request
+	)
+
+	BeforeEach(func() {
+		first = &fakeMapper{ip: net.IPv4(1, 1, 1, 1)}
+		second = &fakeMapper{ip: net.IPv4(2, 2, 2, 2)}
+		mapper = New(ctrl.Log,
+			Backend{Name: "first", Mapper: first},
+			Backend{Name: "second", Mapper: second},
+		)
+		req = &portmap.Request{
+			Protocol:    portmap.ProtocolTCP,
+			NodePort:    32100,
+			GatewayPort: 80,
+			Lifetime:    120,
+		}
+	})
+
+	It("Should use the first backend that responds", func() {
+		first.fail(errRefused)
+
+		res, err := mapper.Map(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.GatewayIP).To(Equal(second.ip))
+		Expect(mapper.Active()).To(Equal("second"))
+	})
+
+	It("Should fall back when the gateway doesn't support the backend", func() {
+		_, err := mapper.Map(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mapper.Active()).To(Equal("first"))
+
+		first.fail(&pcp.ResultError{Code: pcp.ResultUnsuppVersion})
+		res, err := mapper.Map(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.GatewayIP).To(Equal(second.ip))
+		Expect(mapper.Active()).To(Equal("second"))
+		Expect(mapper.Restarts()).To(Receive())
+	})
+
+	It("Should not fall back on the errors about the request", func() {
+		_, err := mapper.Map(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+
+		first.fail(&pcp.ResultError{Code: pcp.ResultNotAuthorized})
+		_, err = mapper.Map(context.Background(), req)
+		Expect(err).To(HaveOccurred())
+		Expect(mapper.Active()).To(Equal("first"))
+		Expect(second.requestCount()).To(BeZero())
+	})
+
+	It("Should fail when none of the backends works", func() {
+		first.fail(errRefused)
+		second.fail(&upnp.SOAPError{Code: 401, Description: "Invalid Action"})
+
+		_, err := mapper.Map(context.Background(), req)
+		Expect(err).To(MatchError(ErrNoBackends))
+	})
+
+	It("Should switch back to the preferred backend once it responds", func() {
+		first.fail(errRefused)
+		_, err := mapper.Map(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mapper.Active()).To(Equal("second"))
+
+		first.fail(nil)
+		mapper.ReprobeInterval = 10 * time.Millisecond
+		stopch := make(chan struct{})
+		donech := make(chan struct{})
+		go func() {
+			defer close(donech)
+			Expect(mapper.Run(stopch)).To(Succeed())
+		}()
+		defer func() {
+			close(stopch)
+			<-donech
+		}()
+
+		Eventually(mapper.Active).Should(Equal("first"))
+		Expect(mapper.Restarts()).To(Receive())
+	})
+
+	It("Should probe the active backend", func() {
+		first.fail(errRefused)
+
+		info, err := mapper.Probe(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.ExternalIP).To(Equal(second.ip))
+	})
+})
+
+var _ = Describe("IsUnsupported", func() {
+	for _, c := range []struct {
+		name        string
+		err         error
+		unsupported bool
+	}{
+		{"connection refused", errRefused, true},
+		{"PCP UNSUPP_VERSION", pcp.ErrUnsupportedServer, true},
+		{"NAT-PMP UNSUPPORTED_VERSION", natpmp.ErrUnsupportedServer, true},
+		{"UPnP errors", &upnp.SOAPError{Code: 606, Description: "Action not authorized"}, true},
+		{"UPnP conflicts", &upnp.SOAPError{Code: upnp.ErrorCodeConflictInMappingEntry}, false},
+		{"PCP NO_RESOURCES", &pcp.ResultError{Code: pcp.ResultNoResources}, false},
+		{"timeouts", context.DeadlineExceeded, false},
+	} {
+		c := c
+		It(fmt.Sprintf("Should tell %s", c.name), func() {
+			Expect(IsUnsupported(c.err)).To(Equal(c.unsupported))
+		})
+	}
+})
@@ -0,0 +1,22 @@
+package fallback
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	backendActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "port_map_backend_active",
+		Help: "Whether the port mapping backend is the one in use, 1 for the active backend and 0 for the others.",
+	}, []string{"backend"})
+
+	backendSwitches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "port_map_backend_switches_total",
+		Help: "The number of times the port mapping backend in use has changed.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(backendActive, backendSwitches)
+}
@@ -0,0 +1,89 @@
+// Discovers the default gateway of the host, which is where the port mapping
+// servers (PCP, NAT-PMP) usually live.
+
+package gateway
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoDefaultRoute = errors.New("no default route found")
+	ErrInvalidRoute   = errors.New("invalid route table entry")
+)
+
+const procNetRoute = "/proc/net/route"
+
+// See `include/uapi/linux/route.h`.
+const rtfGateway = 0x2
+
+// Discover returns the IPv4 address of the default gateway as seen in
+// the kernel routing table.
+func Discover() (net.IP, error) {
+	f, err := os.Open(procNetRoute)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseRoutes(f)
+}
+
+func parseRoutes(r io.Reader) (net.IP, error) {
+	scanner := bufio.NewScanner(r)
+
+	// Skip the header.
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNoDefaultRoute
+	}
+
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 { // nolint: gomnd
+			return nil, ErrInvalidRoute
+		}
+
+		if fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(fields[3], 16, 16)
+		if err != nil {
+			return nil, err
+		}
+		if flags&rtfGateway == 0 {
+			continue
+		}
+
+		gw, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		if len(gw) != net.IPv4len {
+			return nil, ErrInvalidRoute
+		}
+
+		// The kernel prints the address in the host byte order, which is
+		// little-endian on all the platforms we care about.
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(gw))
+		return ip.To16(), nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrNoDefaultRoute
+}
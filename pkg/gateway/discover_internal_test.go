@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"net"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// nolint: lll
+const sampleRoutes = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+eth0	00000000	0100A8C0	0003	0	0	100	00000000	0	0	0
+`
+
+// nolint: lll
+const sampleRoutesNoDefault = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+`
+
+var _ = Describe("parseRoutes", func() {
+	var (
+		sample string
+		ip     net.IP
+		err    error
+	)
+
+	JustBeforeEach(func() {
+		ip, err = parseRoutes(strings.NewReader(sample))
+	})
+
+	Context("with a default route", func() {
+		BeforeEach(func() {
+			sample = sampleRoutes
+		})
+
+		It("should return the gateway address", func() {
+			Expect(err).To(BeNil())
+			Expect(ip).To(Equal(net.IPv4(192, 168, 0, 1)))
+		})
+	})
+
+	Context("without a default route", func() {
+		BeforeEach(func() {
+			sample = sampleRoutesNoDefault
+		})
+
+		It("should produce an expected error", func() {
+			Expect(err).To(MatchError(ErrNoDefaultRoute))
+			Expect(ip).To(BeNil())
+		})
+	})
+
+	Context("with empty input", func() {
+		BeforeEach(func() {
+			sample = ``
+		})
+
+		It("should produce an expected error", func() {
+			Expect(err).To(MatchError(ErrNoDefaultRoute))
+			Expect(ip).To(BeNil())
+		})
+	})
+})
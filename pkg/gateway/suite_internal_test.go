@@ -0,0 +1,13 @@
+package gateway
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestInternalSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Gateway Internal Suite")
+}
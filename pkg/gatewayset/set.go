@@ -0,0 +1,291 @@
+// Package gatewayset keeps the mappers built from the Gateway resources,
+// so that they can be replaced while the operator runs.
+package gatewayset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	"github.com/go-logr/logr"
+)
+
+var (
+	ErrGatewayNotReady = errors.New("the gateway is not ready")
+)
+
+// RunFunc runs the background work of a mapper until stopch is closed.
+type RunFunc func(stopch <-chan struct{}) error
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From portmap.Port
+	To   portmap.Port
+}
+
+// Config is what the gateway is configured with besides its mapper.
+type Config struct {
+	// Zero if the gateway doesn't have a default of its own.
+	DefaultLifetime portmap.Lifetime
+
+	// The gateway ports that can be asked for. Empty means any.
+	AllowedPorts []PortRange
+}
+
+// Allows tells whether the gateway port can be asked for.
+func (c *Config) Allows(port portmap.Port) bool {
+	if len(c.AllowedPorts) == 0 || port == portmap.PortAny {
+		return true
+	}
+	for _, r := range c.AllowedPorts {
+		if r.From <= port && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// Set is the mappers of the gateways by their names.
+type Set struct {
+	Log logr.Logger
+
+	mu       sync.Mutex
+	gateways map[string]*gateway
+
+	// Signaled when any of the gateways restarts.
+	restarts chan struct{}
+}
+
+type gateway struct {
+	mapper     portmap.Mapper
+	config     Config
+	generation int64
+
+	stopch chan struct{}
+	donech chan struct{}
+}
+
+func New(log logr.Logger) *Set {
+	return &Set{
+		Log:      log,
+		gateways: make(map[string]*gateway),
+		restarts: make(chan struct{}, 1),
+	}
+}
+
+// Put runs the mapper of the gateway, and stops the one it replaces.
+// The generation is the one of the Gateway the mapper is built from.
+// The replacement is reported as a restart, since the new gateway might
+// not have the mappings of the previous one.
+func (s *Set) Put(name string, generation int64, mapper portmap.Mapper, run RunFunc, config Config) {
+	gw := &gateway{
+		mapper:     mapper,
+		config:     config,
+		generation: generation,
+		stopch:     make(chan struct{}),
+		donech:     make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	prev := s.gateways[name]
+	s.gateways[name] = gw
+	s.mu.Unlock()
+
+	s.stop(prev)
+	go s.run(name, gw, run)
+	s.signalRestart()
+}
+
+// Remove stops the mapper of the gateway.
+func (s *Set) Remove(name string) {
+	s.mu.Lock()
+	prev := s.gateways[name]
+	delete(s.gateways, name)
+	s.mu.Unlock()
+
+	s.stop(prev)
+}
+
+// Generation returns the generation of the Gateway the current mapper
+// is built from.
+func (s *Set) Generation(name string) (int64, bool) {
+	gw := s.get(name)
+	if gw == nil {
+		return 0, false
+	}
+	return gw.generation, true
+}
+
+// Get returns the current mapper of the gateway, as it is.
+func (s *Set) Get(name string) (portmap.Mapper, bool) {
+	gw := s.get(name)
+	if gw == nil {
+		return nil, false
+	}
+	return gw.mapper, true
+}
+
+// Mapper returns the mapper that maps the ports at whatever mappers
+// the named gateways have at the moment. The first gateway is the default.
+func (s *Set) Mapper(names ...string) *Mapper {
+	return &Mapper{set: s, names: names}
+}
+
+// Start waits for the context to be done, and then stops all the mappers.
+// It implements `manager.Runnable`.
+func (s *Set) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	s.mu.Lock()
+	gateways := s.gateways
+	s.gateways = make(map[string]*gateway)
+	s.mu.Unlock()
+
+	for _, gw := range gateways {
+		s.stop(gw)
+	}
+	return nil
+}
+
+func (s *Set) get(name string) *gateway {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gateways[name]
+}
+
+func (s *Set) run(name string, gw *gateway, run RunFunc) {
+	defer close(gw.donech)
+
+	if notifier, ok := gw.mapper.(portmap.RestartNotifier); ok {
+		go func() {
+			for {
+				select {
+				case <-gw.stopch:
+					return
+				case <-notifier.Restarts():
+					s.signalRestart()
+				}
+			}
+		}()
+	}
+
+	if err := run(gw.stopch); err != nil {
+		s.Log.Error(err, "port mapper failed", "gateway", name)
+	}
+}
+
+func (s *Set) stop(gw *gateway) {
+	if gw == nil {
+		return
+	}
+	close(gw.stopch)
+	<-gw.donech
+}
+
+func (s *Set) signalRestart() {
+	select {
+	case s.restarts <- struct{}{}:
+	default:
+		// Already signaled.
+	}
+}
+
+// Mapper maps the ports at the gateway named in the request.
+type Mapper struct {
+	set   *Set
+	names []string
+}
+
+var (
+	_ portmap.Mapper          = (*Mapper)(nil)
+	_ portmap.RestartNotifier = (*Mapper)(nil)
+)
+
+func (m *Mapper) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
+	gw, err := m.gateway(req.Gateway)
+	if err != nil {
+		return nil, err
+	}
+	res, err := gw.mapper.Map(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	res.Gateway = req.Gateway
+	return res, nil
+}
+
+func (m *Mapper) Unmap(ctx context.Context, req *portmap.Request) error {
+	gw, err := m.gateway(req.Gateway)
+	if err != nil {
+		return err
+	}
+	return gw.mapper.Unmap(ctx, req)
+}
+
+// ListMappings lists the mappings of the default gateway.
+func (m *Mapper) ListMappings(ctx context.Context) ([]portmap.Mapping, error) {
+	gw, err := m.gateway("")
+	if err != nil {
+		return nil, err
+	}
+	return gw.mapper.ListMappings(ctx)
+}
+
+// ExternalAddress returns the external address of the default gateway.
+func (m *Mapper) ExternalAddress(ctx context.Context) (net.IP, error) {
+	gw, err := m.gateway("")
+	if err != nil {
+		return nil, err
+	}
+	return gw.mapper.ExternalAddress(ctx)
+}
+
+// Capabilities of the default gateway, none if it's not ready.
+func (m *Mapper) Capabilities() portmap.Capabilities {
+	gw, err := m.gateway("")
+	if err != nil {
+		return portmap.Capabilities{}
+	}
+	return gw.mapper.Capabilities()
+}
+
+// Gateways returns the names of the gateways the ports can be mapped at.
+func (m *Mapper) Gateways() []string {
+	return m.names
+}
+
+// Restarts reports any of the gateways losing its mappings, and
+// the gateway mappers being replaced.
+func (m *Mapper) Restarts() <-chan struct{} {
+	return m.set.restarts
+}
+
+// GatewayConfig returns the configuration of the gateway, and whether
+// it's ready.
+func (m *Mapper) GatewayConfig(name string) (Config, bool) {
+	gw := m.set.get(m.nameOf(name))
+	if gw == nil {
+		return Config{}, false
+	}
+	return gw.config, true
+}
+
+func (m *Mapper) gateway(name string) (*gateway, error) {
+	name = m.nameOf(name)
+	gw := m.set.get(name)
+	if gw == nil {
+		return nil, fmt.Errorf("%w: %s", ErrGatewayNotReady, name)
+	}
+	return gw, nil
+}
+
+// Empty name means the default gateway.
+func (m *Mapper) nameOf(name string) string {
+	if name == "" && len(m.names) > 0 {
+		return m.names[0]
+	}
+	return name
+}
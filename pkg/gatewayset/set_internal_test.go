@@ -0,0 +1,186 @@
+package gatewayset
+
+import (
+	"context"
+	"net"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// Responds with its gateway IP, and reports the restarts on demand.
+type fakeMapper struct {
+	ip       net.IP
+	restarts chan struct{}
+}
+
+func newFakeMapper(ip net.IP) *fakeMapper {
+	return &fakeMapper{ip: ip, restarts: make(chan struct{}, 1)}
+}
+
+func (m *fakeMapper) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
+	return &portmap.Response{
+		Protocol:    req.Protocol,
+		NodePort:    req.NodePort,
+		GatewayPort: req.GatewayPort,
+		GatewayIP:   m.ip,
+		Lifetime:    req.Lifetime,
+	}, nil
+}
+
+func (m *fakeMapper) Unmap(ctx context.Context, req *portmap.Request) error {
+	return nil
+}
+
+func (m *fakeMapper) ListMappings(ctx context.Context) ([]portmap.Mapping, error) {
+	return nil, portmap.ErrUnsupported
+}
+
+func (m *fakeMapper) ExternalAddress(ctx context.Context) (net.IP, error) {
+	return m.ip, nil
+}
+
+func (m *fakeMapper) Capabilities() portmap.Capabilities {
+	return portmap.Capabilities{ExternalAddress: true}
+}
+
+func (m *fakeMapper) Restarts() <-chan struct{} {
+	return m.restarts
+}
+
+// Records whether the run func was started and stopped.
+func trackRun() (RunFunc, <-chan struct{}, <-chan struct{}) {
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	return func(stopch <-chan struct{}) error {
+		close(started)
+		<-stopch
+		close(stopped)
+		return nil
+	}, started, stopped
+}
+
+var _ = Describe("Set", func() {
+	var (
+		set *Set
+		req *portmap.Request
+	)
+
+	BeforeEach(func() {
+		set = New(ctrl.Log)
+		req = &portmap.Request{
+			Protocol:    portmap.ProtocolTCP,
+			NodePort:    32100,
+			GatewayPort: 80,
+			Lifetime:    120,
+		}
+	})
+
+	It("should fail to map at an unknown gateway", func() {
+		res, err := set.Mapper("home").Map(context.Background(), req)
+		Expect(res).To(BeNil())
+		Expect(err).To(MatchError(ErrGatewayNotReady))
+	})
+
+	It("should map at the current mapper of the gateway", func() {
+		mapper := set.Mapper("home")
+
+		run, started, stopped := trackRun()
+		set.Put("home", 1, newFakeMapper(net.IPv4(1, 2, 3, 4)), run, Config{})
+		Eventually(started).Should(BeClosed())
+		Expect(mapper.Restarts()).To(Receive())
+
+		res, err := mapper.Map(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.GatewayIP).To(Equal(net.IPv4(1, 2, 3, 4)))
+
+		set.Put("home", 2, newFakeMapper(net.IPv4(5, 6, 7, 8)), noopRun, Config{})
+		Expect(stopped).To(BeClosed())
+		Expect(mapper.Restarts()).To(Receive())
+		generation, ok := set.Generation("home")
+		Expect(ok).To(BeTrue())
+		Expect(generation).To(Equal(int64(2)))
+
+		res, err = mapper.Map(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.GatewayIP).To(Equal(net.IPv4(5, 6, 7, 8)))
+
+		set.Remove("home")
+		_, err = mapper.Map(context.Background(), req)
+		Expect(err).To(MatchError(ErrGatewayNotReady))
+	})
+
+	It("should map at the gateway named in the request", func() {
+		set.Put("fibre", 1, newFakeMapper(net.IPv4(1, 2, 3, 4)), noopRun, Config{})
+		set.Put("lte", 1, newFakeMapper(net.IPv4(5, 6, 7, 8)), noopRun, Config{DefaultLifetime: 3600})
+		mapper := set.Mapper("fibre", "lte")
+		Expect(mapper.Gateways()).To(Equal([]string{"fibre", "lte"}))
+
+		res, err := mapper.Map(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.GatewayIP).To(Equal(net.IPv4(1, 2, 3, 4)))
+		Expect(res.Gateway).To(BeEmpty())
+
+		req.Gateway = "lte"
+		res, err = mapper.Map(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.GatewayIP).To(Equal(net.IPv4(5, 6, 7, 8)))
+		Expect(res.Gateway).To(Equal("lte"))
+
+		config, ok := mapper.GatewayConfig("lte")
+		Expect(ok).To(BeTrue())
+		Expect(config.DefaultLifetime).To(Equal(portmap.Lifetime(3600)))
+
+		req.Gateway = "dsl"
+		_, err = mapper.Map(context.Background(), req)
+		Expect(err).To(MatchError(ErrGatewayNotReady))
+
+		set.Remove("fibre")
+		set.Remove("lte")
+	})
+
+	It("should forward the restarts of the mapper", func() {
+		fake := newFakeMapper(net.IPv4(1, 2, 3, 4))
+		set.Put("home", 1, fake, noopRun, Config{})
+		mapper := set.Mapper("home")
+		Expect(mapper.Restarts()).To(Receive())
+
+		fake.restarts <- struct{}{}
+		Eventually(mapper.Restarts()).Should(Receive())
+		set.Remove("home")
+	})
+
+	It("should stop the mappers when stopped", func() {
+		run, _, stopped := trackRun()
+		set.Put("home", 1, newFakeMapper(net.IPv4(1, 2, 3, 4)), run, Config{})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(set.Start(ctx)).To(Succeed())
+		Expect(stopped).To(BeClosed())
+		_, ok := set.Get("home")
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("Config", func() {
+	It("should allow any port without the ranges", func() {
+		config := Config{}
+		Expect(config.Allows(80)).To(BeTrue())
+	})
+
+	It("should only allow the ports in the ranges", func() {
+		config := Config{AllowedPorts: []PortRange{{From: 80, To: 80}, {From: 8000, To: 8999}}}
+		Expect(config.Allows(80)).To(BeTrue())
+		Expect(config.Allows(8500)).To(BeTrue())
+		Expect(config.Allows(81)).To(BeFalse())
+		Expect(config.Allows(portmap.PortAny)).To(BeTrue())
+	})
+})
+
+func noopRun(stopch <-chan struct{}) error {
+	<-stopch
+	return nil
+}
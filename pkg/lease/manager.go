@@ -0,0 +1,392 @@
+// Keeps the port mappings alive by renewing them before the gateway expires
+// them, independently of when the Services are reconciled.
+//
+// The mappings are renewed according to the lifetimes the gateway grants,
+// not the ones requested.
+
+package lease
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var ErrGatewayPortChanged = errors.New("the gateway port changed on renewal")
+
+// The number of renewals that can be pending before they are dropped.
+const renewalsBuffer = 64
+
+// Lease is a port mapping kept alive by the Manager.
+type Lease struct {
+	// The object the mapping belongs to.
+	Owner types.NamespacedName
+
+	// The request to renew the mapping with.
+	Request portmap.Request
+
+	// When the gateway is going to expire the mapping unless it's renewed.
+	Expiry time.Time
+}
+
+// Failure is reported when the Manager fails to renew a mapping.
+type Failure struct {
+	Lease Lease
+	// The error of the last renewal attempt.
+	Err error
+
+	// Whether the mapping has expired, and the Manager no longer
+	// tries to renew it.
+	Expired bool
+}
+
+// Manager renews the tracked mappings at roughly the half of their
+// lifetime. Add it to the controller manager to run it.
+type Manager struct {
+	mapper   portmap.BasicMapper
+	failures chan Failure
+	renewals chan Lease
+	wakeup   chan struct{}
+
+	mu      sync.Mutex
+	entries map[key]*entry
+	queue   queue
+	rand    *rand.Rand
+}
+
+type key struct {
+	owner       types.NamespacedName
+	gateway     string
+	protocol    portmap.Protocol
+	gatewayPort portmap.Port
+	internalIP  string
+}
+
+type entry struct {
+	lease   Lease
+	granted time.Time
+
+	// The renewal attempts made since the lease was last granted.
+	attempt     int
+	lastAttempt time.Time
+	lastErr     error
+
+	// When to make the next renewal attempt, or to give up if it's
+	// the expiry time.
+	next  time.Time
+	index int
+
+	// Closed when the renewal in flight is done, nil if there's none.
+	renewing chan struct{}
+}
+
+func NewManager(mapper portmap.BasicMapper) *Manager {
+	return &Manager{
+		mapper:   mapper,
+		failures: make(chan Failure),
+		renewals: make(chan Lease, renewalsBuffer),
+		wakeup:   make(chan struct{}, 1),
+		entries:  make(map[key]*entry),
+		// nolint: gosec
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Failures reports the renewals that failed, and the mappings that expired.
+// It has to be consumed while the Manager runs.
+func (m *Manager) Failures() <-chan Failure {
+	return m.failures
+}
+
+// Renewals reports the renewed leases. The reports are dropped if nobody
+// keeps up with them.
+func (m *Manager) Renewals() <-chan Lease {
+	return m.renewals
+}
+
+// Track starts renewing the mapping the gateway has granted in response
+// to the request, replacing the previous lease of the same mapping.
+// The mappings granted for an unlimited time are not tracked.
+func (m *Manager) Track(owner types.NamespacedName, req *portmap.Request, res *portmap.Response) {
+	lease := Lease{Owner: owner, Request: *req}
+	// Ask for the port we've got, in case it was up to the gateway.
+	lease.Request.GatewayPort = res.GatewayPort
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := keyOf(&lease)
+	if prev, ok := m.entries[k]; ok {
+		m.remove(prev)
+	}
+	if res.Lifetime == 0 {
+		return
+	}
+
+	now := time.Now()
+	e := &entry{lease: lease}
+	m.grant(e, now, res.Lifetime)
+	m.entries[k] = e
+	heap.Push(&m.queue, e)
+	m.wake()
+}
+
+// Forget stops renewing the mapping of the request, waiting for
+// the renewal in flight, if any, so that the mapping can be safely deleted.
+func (m *Manager) Forget(owner types.NamespacedName, req *portmap.Request) {
+	m.mu.Lock()
+	k := keyOf(&Lease{Owner: owner, Request: *req})
+	var renewing chan struct{}
+	if e, ok := m.entries[k]; ok {
+		m.remove(e)
+		renewing = e.renewing
+	}
+	m.mu.Unlock()
+
+	if renewing != nil {
+		<-renewing
+	}
+}
+
+// ForgetOwner stops renewing all the mappings of the owner, leaving them
+// to expire. Used when the owner is gone.
+func (m *Manager) ForgetOwner(owner types.NamespacedName) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, e := range m.entries {
+		if k.owner == owner {
+			m.remove(e)
+		}
+	}
+}
+
+// Leases returns the leases of the owner.
+func (m *Manager) Leases(owner types.NamespacedName) []Lease {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	leases := make([]Lease, 0)
+	for k, e := range m.entries {
+		if k.owner == owner {
+			leases = append(leases, e.lease)
+		}
+	}
+	return leases
+}
+
+// Expiry returns when the tracked mapping of the request expires, if it's
+// tracked.
+func (m *Manager) Expiry(owner types.NamespacedName, req *portmap.Request) (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[keyOf(&Lease{Owner: owner, Request: *req})]
+	if !ok {
+		return time.Time{}, false
+	}
+	return e.lease.Expiry, true
+}
+
+// Start renews the mappings until the context is done.
+func (m *Manager) Start(ctx context.Context) error {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		wait := m.processDue(ctx, time.Now())
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		case <-m.wakeup:
+		}
+	}
+}
+
+// Starts the renewals that are due, gives up on the expired mappings,
+// and returns how long to wait for the next one.
+func (m *Manager) processDue(ctx context.Context, now time.Time) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for m.queue.Len() > 0 {
+		e := m.queue[0]
+		if e.next.After(now) {
+			return e.next.Sub(now)
+		}
+		heap.Pop(&m.queue)
+
+		if !e.next.Before(e.lease.Expiry) {
+			delete(m.entries, keyOf(&e.lease))
+			go m.report(ctx, Failure{Lease: e.lease, Err: e.lastErr, Expired: true})
+			continue
+		}
+
+		e.attempt++
+		e.lastAttempt = now
+		e.renewing = make(chan struct{})
+		go m.renew(portmap.WithExpiry(ctx, e.lease.Expiry), e, e.lease.Request)
+	}
+	return time.Hour
+}
+
+func (m *Manager) renew(ctx context.Context, e *entry, req portmap.Request) {
+	defer close(e.renewing)
+
+	res, err := m.mapper.Map(ctx, &req)
+	if err == nil && res.GatewayPort != req.GatewayPort {
+		err = fmt.Errorf("%w: from %d to %d", ErrGatewayPortChanged, req.GatewayPort, res.GatewayPort)
+		if unmapErr := m.unmapChanged(ctx, &req, res); unmapErr != nil {
+			err = fmt.Errorf("%w, and unable to delete the new mapping: %v", err, unmapErr)
+		}
+	}
+
+	m.mu.Lock()
+	if current, ok := m.entries[keyOf(&e.lease)]; !ok || current != e {
+		// Forgotten or replaced in the meantime.
+		m.mu.Unlock()
+		return
+	}
+	e.renewing = nil
+
+	renewed := false
+	switch {
+	case err != nil:
+		e.lastErr = err
+		m.schedule(e)
+		heap.Push(&m.queue, e)
+	case res.Lifetime == 0:
+		delete(m.entries, keyOf(&e.lease))
+	default:
+		m.grant(e, time.Now(), res.Lifetime)
+		heap.Push(&m.queue, e)
+		renewed = true
+	}
+	lease := e.lease
+	m.wake()
+	m.mu.Unlock()
+
+	if err != nil {
+		m.report(ctx, Failure{Lease: lease, Err: err})
+	}
+	if renewed {
+		select {
+		case m.renewals <- lease:
+		default:
+		}
+	}
+}
+
+// Deletes the mapping the gateway has made at another port on renewal.
+// Nothing records it, so it would otherwise stay until it expires.
+func (m *Manager) unmapChanged(ctx context.Context, req *portmap.Request, res *portmap.Response) error {
+	unmapReq := *req
+	unmapReq.GatewayPort = res.GatewayPort
+	unmapReq.Lifetime = portmap.LifetimeDelete
+	_, err := m.mapper.Map(ctx, &unmapReq)
+	return err
+}
+
+func (m *Manager) report(ctx context.Context, failure Failure) {
+	select {
+	case m.failures <- failure:
+	case <-ctx.Done():
+	}
+}
+
+// Records the lease granted at the given time, and schedules its renewal.
+func (m *Manager) grant(e *entry, now time.Time, lifetime portmap.Lifetime) {
+	e.granted = now
+	e.lease.Expiry = now.Add(time.Duration(lifetime) * time.Second)
+	e.attempt = 0
+	e.lastErr = nil
+	m.schedule(e)
+}
+
+// Schedules the next renewal attempt, or the expiry if there is no time
+// left for it.
+func (m *Manager) schedule(e *entry) {
+	next := renewalTime(e.granted, e.lease.Expiry.Sub(e.granted), e.attempt, m.rand.Float64())
+	if e.attempt > 0 && next.Sub(e.lastAttempt) < MinRenewalInterval {
+		next = e.lastAttempt.Add(MinRenewalInterval)
+	}
+	if next.After(e.lease.Expiry) {
+		next = e.lease.Expiry
+	}
+	e.next = next
+}
+
+func (m *Manager) remove(e *entry) {
+	delete(m.entries, keyOf(&e.lease))
+	if e.index >= 0 && e.index < m.queue.Len() && m.queue[e.index] == e {
+		heap.Remove(&m.queue, e.index)
+	}
+}
+
+func (m *Manager) wake() {
+	select {
+	case m.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func keyOf(lease *Lease) key {
+	var internalIP string
+	if lease.Request.InternalIP != nil {
+		internalIP = lease.Request.InternalIP.String()
+	}
+	return key{
+		owner:       lease.Owner,
+		gateway:     lease.Request.Gateway,
+		protocol:    lease.Request.Protocol,
+		gatewayPort: lease.Request.GatewayPort,
+		internalIP:  internalIP,
+	}
+}
+
+// The entries ordered by the next attempt time.
+type queue []*entry
+
+var _ heap.Interface = (*queue)(nil)
+
+func (q queue) Len() int           { return len(q) }
+func (q queue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q queue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *queue) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *queue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*q = old[:n-1]
+	return e
+}
@@ -0,0 +1,212 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var errFake = errors.New("fake error")
+
+// Records the requests, and responds with the configured lifetime
+// or error.
+type fakeMapper struct {
+	mu       sync.Mutex
+	requests []portmap.Request
+	expiries []time.Time
+	lifetime portmap.Lifetime
+	err      error
+
+	// Overrides the gateway port in the responses if set.
+	gatewayPort portmap.Port
+}
+
+func (m *fakeMapper) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests = append(m.requests, *req)
+	expiry, _ := portmap.ExpiryFrom(ctx)
+	m.expiries = append(m.expiries, expiry)
+	if m.err != nil {
+		return nil, m.err
+	}
+	gatewayPort := req.GatewayPort
+	if m.gatewayPort != portmap.PortAny {
+		gatewayPort = m.gatewayPort
+	}
+	return &portmap.Response{
+		Protocol:    req.Protocol,
+		NodePort:    req.NodePort,
+		GatewayPort: gatewayPort,
+		GatewayIP:   net.IPv4(1, 2, 3, 4),
+		Lifetime:    m.lifetime,
+	}, nil
+}
+
+func (m *fakeMapper) Requests() []portmap.Request {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]portmap.Request(nil), m.requests...)
+}
+
+func (m *fakeMapper) Expiries() []time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]time.Time(nil), m.expiries...)
+}
+
+var _ = Describe("Manager", func() {
+	var (
+		mapper  *fakeMapper
+		manager *Manager
+		cancel  context.CancelFunc
+		stopped chan struct{}
+		owner   = types.NamespacedName{Namespace: "default", Name: "test"}
+		req     *portmap.Request
+		res     *portmap.Response
+	)
+
+	BeforeEach(func() {
+		mapper = &fakeMapper{lifetime: 1}
+		manager = NewManager(mapper)
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		stopped = make(chan struct{})
+		go func(manager *Manager, stopped chan<- struct{}) {
+			defer GinkgoRecover()
+			defer close(stopped)
+			Expect(manager.Start(ctx)).To(Succeed())
+		}(manager, stopped)
+
+		req = &portmap.Request{
+			Protocol:    portmap.ProtocolTCP,
+			NodePort:    portmap.Port(30000),
+			GatewayPort: portmap.Port(80),
+			Lifetime:    portmap.Lifetime(120),
+		}
+		res = &portmap.Response{
+			Protocol:    portmap.ProtocolTCP,
+			NodePort:    portmap.Port(30000),
+			GatewayPort: portmap.Port(80),
+			GatewayIP:   net.IPv4(1, 2, 3, 4),
+			Lifetime:    portmap.Lifetime(1),
+		}
+	})
+
+	AfterEach(func() {
+		cancel()
+		<-stopped
+	})
+
+	It("should renew the mapping at the half of the granted lifetime", func() {
+		start := time.Now()
+		manager.Track(owner, req, res)
+
+		Eventually(mapper.Requests, 2*time.Second, 10*time.Millisecond).Should(HaveLen(1))
+		Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+		Expect(mapper.Requests()[0]).To(Equal(*req))
+
+		Eventually(mapper.Requests, 2*time.Second, 10*time.Millisecond).Should(HaveLen(2))
+		Expect(manager.Leases(owner)).To(HaveLen(1))
+	})
+
+	It("should report the renewals", func() {
+		manager.Track(owner, req, res)
+
+		var renewed Lease
+		Eventually(manager.Renewals(), 2*time.Second).Should(Receive(&renewed))
+		Expect(renewed.Owner).To(Equal(owner))
+		Expect(renewed.Expiry).To(BeTemporally(">", time.Now()))
+	})
+
+	It("should mark the renewals with the expiry of the mapping", func() {
+		manager.Track(owner, req, res)
+		expiry, ok := manager.Expiry(owner, req)
+		Expect(ok).To(BeTrue())
+		Expect(expiry).To(BeTemporally("~", time.Now().Add(time.Second), 100*time.Millisecond))
+
+		Eventually(mapper.Expiries, 2*time.Second, 10*time.Millisecond).Should(HaveLen(1))
+		Expect(mapper.Expiries()[0]).To(Equal(expiry))
+	})
+
+	It("should renew the gateway port that was granted", func() {
+		res.GatewayPort = portmap.Port(8080)
+		manager.Track(owner, req, res)
+
+		Eventually(mapper.Requests, 2*time.Second, 10*time.Millisecond).Should(HaveLen(1))
+		Expect(mapper.Requests()[0].GatewayPort).To(Equal(portmap.Port(8080)))
+	})
+
+	It("should not renew the forgotten mappings", func() {
+		manager.Track(owner, req, res)
+		manager.Forget(owner, req)
+
+		Consistently(mapper.Requests, time.Second, 50*time.Millisecond).Should(BeEmpty())
+		Expect(manager.Leases(owner)).To(BeEmpty())
+	})
+
+	It("should forget all the mappings of the owner", func() {
+		manager.Track(owner, req, res)
+		other := types.NamespacedName{Namespace: "default", Name: "other"}
+		manager.Track(other, req, res)
+		manager.ForgetOwner(owner)
+
+		Expect(manager.Leases(owner)).To(BeEmpty())
+		Expect(manager.Leases(other)).To(HaveLen(1))
+	})
+
+	It("should not track the mappings without a time limit", func() {
+		res.Lifetime = 0
+		manager.Track(owner, req, res)
+
+		Expect(manager.Leases(owner)).To(BeEmpty())
+	})
+
+	It("should report the failed renewals and the expiry", func() {
+		mapper.err = errFake
+		manager.Track(owner, req, res)
+
+		var failure Failure
+		Eventually(manager.Failures(), 2*time.Second).Should(Receive(&failure))
+		Expect(failure.Err).To(MatchError(errFake))
+		Expect(failure.Expired).To(BeFalse())
+		Expect(failure.Lease.Owner).To(Equal(owner))
+
+		// The next attempt is too soon after the first one.
+		Eventually(manager.Failures(), 2*time.Second).Should(Receive(&failure))
+		Expect(failure.Err).To(MatchError(errFake))
+		Expect(failure.Expired).To(BeTrue())
+		Expect(mapper.Requests()).To(HaveLen(1))
+		Expect(manager.Leases(owner)).To(BeEmpty())
+	})
+
+	It("should report the gateway port changes", func() {
+		mapper.gatewayPort = portmap.Port(8080)
+		manager.Track(owner, req, res)
+
+		var failure Failure
+		Eventually(manager.Failures(), 2*time.Second).Should(Receive(&failure))
+		Expect(failure.Err).To(MatchError(ErrGatewayPortChanged))
+		Expect(failure.Expired).To(BeFalse())
+	})
+
+	It("should delete the mapping made at the changed gateway port", func() {
+		mapper.gatewayPort = portmap.Port(8080)
+		manager.Track(owner, req, res)
+
+		Eventually(manager.Failures(), 2*time.Second).Should(Receive())
+		requests := mapper.Requests()
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[1].GatewayPort).To(Equal(portmap.Port(8080)))
+		Expect(requests[1].Lifetime).To(Equal(portmap.LifetimeDelete))
+	})
+})
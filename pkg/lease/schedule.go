@@ -0,0 +1,27 @@
+package lease
+
+import (
+	"time"
+)
+
+// MinRenewalInterval is how far apart the renewal attempts of a mapping
+// have to be at least.
+//
+// See https://tools.ietf.org/html/rfc6887#section-11.2.1
+const MinRenewalInterval = 4 * time.Second
+
+// Returns when to make the given renewal attempt, counting from zero,
+// for the lease granted for the lifetime at the given time.
+//
+// The attempt n is made at 1 - 1/2^(n+1) of the lifetime plus a random
+// jitter of up to 1/2^(n+3) of the lifetime: the first one at 1/2 to 5/8
+// of the lifetime, then at 3/4 to 3/4 + 1/16, at 7/8 to 7/8 + 1/32 and so on.
+// The jitter is expected to be in the [0, 1) range.
+//
+// See https://tools.ietf.org/html/rfc6887#section-11.2.1
+func renewalTime(granted time.Time, lifetime time.Duration, attempt int, jitter float64) time.Time {
+	shift := uint(attempt + 1)
+	offset := lifetime - lifetime>>shift
+	offset += time.Duration(jitter * float64(lifetime>>(shift+2))) // nolint: gomnd
+	return granted.Add(offset)
+}
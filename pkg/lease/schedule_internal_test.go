@@ -0,0 +1,34 @@
+package lease
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("renewalTime", func() {
+	granted := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	lifetime := 64 * time.Second
+
+	It("should make the first attempt at 1/2 to 5/8 of the lifetime", func() {
+		Expect(renewalTime(granted, lifetime, 0, 0)).To(Equal(granted.Add(32 * time.Second)))
+		Expect(renewalTime(granted, lifetime, 0, 0.5)).To(Equal(granted.Add(36 * time.Second)))
+	})
+
+	It("should retry at 3/4 to 3/4 + 1/16 of the lifetime", func() {
+		Expect(renewalTime(granted, lifetime, 1, 0)).To(Equal(granted.Add(48 * time.Second)))
+		Expect(renewalTime(granted, lifetime, 1, 0.5)).To(Equal(granted.Add(50 * time.Second)))
+	})
+
+	It("should retry at 7/8 to 7/8 + 1/32 of the lifetime", func() {
+		Expect(renewalTime(granted, lifetime, 2, 0)).To(Equal(granted.Add(56 * time.Second)))
+		Expect(renewalTime(granted, lifetime, 2, 0.5)).To(Equal(granted.Add(57 * time.Second)))
+	})
+
+	It("should never go past the expiry", func() {
+		for attempt := 0; attempt < 100; attempt++ {
+			Expect(renewalTime(granted, lifetime, attempt, 0.999)).To(BeTemporally("<=", granted.Add(lifetime)))
+		}
+	})
+})
@@ -0,0 +1,307 @@
+package natpmp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/gateway"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+)
+
+var (
+	ErrNoResponse = errors.New("no response from the NAT-PMP server")
+)
+
+const (
+	// DefaultTimeout is the maximum time spent on a single request,
+	// including retransmissions.
+	DefaultTimeout = 30 * time.Second
+
+	// See https://tools.ietf.org/html/rfc6886#section-3.1
+	maxAttempts = 9
+
+	maxPacketSize = 16
+)
+
+// Used for mocks.
+var initialRetransmissionTime = 250 * time.Millisecond
+
+type Client struct {
+	// If empty, the default gateway is used as the server.
+	// The port is optional and defaults to `DefaultServerPort`.
+	ServerAddr string
+
+	// If zero, `DefaultTimeout` is used.
+	Timeout time.Duration
+}
+
+var (
+	_ portmap.Mapper = (*Client)(nil)
+	_ portmap.Prober = (*Client)(nil)
+)
+
+func New(serverAddr string) *Client {
+	return &Client{
+		ServerAddr: serverAddr,
+	}
+}
+
+func (c *Client) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
+	var opcode uint8
+	switch req.Protocol { // nolint: exhaustive
+	case portmap.ProtocolUDP:
+		opcode = opcodeMapUDP
+	case portmap.ProtocolTCP:
+		opcode = opcodeMapTCP
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedProtocol, req.Protocol)
+	}
+
+	if req.NodePort == portmap.PortAny {
+		return nil, ErrUnsupportedPortRange
+	}
+
+	if req.InternalIP != nil {
+		localIP, err := c.localAddress(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !req.InternalIP.Equal(localIP) {
+			return nil, ErrUnsupportedInternalIP
+		}
+	}
+
+	mreq := &mapRequest{
+		Opcode:                opcode,
+		InternalPort:          uint16(req.NodePort),
+		SuggestedExternalPort: uint16(req.GatewayPort),
+		Lifetime:              uint32(req.Lifetime),
+	}
+	if req.Lifetime == portmap.LifetimeDelete {
+		// See https://tools.ietf.org/html/rfc6886#section-3.4
+		mreq.SuggestedExternalPort = 0
+	}
+
+	var mres *mapResponse
+	err := c.exchange(ctx, mreq.marshal(), func(data []byte) (bool, error) {
+		res, perr := parseMapResponse(data, opcode)
+		if perr != nil {
+			if errors.Is(perr, ErrUnsupportedServer) {
+				return true, perr
+			}
+			// Not a valid response, keep waiting.
+			return false, nil
+		}
+		if res.ResultCode == ResultSuccess && res.InternalPort != mreq.InternalPort {
+			// Response to some other request, keep waiting.
+			return false, nil
+		}
+		mres = res
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if mres.ResultCode != ResultSuccess {
+		return nil, &ResultError{Code: mres.ResultCode}
+	}
+
+	res := &portmap.Response{
+		Protocol:    req.Protocol,
+		NodePort:    portmap.Port(mres.InternalPort),
+		GatewayPort: portmap.Port(mres.MappedExternalPort),
+		Lifetime:    portmap.Lifetime(mres.Lifetime),
+	}
+
+	if req.Lifetime != portmap.LifetimeDelete {
+		// The mapping response doesn't carry the external address,
+		// so it has to be requested separately.
+		res.GatewayIP, err = c.ExternalAddress(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the external address: %w", err)
+		}
+	}
+
+	return res, nil
+}
+
+// Unmap deletes the mapping of the node port. NAT-PMP servers don't fail
+// deleting the mappings that are already gone.
+func (c *Client) Unmap(ctx context.Context, req *portmap.Request) error {
+	delreq := *req
+	delreq.Lifetime = portmap.LifetimeDelete
+	_, err := c.Map(ctx, &delreq)
+	return err
+}
+
+// ListMappings is not supported, NAT-PMP can't list the mappings.
+func (c *Client) ListMappings(ctx context.Context) ([]portmap.Mapping, error) {
+	return nil, portmap.ErrUnsupported
+}
+
+// Capabilities of NAT-PMP.
+func (c *Client) Capabilities() portmap.Capabilities {
+	return portmap.Capabilities{
+		Protocols:       []portmap.Protocol{portmap.ProtocolTCP, portmap.ProtocolUDP},
+		PortAny:         true,
+		ExternalAddress: true,
+	}
+}
+
+// ExternalAddress requests the external IPv4 address of the NAT.
+func (c *Client) ExternalAddress(ctx context.Context) (net.IP, error) {
+	eres, err := c.externalAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return eres.ExternalIP, nil
+}
+
+// Probe requests the external address, which also tells the server epoch.
+func (c *Client) Probe(ctx context.Context) (*portmap.GatewayInfo, error) {
+	eres, err := c.externalAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &portmap.GatewayInfo{
+		ExternalIP: eres.ExternalIP,
+		Epoch:      &eres.Epoch,
+		Protocols:  []portmap.Protocol{portmap.ProtocolTCP, portmap.ProtocolUDP},
+	}, nil
+}
+
+func (c *Client) externalAddress(ctx context.Context) (*externalAddressResponse, error) {
+	var eres *externalAddressResponse
+	err := c.exchange(ctx, marshalExternalAddressRequest(), func(data []byte) (bool, error) {
+		res, perr := parseExternalAddressResponse(data)
+		if perr != nil {
+			if errors.Is(perr, ErrUnsupportedServer) {
+				return true, perr
+			}
+			// Not a valid response, keep waiting.
+			return false, nil
+		}
+		eres = res
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if eres.ResultCode != ResultSuccess {
+		return nil, &ResultError{Code: eres.ResultCode}
+	}
+	return eres, nil
+}
+
+// Sends the packet and waits for the handler to accept a response,
+// retransmitting the packet as per https://tools.ietf.org/html/rfc6886#section-3.1
+func (c *Client) exchange(ctx context.Context, packet []byte, handle func([]byte) (bool, error)) error {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Unblock the pending read when the context is done.
+	stopch := make(chan struct{})
+	defer close(stopch)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stopch:
+		}
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	rt := initialRetransmissionTime
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if _, err := conn.Write(packet); err != nil {
+			return contextErr(ctx, err)
+		}
+
+		if err := conn.SetReadDeadline(time.Now().Add(rt)); err != nil {
+			return contextErr(ctx, err)
+		}
+		rt *= 2
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var nerr net.Error
+				if errors.As(err, &nerr) && nerr.Timeout() && ctx.Err() == nil {
+					// Time to retransmit.
+					break
+				}
+				return contextErr(ctx, err)
+			}
+
+			if done, herr := handle(buf[:n]); done {
+				return herr
+			}
+		}
+	}
+
+	return ErrNoResponse
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	addr, err := c.serverAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "udp4", addr)
+}
+
+// The address of this host as seen by the server.
+func (c *Client) localAddress(ctx context.Context) (net.IP, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func (c *Client) serverAddr() (string, error) {
+	if c.ServerAddr == "" {
+		ip, err := gateway.Discover()
+		if err != nil {
+			return "", fmt.Errorf("unable to discover the NAT-PMP server: %w", err)
+		}
+		return net.JoinHostPort(ip.String(), strconv.Itoa(DefaultServerPort)), nil
+	}
+
+	if _, _, err := net.SplitHostPort(c.ServerAddr); err != nil {
+		return net.JoinHostPort(c.ServerAddr, strconv.Itoa(DefaultServerPort)), nil
+	}
+	return c.ServerAddr, nil
+}
+
+func contextErr(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case nil:
+		return err
+	case context.DeadlineExceeded:
+		return ErrNoResponse
+	default:
+		return ctx.Err()
+	}
+}
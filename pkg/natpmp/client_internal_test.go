@@ -0,0 +1,244 @@
+package natpmp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// A fake NAT-PMP server that echoes the mapping requests back.
+type fakeServer struct {
+	conn     *net.UDPConn
+	requests chan []byte
+	donech   chan struct{}
+
+	// Result code to respond to the mapping requests with.
+	ResultCode ResultCode
+	// Mapped external port, if non-zero, otherwise the suggested port is used.
+	ExternalPort uint16
+	// Number of requests to ignore before responding.
+	Drop int
+}
+
+func startFakeServer() *fakeServer {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	Expect(err).NotTo(HaveOccurred())
+
+	return &fakeServer{
+		conn:     conn,
+		requests: make(chan []byte, 100),
+		donech:   make(chan struct{}),
+	}
+}
+
+func (s *fakeServer) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *fakeServer) Run() {
+	defer close(s.donech)
+	buf := make([]byte, 64)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := append([]byte(nil), buf[:n]...)
+		s.requests <- req
+
+		if s.Drop > 0 {
+			s.Drop--
+			continue
+		}
+
+		_, _ = s.conn.WriteToUDP(s.respond(req), from)
+	}
+}
+
+func (s *fakeServer) Stop() {
+	s.conn.Close()
+	<-s.donech
+}
+
+func (s *fakeServer) respond(req []byte) []byte {
+	if req[1] == opcodeExternalAddress {
+		return []byte{0, 128, 0, 0, 0, 0, 0, 1, 1, 2, 3, 4}
+	}
+
+	res := make([]byte, mapResponseSize)
+	res[1] = responseBit | req[1]
+	binary.BigEndian.PutUint16(res[2:4], uint16(s.ResultCode))
+	binary.BigEndian.PutUint32(res[4:8], 1)
+	copy(res[8:10], req[4:6])
+	copy(res[10:12], req[6:8])
+	if s.ExternalPort != 0 {
+		binary.BigEndian.PutUint16(res[10:12], s.ExternalPort)
+	}
+	copy(res[12:16], req[8:12])
+	return res
+}
+
+var _ = Describe("Client", func() {
+	var (
+		server *fakeServer
+		req    *portmap.Request
+		res    *portmap.Response
+		err    error
+	)
+
+	BeforeEach(func() {
+		initialRetransmissionTime = 10 * time.Millisecond
+		server = startFakeServer()
+		req = &portmap.Request{
+			Protocol:    portmap.ProtocolTCP,
+			NodePort:    portmap.Port(32100),
+			GatewayPort: portmap.Port(80),
+			Lifetime:    portmap.Lifetime(120),
+		}
+	})
+
+	AfterEach(func() {
+		initialRetransmissionTime = 250 * time.Millisecond
+	})
+
+	JustBeforeEach(func() {
+		go server.Run()
+		defer server.Stop()
+
+		client := New(server.Addr())
+		client.Timeout = time.Second
+		res, err = client.Map(context.Background(), req)
+	})
+
+	Context("with a server that accepts the mapping", func() {
+		BeforeEach(func() {
+			server.ExternalPort = 1024
+		})
+
+		It("should produce a correct response", func() {
+			Expect(err).To(BeNil())
+			Expect(res).To(Equal(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1024),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(120),
+			}))
+		})
+
+		It("should send the mapping and then the external address requests", func() {
+			Expect(server.requests).To(HaveLen(2))
+			Expect(<-server.requests).To(Equal([]byte{0, 2, 0, 0, 0x7d, 0x64, 0, 80, 0, 0, 0, 120}))
+			Expect(<-server.requests).To(Equal([]byte{0, 0}))
+		})
+	})
+
+	Context("when deleting a UDP mapping", func() {
+		BeforeEach(func() {
+			req.Protocol = portmap.ProtocolUDP
+			req.Lifetime = portmap.LifetimeDelete
+		})
+
+		It("should send a deletion request only", func() {
+			Expect(err).To(BeNil())
+			Expect(res.Lifetime).To(Equal(portmap.LifetimeDelete))
+			Expect(res.GatewayIP).To(BeNil())
+			Expect(server.requests).To(HaveLen(1))
+			Expect(<-server.requests).To(Equal([]byte{0, 1, 0, 0, 0x7d, 0x64, 0, 0, 0, 0, 0, 0}))
+		})
+	})
+
+	Context("with a server that rejects the mapping", func() {
+		BeforeEach(func() {
+			server.ResultCode = ResultNotAuthorized
+		})
+
+		It("should produce a result error", func() {
+			Expect(err).To(Equal(&ResultError{Code: ResultNotAuthorized}))
+			Expect(err).To(MatchError("NAT-PMP server responded with NOT_AUTHORIZED (2)"))
+			Expect(res).To(BeNil())
+		})
+	})
+
+	Context("with a server that loses the first request", func() {
+		BeforeEach(func() {
+			server.Drop = 1
+		})
+
+		It("should retransmit the request", func() {
+			Expect(err).To(BeNil())
+			Expect(res.GatewayPort).To(Equal(portmap.Port(80)))
+			Expect(server.requests).To(HaveLen(3))
+		})
+	})
+
+	Context("with a server that never responds", func() {
+		BeforeEach(func() {
+			initialRetransmissionTime = time.Millisecond
+			server.Drop = 100
+		})
+
+		It("should give up after the maximum number of attempts", func() {
+			Expect(err).To(MatchError(ErrNoResponse))
+			Expect(res).To(BeNil())
+			Expect(server.requests).To(HaveLen(maxAttempts))
+		})
+	})
+
+	Context("with the internal address of the client itself", func() {
+		BeforeEach(func() {
+			req.InternalIP = net.IPv4(127, 0, 0, 1)
+		})
+
+		It("should map the port", func() {
+			Expect(err).To(BeNil())
+			Expect(res.NodePort).To(Equal(portmap.Port(32100)))
+		})
+	})
+
+	Context("with the internal address of another host", func() {
+		BeforeEach(func() {
+			req.InternalIP = net.IPv4(192, 168, 0, 10)
+		})
+
+		It("should fail without contacting the server", func() {
+			Expect(err).To(MatchError(ErrUnsupportedInternalIP))
+			Expect(res).To(BeNil())
+			Expect(server.requests).To(BeEmpty())
+		})
+	})
+
+	Context("with an SCTP request", func() {
+		BeforeEach(func() {
+			req.Protocol = portmap.ProtocolSCTP
+		})
+
+		It("should fail without contacting the server", func() {
+			Expect(err).To(MatchError(ErrUnsupportedProtocol))
+			Expect(res).To(BeNil())
+			Expect(server.requests).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("Client.Probe", func() {
+	It("should report the external address and the epoch", func() {
+		server := startFakeServer()
+		go server.Run()
+		defer server.Stop()
+
+		client := New(server.Addr())
+		client.Timeout = time.Second
+		info, err := client.Probe(context.Background())
+		Expect(err).To(BeNil())
+		Expect(info.ExternalIP).To(Equal(net.IPv4(1, 2, 3, 4)))
+		Expect(info.Epoch).NotTo(BeNil())
+		Expect(*info.Epoch).To(Equal(uint32(1)))
+		Expect(info.Protocols).To(ConsistOf(portmap.ProtocolTCP, portmap.ProtocolUDP))
+	})
+})
@@ -0,0 +1,6 @@
+// NAT Port Mapping Protocol client implementing a `portmap.Mapper` for
+// the routers that don't speak PCP.
+//
+// Ref: https://tools.ietf.org/html/rfc6886
+
+package natpmp
@@ -0,0 +1,155 @@
+package natpmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+var (
+	ErrShortPacket           = errors.New("packet is too short")
+	ErrNotResponse           = errors.New("packet is not a response")
+	ErrUnexpectedOpcode      = errors.New("unexpected opcode")
+	ErrUnsupportedServer     = &ResultError{Code: ResultUnsupportedVersion}
+	ErrUnsupportedProtocol   = errors.New("protocol is not supported by NAT-PMP")
+	ErrUnsupportedPortRange  = errors.New("NAT-PMP can't map all ports at once")
+	ErrUnsupportedInternalIP = errors.New("NAT-PMP can only map ports to the host the request is sent from")
+)
+
+const (
+	// Version of the protocol implemented by this package.
+	Version = 0
+
+	// DefaultServerPort is the port NAT-PMP servers listen on.
+	DefaultServerPort = 5351
+)
+
+const (
+	opcodeExternalAddress = 0
+	opcodeMapUDP          = 1
+	opcodeMapTCP          = 2
+
+	responseBit = 0x80
+
+	externalAddressResponseSize = 12
+	mapRequestSize              = 12
+	mapResponseSize             = 16
+)
+
+// See https://tools.ietf.org/html/rfc6886#section-3.2
+func marshalExternalAddressRequest() []byte {
+	return []byte{Version, opcodeExternalAddress}
+}
+
+// See https://tools.ietf.org/html/rfc6886#section-3.3
+type mapRequest struct {
+	Opcode                uint8
+	InternalPort          uint16
+	SuggestedExternalPort uint16
+	Lifetime              uint32
+}
+
+func (r *mapRequest) marshal() []byte {
+	buf := make([]byte, mapRequestSize)
+
+	buf[0] = Version
+	buf[1] = r.Opcode
+	binary.BigEndian.PutUint16(buf[4:6], r.InternalPort)
+	binary.BigEndian.PutUint16(buf[6:8], r.SuggestedExternalPort)
+	binary.BigEndian.PutUint32(buf[8:12], r.Lifetime)
+
+	return buf
+}
+
+type responseHeader struct {
+	Opcode     uint8
+	ResultCode ResultCode
+	Epoch      uint32
+}
+
+type externalAddressResponse struct {
+	responseHeader
+
+	ExternalIP net.IP
+}
+
+type mapResponse struct {
+	responseHeader
+
+	InternalPort       uint16
+	MappedExternalPort uint16
+	Lifetime           uint32
+}
+
+// See https://tools.ietf.org/html/rfc6886#section-3.5
+func parseResponseHeader(data []byte, opcode uint8) (*responseHeader, error) {
+	if len(data) < 4 { // nolint: gomnd
+		return nil, ErrShortPacket
+	}
+
+	if data[0] != Version {
+		return nil, ErrUnsupportedServer
+	}
+
+	if data[1]&responseBit == 0 {
+		return nil, ErrNotResponse
+	}
+
+	if data[1]&^responseBit != opcode {
+		return nil, ErrUnexpectedOpcode
+	}
+
+	header := &responseHeader{
+		Opcode:     opcode,
+		ResultCode: ResultCode(binary.BigEndian.Uint16(data[2:4])),
+	}
+
+	// Error responses might be truncated to just the header.
+	if len(data) >= 8 { // nolint: gomnd
+		header.Epoch = binary.BigEndian.Uint32(data[4:8])
+	}
+
+	return header, nil
+}
+
+// See https://tools.ietf.org/html/rfc6886#section-3.2
+func parseExternalAddressResponse(data []byte) (*externalAddressResponse, error) {
+	header, err := parseResponseHeader(data, opcodeExternalAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &externalAddressResponse{responseHeader: *header}
+	if header.ResultCode != ResultSuccess {
+		return res, nil
+	}
+
+	if len(data) < externalAddressResponseSize {
+		return nil, ErrShortPacket
+	}
+
+	res.ExternalIP = net.IPv4(data[8], data[9], data[10], data[11])
+	return res, nil
+}
+
+// See https://tools.ietf.org/html/rfc6886#section-3.3
+func parseMapResponse(data []byte, opcode uint8) (*mapResponse, error) {
+	header, err := parseResponseHeader(data, opcode)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &mapResponse{responseHeader: *header}
+	if header.ResultCode != ResultSuccess && len(data) < mapResponseSize {
+		return res, nil
+	}
+
+	if len(data) < mapResponseSize {
+		return nil, ErrShortPacket
+	}
+
+	res.InternalPort = binary.BigEndian.Uint16(data[8:10])
+	res.MappedExternalPort = binary.BigEndian.Uint16(data[10:12])
+	res.Lifetime = binary.BigEndian.Uint32(data[12:16])
+	return res, nil
+}
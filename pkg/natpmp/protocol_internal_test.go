@@ -0,0 +1,83 @@
+package natpmp
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("mapRequest", func() {
+	It("should marshal properly", func() {
+		req := &mapRequest{
+			Opcode:                opcodeMapTCP,
+			InternalPort:          32100,
+			SuggestedExternalPort: 80,
+			Lifetime:              7200,
+		}
+
+		Expect(req.marshal()).To(Equal([]byte{
+			0, 2, 0, 0,
+			0x7d, 0x64, 0, 80,
+			0, 0, 0x1c, 0x20,
+		}))
+	})
+})
+
+var _ = Describe("parseMapResponse", func() {
+	It("should parse a valid response", func() {
+		res, err := parseMapResponse([]byte{
+			0, 130, 0, 0,
+			0, 0, 0, 42,
+			0x7d, 0x64, 0x04, 0x00,
+			0, 0, 0x1c, 0x20,
+		}, opcodeMapTCP)
+		Expect(err).To(BeNil())
+		Expect(res).To(Equal(&mapResponse{
+			responseHeader: responseHeader{
+				Opcode:     opcodeMapTCP,
+				ResultCode: ResultSuccess,
+				Epoch:      42,
+			},
+			InternalPort:       32100,
+			MappedExternalPort: 1024,
+			Lifetime:           7200,
+		}))
+	})
+
+	It("should accept a truncated error response", func() {
+		res, err := parseMapResponse([]byte{0, 130, 0, 2}, opcodeMapTCP)
+		Expect(err).To(BeNil())
+		Expect(res.ResultCode).To(Equal(ResultNotAuthorized))
+	})
+
+	It("should reject a response to another opcode", func() {
+		res, err := parseMapResponse([]byte{0, 129, 0, 0}, opcodeMapTCP)
+		Expect(err).To(MatchError(ErrUnexpectedOpcode))
+		Expect(res).To(BeNil())
+	})
+
+	It("should reject a PCP response", func() {
+		res, err := parseMapResponse([]byte{2, 129, 0, 1}, opcodeMapTCP)
+		Expect(err).To(BeIdenticalTo(ErrUnsupportedServer))
+		Expect(res).To(BeNil())
+	})
+})
+
+var _ = Describe("parseExternalAddressResponse", func() {
+	It("should parse a valid response", func() {
+		res, err := parseExternalAddressResponse([]byte{
+			0, 128, 0, 0,
+			0, 0, 0, 42,
+			1, 2, 3, 4,
+		})
+		Expect(err).To(BeNil())
+		Expect(res.ExternalIP).To(Equal(net.IPv4(1, 2, 3, 4)))
+	})
+
+	It("should reject a truncated response", func() {
+		res, err := parseExternalAddressResponse([]byte{0, 128, 0, 0, 0, 0, 0, 42})
+		Expect(err).To(MatchError(ErrShortPacket))
+		Expect(res).To(BeNil())
+	})
+})
@@ -0,0 +1,45 @@
+package natpmp
+
+import "fmt"
+
+// ResultCode of the NAT-PMP response.
+//
+// See https://tools.ietf.org/html/rfc6886#section-3.5
+type ResultCode uint16
+
+const (
+	ResultSuccess            ResultCode = 0
+	ResultUnsupportedVersion ResultCode = 1
+	ResultNotAuthorized      ResultCode = 2
+	ResultNetworkFailure     ResultCode = 3
+	ResultOutOfResources     ResultCode = 4
+	ResultUnsupportedOpcode  ResultCode = 5
+)
+
+var resultCodeNames = map[ResultCode]string{
+	ResultSuccess:            "SUCCESS",
+	ResultUnsupportedVersion: "UNSUPPORTED_VERSION",
+	ResultNotAuthorized:      "NOT_AUTHORIZED",
+	ResultNetworkFailure:     "NETWORK_FAILURE",
+	ResultOutOfResources:     "OUT_OF_RESOURCES",
+	ResultUnsupportedOpcode:  "UNSUPPORTED_OPCODE",
+}
+
+func (c ResultCode) String() string {
+	if name, ok := resultCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_%d", uint16(c))
+}
+
+// ResultError is returned when the NAT-PMP server responds with
+// a non-success result code.
+type ResultError struct {
+	Code ResultCode
+}
+
+var _ error = (*ResultError)(nil)
+
+func (e *ResultError) Error() string {
+	return fmt.Sprintf("NAT-PMP server responded with %s (%d)", e.Code, uint16(e.Code))
+}
@@ -0,0 +1,112 @@
+// Package noncestore persists the PCP mapping nonce in Kubernetes.
+package noncestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/MOZGIII/port-map-operator/pkg/pcp"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// NonceKey is the key of the Secret data the nonce is stored at.
+const NonceKey = "nonce"
+
+var ErrInvalidNonce = errors.New("invalid nonce")
+
+// Secret stores the nonce in a Secret.
+type Secret struct {
+	// Used for reading, should not be a cached client, since the store
+	// is used before the manager starts.
+	Reader client.Reader
+	Writer client.Writer
+
+	Namespace string
+	Name      string
+}
+
+var _ pcp.NonceStore = (*Secret)(nil)
+
+func (s *Secret) LoadNonce(ctx context.Context) (*pcp.Nonce, error) {
+	var secret corev1.Secret
+	err := s.Reader.Get(ctx, types.NamespacedName{Namespace: s.Namespace, Name: s.Name}, &secret)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := secret.Data[NonceKey]
+	if !ok {
+		return nil, nil
+	}
+	return parseNonce(data)
+}
+
+// SaveNonce saves the nonce, unless another instance has saved its own
+// meanwhile, in which case that one is adopted, since it might be mapping
+// the ports with it already.
+func (s *Secret) SaveNonce(ctx context.Context, nonce pcp.Nonce) (pcp.Nonce, error) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: s.Namespace,
+			Name:      s.Name,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			NonceKey: nonce[:],
+		},
+	}
+
+	err := s.Writer.Create(ctx, secret)
+	if !apierrors.IsAlreadyExists(err) {
+		return nonce, err
+	}
+
+	var saved pcp.Nonce
+	err = retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		var adoptErr error
+		saved, adoptErr = s.adoptNonce(ctx, nonce)
+		return adoptErr
+	})
+	return saved, err
+}
+
+// Returns the nonce stored at the existing Secret, or stores the one
+// passed if there is none, updating the Secret that was read.
+func (s *Secret) adoptNonce(ctx context.Context, nonce pcp.Nonce) (pcp.Nonce, error) {
+	var secret corev1.Secret
+	if err := s.Reader.Get(ctx, types.NamespacedName{Namespace: s.Namespace, Name: s.Name}, &secret); err != nil {
+		return nonce, err
+	}
+	if data, ok := secret.Data[NonceKey]; ok {
+		stored, err := parseNonce(data)
+		if err != nil {
+			return nonce, err
+		}
+		return *stored, nil
+	}
+
+	// Left over without the nonce, take it over.
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	secret.Data[NonceKey] = nonce[:]
+	return nonce, s.Writer.Update(ctx, &secret)
+}
+
+func parseNonce(data []byte) (*pcp.Nonce, error) {
+	var nonce pcp.Nonce
+	if len(data) != len(nonce) {
+		return nil, fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidNonce, len(nonce), len(data))
+	}
+	copy(nonce[:], data)
+	return &nonce, nil
+}
@@ -0,0 +1,95 @@
+package noncestore
+
+import (
+	"context"
+
+	"github.com/MOZGIII/port-map-operator/pkg/pcp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Secret", func() {
+	var (
+		ctx   context.Context
+		store *Secret
+		nonce pcp.Nonce
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store = &Secret{
+			Reader:    k8sClient,
+			Writer:    k8sClient,
+			Namespace: "default",
+			Name:      "test-nonce",
+		}
+		nonce = pcp.Nonce{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	})
+
+	AfterEach(func() {
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: store.Namespace, Name: store.Name}}
+		_ = k8sClient.Delete(ctx, secret)
+	})
+
+	It("should load nothing when the Secret doesn't exist", func() {
+		loaded, err := store.LoadNonce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded).To(BeNil())
+	})
+
+	It("should load the saved nonce", func() {
+		Expect(store.SaveNonce(ctx, nonce)).To(Equal(nonce))
+
+		loaded, err := store.LoadNonce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded).To(Equal(&nonce))
+	})
+
+	It("should take over an existing Secret", func() {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: store.Namespace, Name: store.Name},
+			Data:       map[string][]byte{"other": []byte("data")},
+		}
+		Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+
+		loaded, err := store.LoadNonce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded).To(BeNil())
+
+		Expect(store.SaveNonce(ctx, nonce)).To(Equal(nonce))
+
+		loaded, err = store.LoadNonce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded).To(Equal(&nonce))
+	})
+
+	It("should adopt the nonce another instance has saved", func() {
+		other := nonce
+		other[0]++
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: store.Namespace, Name: store.Name},
+			Data:       map[string][]byte{NonceKey: other[:]},
+		}
+		Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+
+		Expect(store.SaveNonce(ctx, nonce)).To(Equal(other))
+
+		loaded, err := store.LoadNonce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded).To(Equal(&other))
+	})
+
+	It("should fail on a malformed nonce", func() {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: store.Namespace, Name: store.Name},
+			Data:       map[string][]byte{NonceKey: []byte("short")},
+		}
+		Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+
+		loaded, err := store.LoadNonce(ctx)
+		Expect(err).To(MatchError(ErrInvalidNonce))
+		Expect(loaded).To(BeNil())
+	})
+})
@@ -0,0 +1,186 @@
+package pcp
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+)
+
+// DefaultAnnounceAddr is where the PCP servers send the unsolicited ANNOUNCE
+// messages to, both via unicast and the all-hosts multicast group.
+//
+// See https://tools.ietf.org/html/rfc6887#section-14.1.2
+const DefaultAnnounceAddr = ":5350"
+
+var _ portmap.RestartNotifier = (*Client)(nil)
+
+// Restarts signals when the server is detected to have lost its state,
+// meaning all the mappings have to be recreated.
+func (c *Client) Restarts() <-chan struct{} {
+	return c.restarts
+}
+
+// Run listens for the unsolicited ANNOUNCE messages until the stopch is
+// closed, via the shared `Announces` listener if it's set.
+//
+// See https://tools.ietf.org/html/rfc6887#section-14.1.3
+func (c *Client) Run(stopch <-chan struct{}) error {
+	listener := c.Announces
+	if listener == nil {
+		listener = &AnnounceListener{Addr: c.AnnounceAddr}
+	}
+	return listener.Listen(c, stopch)
+}
+
+// AnnounceListener listens for the ANNOUNCE messages on behalf of several
+// Clients, since only one socket can receive them at the port. Every Client
+// gets all the messages, and only acts on the ones from its server.
+type AnnounceListener struct {
+	// If empty, `DefaultAnnounceAddr` is used.
+	Addr string
+
+	mu      sync.Mutex
+	clients map[*Client]struct{}
+	current *announceConn
+}
+
+// The socket is closed when the last Client stops listening, and opened
+// again when the next one starts.
+type announceConn struct {
+	conn net.PacketConn
+	done chan struct{}
+	// Why the socket failed, set before done is closed.
+	err error
+}
+
+// Listen hands the ANNOUNCE messages to the Client until the stopch is
+// closed, or the socket fails.
+func (l *AnnounceListener) Listen(c *Client, stopch <-chan struct{}) error {
+	ac, err := l.add(c)
+	if err != nil {
+		return err
+	}
+	defer l.remove(c)
+
+	select {
+	case <-stopch:
+		return nil
+	case <-ac.done:
+		return ac.err
+	}
+}
+
+func (l *AnnounceListener) add(c *Client) (*announceConn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.current == nil {
+		addr := l.Addr
+		if addr == "" {
+			addr = DefaultAnnounceAddr
+		}
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		l.current = &announceConn{conn: conn, done: make(chan struct{})}
+		go l.read(l.current)
+	}
+
+	if l.clients == nil {
+		l.clients = make(map[*Client]struct{})
+	}
+	l.clients[c] = struct{}{}
+	return l.current, nil
+}
+
+func (l *AnnounceListener) remove(c *Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.clients, c)
+	if len(l.clients) == 0 && l.current != nil {
+		l.current.conn.Close()
+		l.current = nil
+	}
+}
+
+func (l *AnnounceListener) read(ac *announceConn) {
+	defer close(ac.done)
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := ac.conn.ReadFrom(buf)
+		if err != nil {
+			l.mu.Lock()
+			// Otherwise the socket was closed as nobody listens anymore.
+			if l.current == ac {
+				ac.err = err
+				l.current = nil
+				ac.conn.Close()
+			}
+			l.mu.Unlock()
+			return
+		}
+
+		for _, c := range l.listeners() {
+			c.handleAnnounce(buf[:n], from)
+		}
+	}
+}
+
+func (l *AnnounceListener) listeners() []*Client {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	clients := make([]*Client, 0, len(l.clients))
+	for c := range l.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (c *Client) handleAnnounce(data []byte, from net.Addr) {
+	header, err := parseResponseHeader(data)
+	if err != nil || header.Opcode != opcodeAnnounce || header.ResultCode != ResultSuccess {
+		return
+	}
+
+	if !c.isServer(from) {
+		return
+	}
+
+	c.observeEpoch(header.Epoch)
+}
+
+func (c *Client) isServer(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	serverAddr, err := c.serverAddr()
+	if err != nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		return false
+	}
+
+	return udpAddr.IP.Equal(net.ParseIP(host))
+}
+
+func (c *Client) observeEpoch(epoch uint32) {
+	if !c.epoch.observe(epoch, time.Now()) {
+		return
+	}
+
+	select {
+	case c.restarts <- struct{}{}:
+	default:
+		// Already signaled.
+	}
+}
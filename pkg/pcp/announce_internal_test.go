@@ -0,0 +1,159 @@
+package pcp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func marshalAnnounce(epoch uint32) []byte {
+	buf := make([]byte, headerSize)
+	buf[0] = Version
+	buf[1] = responseBit | opcodeAnnounce
+	binary.BigEndian.PutUint32(buf[8:12], epoch)
+	return buf
+}
+
+var _ = Describe("ANNOUNCE handling", func() {
+	var (
+		client *Client
+		server *net.UDPAddr
+	)
+
+	BeforeEach(func() {
+		var err error
+		client, err = New("192.168.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		server = &net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: DefaultServerPort}
+
+		client.handleAnnounce(marshalAnnounce(100000), server)
+		Expect(client.Restarts()).NotTo(Receive())
+	})
+
+	It("should signal a restart when the epoch is reset", func() {
+		client.handleAnnounce(marshalAnnounce(5), server)
+		Expect(client.Restarts()).To(Receive())
+	})
+
+	It("should coalesce the restart signals", func() {
+		client.handleAnnounce(marshalAnnounce(5), server)
+		client.handleAnnounce(marshalAnnounce(1), server)
+		Expect(client.Restarts()).To(Receive())
+		Expect(client.Restarts()).NotTo(Receive())
+	})
+
+	It("should ignore the messages from other hosts", func() {
+		other := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: DefaultServerPort}
+		client.handleAnnounce(marshalAnnounce(5), other)
+		Expect(client.Restarts()).NotTo(Receive())
+	})
+
+	It("should ignore the malformed messages", func() {
+		client.handleAnnounce([]byte("garbage"), server)
+		client.handleAnnounce(marshalAnnounce(5)[:8], server)
+		Expect(client.Restarts()).NotTo(Receive())
+	})
+})
+
+var _ = Describe("ANNOUNCE listener", func() {
+	var (
+		listener *AnnounceListener
+		stopch   chan struct{}
+		runs     sync.WaitGroup
+	)
+
+	run := func(client *Client) {
+		runs.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			defer runs.Done()
+			Expect(client.Run(stopch)).To(Succeed())
+		}()
+	}
+
+	// Sends the ANNOUNCE from the address of the server.
+	announce := func(serverIP net.IP, epoch uint32) {
+		var addr net.Addr
+		Eventually(func() net.Addr {
+			listener.mu.Lock()
+			defer listener.mu.Unlock()
+			if listener.current == nil {
+				return nil
+			}
+			addr = listener.current.conn.LocalAddr()
+			return addr
+		}).ShouldNot(BeNil())
+
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: serverIP})
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.WriteTo(marshalAnnounce(epoch), &net.UDPAddr{
+			IP:   net.IPv4(127, 0, 0, 1),
+			Port: addr.(*net.UDPAddr).Port,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		listener = &AnnounceListener{Addr: "127.0.0.1:0"}
+		stopch = make(chan struct{})
+	})
+
+	AfterEach(func() {
+		close(stopch)
+		runs.Wait()
+	})
+
+	It("should let several clients listen at once", func() {
+		first, err := New("127.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		first.Announces = listener
+		second, err := New("127.0.0.2")
+		Expect(err).NotTo(HaveOccurred())
+		second.Announces = listener
+
+		run(first)
+		run(second)
+		Eventually(func() int {
+			listener.mu.Lock()
+			defer listener.mu.Unlock()
+			return len(listener.clients)
+		}).Should(Equal(2))
+
+		announce(net.IPv4(127, 0, 0, 1), 100000)
+		announce(net.IPv4(127, 0, 0, 2), 100000)
+		announce(net.IPv4(127, 0, 0, 2), 5)
+		Eventually(second.Restarts()).Should(Receive())
+		Consistently(first.Restarts(), 100*time.Millisecond).ShouldNot(Receive())
+
+		announce(net.IPv4(127, 0, 0, 1), 5)
+		Eventually(first.Restarts()).Should(Receive())
+	})
+
+	It("should close the socket when the last client stops", func() {
+		client, err := New("127.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		client.Announces = listener
+
+		clientStopch := make(chan struct{})
+		done := make(chan error)
+		go func() {
+			done <- client.Run(clientStopch)
+		}()
+		Eventually(func() *announceConn {
+			listener.mu.Lock()
+			defer listener.mu.Unlock()
+			return listener.current
+		}).ShouldNot(BeNil())
+
+		close(clientStopch)
+		Eventually(done).Should(Receive(BeNil()))
+		listener.mu.Lock()
+		defer listener.mu.Unlock()
+		Expect(listener.current).To(BeNil())
+	})
+})
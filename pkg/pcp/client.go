@@ -0,0 +1,253 @@
+package pcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/gateway"
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+)
+
+var (
+	ErrNoResponse = errors.New("no response from the PCP server")
+)
+
+const (
+	// DefaultTimeout is the maximum time spent on a single request,
+	// including retransmissions.
+	DefaultTimeout = 30 * time.Second
+
+	// See https://tools.ietf.org/html/rfc6887#section-8.1.1
+	maxRetransmissionTime = 1024 * time.Second
+
+	// See https://tools.ietf.org/html/rfc6887#section-7
+	maxPacketSize = 1100
+)
+
+// Used for mocks.
+var initialRetransmissionTime = 3 * time.Second
+
+type Client struct {
+	// If empty, the default gateway is used as the server.
+	// The port is optional and defaults to `DefaultServerPort`.
+	ServerAddr string
+
+	// If zero, `DefaultTimeout` is used.
+	Timeout time.Duration
+
+	// Where to listen for the ANNOUNCE messages.
+	// If empty, `DefaultAnnounceAddr` is used.
+	AnnounceAddr string
+
+	// The listener of the ANNOUNCE messages shared with the other Clients.
+	// If nil, the Client listens at `AnnounceAddr` on its own.
+	Announces *AnnounceListener
+
+	nonce    Nonce
+	epoch    epochTracker
+	restarts chan struct{}
+}
+
+var _ portmap.Mapper = (*Client)(nil)
+
+// New creates a client with a random nonce.
+// Use `NewWithNonceStore` to keep the mappings manageable across the restarts.
+func New(serverAddr string) (*Client, error) {
+	nonce, err := generateNonce()
+	if err != nil {
+		return nil, err
+	}
+	return newWithNonce(serverAddr, nonce), nil
+}
+
+func newWithNonce(serverAddr string, nonce Nonce) *Client {
+	return &Client{
+		ServerAddr: serverAddr,
+		nonce:      nonce,
+		restarts:   make(chan struct{}, 1),
+	}
+}
+
+func (c *Client) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	clientIP := conn.LocalAddr().(*net.UDPAddr).IP
+	mreq := &mapRequest{
+		Lifetime:              uint32(req.Lifetime),
+		ClientIP:              clientIP,
+		Nonce:                 c.nonce,
+		Protocol:              uint8(req.Protocol),
+		InternalPort:          uint16(req.NodePort),
+		SuggestedExternalPort: uint16(req.GatewayPort),
+		SuggestedExternalIP:   unspecifiedAddress(clientIP),
+	}
+	if req.InternalIP != nil && !req.InternalIP.Equal(clientIP) {
+		mreq.ThirdPartyIP = req.InternalIP
+	}
+
+	var mres *mapResponse
+	err = exchange(ctx, conn, mreq.marshal(), func(data []byte) (bool, error) {
+		res, perr := parseMapResponse(data)
+		if perr != nil {
+			if errors.Is(perr, ErrUnsupportedServer) {
+				return true, perr
+			}
+			// Not a valid response, keep waiting.
+			return false, nil
+		}
+		if !mreq.matches(res) {
+			// Response to some other request, keep waiting.
+			return false, nil
+		}
+		mres = res
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.observeEpoch(mres.Epoch)
+
+	if mres.ResultCode != ResultSuccess {
+		return nil, &ResultError{Code: mres.ResultCode, Lifetime: mres.Lifetime}
+	}
+
+	return &portmap.Response{
+		Protocol:    portmap.Protocol(mres.Protocol),
+		NodePort:    portmap.Port(mres.InternalPort),
+		GatewayPort: portmap.Port(mres.AssignedExternalPort),
+		GatewayIP:   mres.AssignedExternalIP,
+		Lifetime:    portmap.Lifetime(mres.Lifetime),
+	}, nil
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	addr, err := c.serverAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "udp", addr)
+}
+
+func (c *Client) serverAddr() (string, error) {
+	if c.ServerAddr == "" {
+		ip, err := gateway.Discover()
+		if err != nil {
+			return "", fmt.Errorf("unable to discover the PCP server: %w", err)
+		}
+		return net.JoinHostPort(ip.String(), strconv.Itoa(DefaultServerPort)), nil
+	}
+
+	if _, _, err := net.SplitHostPort(c.ServerAddr); err != nil {
+		return net.JoinHostPort(c.ServerAddr, strconv.Itoa(DefaultServerPort)), nil
+	}
+	return c.ServerAddr, nil
+}
+
+func (r *mapRequest) matches(res *mapResponse) bool {
+	return res.Nonce == r.Nonce &&
+		res.Protocol == r.Protocol &&
+		res.InternalPort == r.InternalPort
+}
+
+// Sends the packet and waits for the handler to accept a response,
+// retransmitting the packet as per https://tools.ietf.org/html/rfc6887#section-8.1.1
+func exchange(ctx context.Context, conn net.Conn, packet []byte, handle func([]byte) (bool, error)) error {
+	// Unblock the pending read when the context is done.
+	stopch := make(chan struct{})
+	defer close(stopch)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stopch:
+		}
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	var rt time.Duration
+
+	for {
+		if _, err := conn.Write(packet); err != nil {
+			return contextErr(ctx, err)
+		}
+
+		rt = nextRetransmissionTime(rt)
+		if err := conn.SetReadDeadline(time.Now().Add(rt)); err != nil {
+			return contextErr(ctx, err)
+		}
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var nerr net.Error
+				if errors.As(err, &nerr) && nerr.Timeout() && ctx.Err() == nil {
+					// Time to retransmit.
+					break
+				}
+				return contextErr(ctx, err)
+			}
+
+			if done, herr := handle(buf[:n]); done {
+				return herr
+			}
+		}
+	}
+}
+
+func contextErr(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case nil:
+		return err
+	case context.DeadlineExceeded:
+		return ErrNoResponse
+	default:
+		return ctx.Err()
+	}
+}
+
+// See https://tools.ietf.org/html/rfc6887#section-8.1.1
+func nextRetransmissionTime(prev time.Duration) time.Duration {
+	rt := withJitter(initialRetransmissionTime)
+	if prev != 0 {
+		rt = withJitter(2 * prev) // nolint: gomnd
+	}
+	if rt > maxRetransmissionTime {
+		rt = withJitter(maxRetransmissionTime)
+	}
+	return rt
+}
+
+// Applies the RAND factor in the range of [-0.1, +0.1].
+func withJitter(d time.Duration) time.Duration {
+	// nolint: gosec, gomnd
+	factor := 1 + (mathrand.Float64()*0.2 - 0.1)
+	return time.Duration(float64(d) * factor)
+}
+
+// The address that indicates no preference for the external address,
+// from the same family as the client address.
+func unspecifiedAddress(clientIP net.IP) net.IP {
+	if clientIP.To4() != nil {
+		return net.IPv4zero
+	}
+	return net.IPv6zero
+}
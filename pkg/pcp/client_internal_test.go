@@ -0,0 +1,246 @@
+package pcp
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Handles a single request packet and returns the packets to send back.
+type fakeServerHandler func(req []byte) [][]byte
+
+// Runs a fake PCP server on the loopback interface.
+func startFakeServer(handler fakeServerHandler) (addr string, stop func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	Expect(err).NotTo(HaveOccurred())
+
+	donech := make(chan struct{})
+	go func() {
+		defer close(donech)
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, from, rerr := conn.ReadFromUDP(buf)
+			if rerr != nil {
+				return
+			}
+			for _, packet := range handler(append([]byte(nil), buf[:n]...)) {
+				_, _ = conn.WriteToUDP(packet, from)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String(), func() {
+		conn.Close()
+		<-donech
+	}
+}
+
+// Responds as the real server would, echoing the request fields.
+func respondTo(req []byte, code ResultCode, externalPort uint16) []byte {
+	res := &mapResponse{
+		responseHeader: responseHeader{
+			ResultCode: code,
+			Lifetime:   120,
+			Epoch:      1000,
+		},
+		Protocol:             req[headerSize+12],
+		InternalPort:         uint16(req[headerSize+16])<<8 | uint16(req[headerSize+17]),
+		AssignedExternalPort: externalPort,
+		AssignedExternalIP:   net.IPv4(1, 2, 3, 4),
+	}
+	copy(res.Nonce[:], req[headerSize:headerSize+12])
+	return marshalMapResponse(res)
+}
+
+var _ = Describe("Client", func() {
+	var (
+		handler  fakeServerHandler
+		timeout  time.Duration
+		requests chan []byte
+		req      *portmap.Request
+		res      *portmap.Response
+		err      error
+	)
+
+	BeforeEach(func() {
+		initialRetransmissionTime = 10 * time.Millisecond
+		timeout = time.Second
+		requests = make(chan []byte, 100)
+		req = &portmap.Request{
+			Protocol:    portmap.ProtocolTCP,
+			NodePort:    portmap.Port(32100),
+			GatewayPort: portmap.Port(80),
+			Lifetime:    portmap.Lifetime(120),
+		}
+	})
+
+	AfterEach(func() {
+		initialRetransmissionTime = 3 * time.Second
+	})
+
+	JustBeforeEach(func() {
+		addr, stop := startFakeServer(func(packet []byte) [][]byte {
+			requests <- packet
+			return handler(packet)
+		})
+		defer stop()
+
+		client, newErr := New(addr)
+		Expect(newErr).NotTo(HaveOccurred())
+		client.Timeout = timeout
+
+		res, err = client.Map(context.Background(), req)
+	})
+
+	Context("with a server that accepts the mapping", func() {
+		BeforeEach(func() {
+			handler = func(packet []byte) [][]byte {
+				return [][]byte{respondTo(packet, ResultSuccess, 1024)}
+			}
+		})
+
+		It("should send a proper request", func() {
+			Expect(requests).To(HaveLen(1))
+			packet := <-requests
+			Expect(packet).To(HaveLen(headerSize + mapPayloadSize))
+			Expect(packet[0:2]).To(Equal([]byte{Version, opcodeMap}))
+			Expect(net.IP(packet[8:24])).To(Equal(net.IPv4(127, 0, 0, 1)))
+			Expect(packet[headerSize+12]).To(Equal(byte(portmap.ProtocolTCP)))
+			Expect(packet[headerSize+16 : headerSize+20]).To(Equal([]byte{0x7d, 0x64, 0, 80}))
+		})
+
+		It("should produce a correct response", func() {
+			Expect(err).To(BeNil())
+			Expect(res).To(Equal(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(1024),
+				GatewayIP:   net.IPv4(1, 2, 3, 4),
+				Lifetime:    portmap.Lifetime(120),
+			}))
+		})
+	})
+
+	Context("with the internal address of another host", func() {
+		BeforeEach(func() {
+			req.InternalIP = net.IPv4(192, 168, 0, 10)
+			handler = func(packet []byte) [][]byte {
+				return [][]byte{respondTo(packet, ResultSuccess, 80)}
+			}
+		})
+
+		It("should send the THIRD_PARTY option", func() {
+			Expect(err).To(BeNil())
+			packet := <-requests
+			Expect(packet).To(HaveLen(headerSize + mapPayloadSize + 20))
+			Expect(packet[headerSize+mapPayloadSize]).To(Equal(byte(optionThirdParty)))
+			Expect(net.IP(packet[headerSize+mapPayloadSize+4:])).To(Equal(net.IPv4(192, 168, 0, 10)))
+		})
+	})
+
+	Context("with the internal address of the client itself", func() {
+		BeforeEach(func() {
+			req.InternalIP = net.IPv4(127, 0, 0, 1)
+			handler = func(packet []byte) [][]byte {
+				return [][]byte{respondTo(packet, ResultSuccess, 80)}
+			}
+		})
+
+		It("should not send the THIRD_PARTY option", func() {
+			Expect(err).To(BeNil())
+			Expect(<-requests).To(HaveLen(headerSize + mapPayloadSize))
+		})
+	})
+
+	Context("with a server that rejects the mapping", func() {
+		BeforeEach(func() {
+			handler = func(packet []byte) [][]byte {
+				return [][]byte{respondTo(packet, ResultNotAuthorized, 0)}
+			}
+		})
+
+		It("should produce a result error", func() {
+			Expect(err).To(Equal(&ResultError{Code: ResultNotAuthorized, Lifetime: 120}))
+			Expect(err).To(MatchError("PCP server responded with NOT_AUTHORIZED (2)"))
+			Expect(res).To(BeNil())
+		})
+	})
+
+	Context("with a server that loses the first request", func() {
+		BeforeEach(func() {
+			seen := 0
+			handler = func(packet []byte) [][]byte {
+				seen++
+				if seen == 1 {
+					return nil
+				}
+				return [][]byte{respondTo(packet, ResultSuccess, 80)}
+			}
+		})
+
+		It("should retransmit the request", func() {
+			Expect(err).To(BeNil())
+			Expect(res.GatewayPort).To(Equal(portmap.Port(80)))
+			Expect(requests).To(HaveLen(2))
+		})
+	})
+
+	Context("with a server that sends unrelated responses first", func() {
+		BeforeEach(func() {
+			handler = func(packet []byte) [][]byte {
+				unrelated := respondTo(packet, ResultNotAuthorized, 0)
+				unrelated[headerSize] ^= 0xff // break the nonce
+				return [][]byte{[]byte("garbage"), unrelated, respondTo(packet, ResultSuccess, 80)}
+			}
+		})
+
+		It("should skip them", func() {
+			Expect(err).To(BeNil())
+			Expect(res.GatewayPort).To(Equal(portmap.Port(80)))
+		})
+	})
+
+	Context("with a NAT-PMP server", func() {
+		BeforeEach(func() {
+			handler = func(packet []byte) [][]byte {
+				return [][]byte{{0, 0x81, 0, 1, 0, 0, 0, 0}}
+			}
+		})
+
+		It("should produce an expected error", func() {
+			Expect(err).To(BeIdenticalTo(ErrUnsupportedServer))
+			Expect(res).To(BeNil())
+		})
+	})
+
+	Context("with a server that never responds", func() {
+		BeforeEach(func() {
+			timeout = 100 * time.Millisecond
+			handler = func(packet []byte) [][]byte {
+				return nil
+			}
+		})
+
+		It("should produce an expected error", func() {
+			Expect(err).To(MatchError(ErrNoResponse))
+			Expect(res).To(BeNil())
+			Expect(len(requests)).To(BeNumerically(">", 1))
+		})
+	})
+})
+
+var _ = Describe("nextRetransmissionTime", func() {
+	It("should follow the RFC 6887 schedule", func() {
+		rt := nextRetransmissionTime(0)
+		Expect(rt).To(BeNumerically("~", initialRetransmissionTime, initialRetransmissionTime/10))
+
+		next := nextRetransmissionTime(rt)
+		Expect(next).To(BeNumerically("~", 2*rt, 2*rt/10))
+
+		Expect(nextRetransmissionTime(maxRetransmissionTime)).To(BeNumerically("~", maxRetransmissionTime, maxRetransmissionTime/10))
+	})
+})
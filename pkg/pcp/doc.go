@@ -0,0 +1,6 @@
+// Native Port Control Protocol client implementing the MAP opcode as
+// a `portmap.Mapper`.
+//
+// Ref: https://tools.ietf.org/html/rfc6887
+
+package pcp
@@ -0,0 +1,45 @@
+package pcp
+
+import (
+	"sync"
+	"time"
+)
+
+// Tracks the server epoch to detect the server losing its state,
+// as per https://tools.ietf.org/html/rfc6887#section-8.5
+type epochTracker struct {
+	mu sync.Mutex
+
+	valid           bool
+	prevServerEpoch uint32
+	prevClientTime  time.Time
+}
+
+// Records the server epoch observed at the given client time and reports
+// whether the server has lost its state since the previous observation.
+func (t *epochTracker) observe(serverEpoch uint32, clientTime time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	defer func() {
+		t.valid = true
+		t.prevServerEpoch = serverEpoch
+		t.prevClientTime = clientTime
+	}()
+
+	if !t.valid {
+		return false
+	}
+
+	// Allow for one second of skew caused by the packets reordering.
+	if serverEpoch+1 < t.prevServerEpoch {
+		return true
+	}
+
+	clientDelta := int64(clientTime.Sub(t.prevClientTime) / time.Second)
+	serverDelta := int64(serverEpoch) - int64(t.prevServerEpoch)
+
+	// nolint: gomnd
+	return clientDelta+2 < serverDelta-serverDelta/16 ||
+		serverDelta+2 < clientDelta-clientDelta/16
+}
@@ -0,0 +1,47 @@
+package pcp
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("epochTracker", func() {
+	var (
+		tracker *epochTracker
+		start   time.Time
+	)
+
+	BeforeEach(func() {
+		tracker = &epochTracker{}
+		start = time.Now()
+		Expect(tracker.observe(1000, start)).To(BeFalse())
+	})
+
+	It("should accept the epoch advancing with the client clock", func() {
+		Expect(tracker.observe(1060, start.Add(60*time.Second))).To(BeFalse())
+		Expect(tracker.observe(1121, start.Add(120*time.Second))).To(BeFalse())
+	})
+
+	It("should tolerate the packet reordering", func() {
+		Expect(tracker.observe(999, start)).To(BeFalse())
+	})
+
+	It("should detect the epoch going back", func() {
+		Expect(tracker.observe(5, start.Add(60*time.Second))).To(BeTrue())
+	})
+
+	It("should detect the epoch lagging behind the client clock", func() {
+		Expect(tracker.observe(1010, start.Add(600*time.Second))).To(BeTrue())
+	})
+
+	It("should detect the epoch running ahead of the client clock", func() {
+		Expect(tracker.observe(2000, start.Add(60*time.Second))).To(BeTrue())
+	})
+
+	It("should compare with the latest observation", func() {
+		Expect(tracker.observe(5, start.Add(60*time.Second))).To(BeTrue())
+		Expect(tracker.observe(65, start.Add(120*time.Second))).To(BeFalse())
+	})
+})
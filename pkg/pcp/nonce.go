@@ -0,0 +1,51 @@
+package pcp
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+)
+
+// NonceStore persists the nonce across the restarts.
+//
+// The PCP server only lets the owner of a mapping renew or delete it,
+// and the owner is identified by the nonce.
+// See https://tools.ietf.org/html/rfc6887#section-11.1
+type NonceStore interface {
+	// LoadNonce returns nil if there is no nonce stored yet.
+	LoadNonce(ctx context.Context) (*Nonce, error)
+	// SaveNonce returns the nonce stored, which is not the one passed
+	// if another instance has stored its own in the meantime.
+	SaveNonce(ctx context.Context, nonce Nonce) (Nonce, error)
+}
+
+// NewWithNonceStore creates a client that reuses the nonce from the store,
+// or generates a new one and saves it there.
+func NewWithNonceStore(ctx context.Context, serverAddr string, store NonceStore) (*Client, error) {
+	nonce, err := store.LoadNonce(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the mapping nonce: %w", err)
+	}
+
+	if nonce == nil {
+		generated, err := generateNonce()
+		if err != nil {
+			return nil, err
+		}
+		saved, err := store.SaveNonce(ctx, generated)
+		if err != nil {
+			return nil, fmt.Errorf("unable to save the mapping nonce: %w", err)
+		}
+		nonce = &saved
+	}
+
+	return newWithNonce(serverAddr, *nonce), nil
+}
+
+func generateNonce() (Nonce, error) {
+	var nonce Nonce
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nonce, fmt.Errorf("unable to generate the mapping nonce: %w", err)
+	}
+	return nonce, nil
+}
@@ -0,0 +1,77 @@
+package pcp
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type memoryNonceStore struct {
+	nonce   *Nonce
+	saves   int
+	loadErr error
+
+	// Stored by another instance between the load and the save, if set.
+	raced *Nonce
+}
+
+func (s *memoryNonceStore) LoadNonce(_ context.Context) (*Nonce, error) {
+	return s.nonce, s.loadErr
+}
+
+func (s *memoryNonceStore) SaveNonce(_ context.Context, nonce Nonce) (Nonce, error) {
+	s.saves++
+	if s.raced != nil {
+		s.nonce = s.raced
+		return *s.raced, nil
+	}
+	s.nonce = &nonce
+	return nonce, nil
+}
+
+var _ = Describe("NewWithNonceStore", func() {
+	var store *memoryNonceStore
+
+	BeforeEach(func() {
+		store = &memoryNonceStore{}
+	})
+
+	It("should generate and save the nonce when there is none", func() {
+		client, err := NewWithNonceStore(context.Background(), "", store)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.saves).To(Equal(1))
+		Expect(store.nonce).NotTo(BeNil())
+		Expect(client.nonce).To(Equal(*store.nonce))
+		Expect(client.nonce).NotTo(Equal(Nonce{}))
+	})
+
+	It("should reuse the stored nonce", func() {
+		nonce := sampleNonce
+		store.nonce = &nonce
+
+		client, err := NewWithNonceStore(context.Background(), "", store)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.saves).To(Equal(0))
+		Expect(client.nonce).To(Equal(sampleNonce))
+	})
+
+	It("should adopt the nonce another instance has stored meanwhile", func() {
+		nonce := sampleNonce
+		store.raced = &nonce
+
+		client, err := NewWithNonceStore(context.Background(), "", store)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.nonce).To(Equal(sampleNonce))
+	})
+
+	It("should fail when the store fails", func() {
+		storeErr := errors.New("store error") // nolint: goerr113
+		store.loadErr = storeErr
+
+		client, err := NewWithNonceStore(context.Background(), "", store)
+		Expect(err).To(MatchError(storeErr))
+		Expect(client).To(BeNil())
+	})
+})
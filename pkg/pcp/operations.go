@@ -0,0 +1,39 @@
+package pcp
+
+import (
+	"context"
+	"net"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+)
+
+// Unmap deletes the mapping of the node port with a zero lifetime MAP
+// request. Deleting a mapping that is already gone succeeds.
+//
+// See https://tools.ietf.org/html/rfc6887#section-15
+func (c *Client) Unmap(ctx context.Context, req *portmap.Request) error {
+	delreq := *req
+	delreq.Lifetime = portmap.LifetimeDelete
+	_, err := c.Map(ctx, &delreq)
+	return err
+}
+
+// ListMappings is not supported, PCP can't list the mappings.
+func (c *Client) ListMappings(ctx context.Context) ([]portmap.Mapping, error) {
+	return nil, portmap.ErrUnsupported
+}
+
+// ExternalAddress is not supported, PCP only reports the external address
+// in the responses to the MAP requests.
+func (c *Client) ExternalAddress(ctx context.Context) (net.IP, error) {
+	return nil, portmap.ErrUnsupported
+}
+
+// Capabilities of PCP.
+func (c *Client) Capabilities() portmap.Capabilities {
+	return portmap.Capabilities{
+		Protocols:  []portmap.Protocol{portmap.ProtocolTCP, portmap.ProtocolUDP, portmap.ProtocolSCTP},
+		ThirdParty: true,
+		PortAny:    true,
+	}
+}
@@ -0,0 +1,66 @@
+package pcp
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+)
+
+var _ portmap.Prober = (*Client)(nil)
+
+// Probe sends an ANNOUNCE request to learn the server epoch.
+// PCP doesn't report the external address without mapping a port.
+//
+// See https://tools.ietf.org/html/rfc6887#section-14.1
+func (c *Client) Probe(ctx context.Context) (*portmap.GatewayInfo, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	clientIP := conn.LocalAddr().(*net.UDPAddr).IP
+
+	var header *responseHeader
+	err = exchange(ctx, conn, marshalAnnounceRequest(clientIP), func(data []byte) (bool, error) {
+		res, perr := parseResponseHeader(data)
+		if perr != nil {
+			if errors.Is(perr, ErrUnsupportedServer) {
+				return true, perr
+			}
+			// Not a valid response, keep waiting.
+			return false, nil
+		}
+		if res.Opcode != opcodeAnnounce {
+			// Response to some other request, keep waiting.
+			return false, nil
+		}
+		header = res
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.observeEpoch(header.Epoch)
+
+	if header.ResultCode != ResultSuccess {
+		return nil, &ResultError{Code: header.ResultCode}
+	}
+
+	epoch := header.Epoch
+	return &portmap.GatewayInfo{
+		Epoch: &epoch,
+		// PCP maps the ports of any protocol, but the Services only have these.
+		Protocols: []portmap.Protocol{portmap.ProtocolTCP, portmap.ProtocolUDP, portmap.ProtocolSCTP},
+	}, nil
+}
@@ -0,0 +1,92 @@
+package pcp
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client.Probe", func() {
+	var (
+		handler  fakeServerHandler
+		requests chan []byte
+		info     *portmap.GatewayInfo
+		err      error
+	)
+
+	BeforeEach(func() {
+		initialRetransmissionTime = 10 * time.Millisecond
+		requests = make(chan []byte, 100)
+	})
+
+	AfterEach(func() {
+		initialRetransmissionTime = 3 * time.Second
+	})
+
+	JustBeforeEach(func() {
+		addr, stop := startFakeServer(func(packet []byte) [][]byte {
+			requests <- packet
+			return handler(packet)
+		})
+		defer stop()
+
+		client, newErr := New(addr)
+		Expect(newErr).NotTo(HaveOccurred())
+		client.Timeout = time.Second
+
+		info, err = client.Probe(context.Background())
+	})
+
+	Context("with a server that responds", func() {
+		BeforeEach(func() {
+			handler = func(packet []byte) [][]byte {
+				return [][]byte{marshalAnnounce(1000)}
+			}
+		})
+
+		It("should send an ANNOUNCE request", func() {
+			Expect(requests).To(HaveLen(1))
+			packet := <-requests
+			Expect(packet).To(HaveLen(headerSize))
+			Expect(packet[0:2]).To(Equal([]byte{Version, opcodeAnnounce}))
+			Expect(net.IP(packet[8:24])).To(Equal(net.IPv4(127, 0, 0, 1)))
+		})
+
+		It("should report the epoch", func() {
+			Expect(err).To(BeNil())
+			Expect(info.Epoch).NotTo(BeNil())
+			Expect(*info.Epoch).To(Equal(uint32(1000)))
+			Expect(info.ExternalIP).To(BeNil())
+		})
+	})
+
+	Context("with a server that sends the MAP responses", func() {
+		BeforeEach(func() {
+			handler = func(packet []byte) [][]byte {
+				return [][]byte{marshalMapResponse(&mapResponse{}), marshalAnnounce(1000)}
+			}
+		})
+
+		It("should skip them", func() {
+			Expect(err).To(BeNil())
+			Expect(*info.Epoch).To(Equal(uint32(1000)))
+		})
+	})
+
+	Context("with a NAT-PMP server", func() {
+		BeforeEach(func() {
+			handler = func(packet []byte) [][]byte {
+				return [][]byte{{0, 128, 0, 1}}
+			}
+		})
+
+		It("should produce an expected error", func() {
+			Expect(err).To(MatchError(ErrUnsupportedServer))
+			Expect(info).To(BeNil())
+		})
+	})
+})
@@ -0,0 +1,183 @@
+package pcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+var (
+	ErrShortPacket       = errors.New("packet is too short")
+	ErrNotResponse       = errors.New("packet is not a response")
+	ErrUnexpectedOpcode  = errors.New("unexpected opcode")
+	ErrUnsupportedServer = &ResultError{Code: ResultUnsuppVersion}
+)
+
+const (
+	// Version of the protocol implemented by this package.
+	Version = 2
+
+	// DefaultServerPort is the port PCP servers listen on.
+	DefaultServerPort = 5351
+)
+
+const (
+	opcodeAnnounce = 0
+	opcodeMap      = 1
+
+	responseBit = 0x80
+	opcodeMask  = 0x7f
+
+	headerSize       = 24
+	mapPayloadSize   = 36
+	nonceSize        = 12
+	optionHeaderSize = 4
+)
+
+// See https://tools.ietf.org/html/rfc6887#section-13
+const (
+	optionThirdParty = 1
+)
+
+// Nonce identifies the mapping owner.
+//
+// See https://tools.ietf.org/html/rfc6887#section-11.1
+type Nonce [nonceSize]byte
+
+type mapRequest struct {
+	Lifetime              uint32
+	ClientIP              net.IP
+	Nonce                 Nonce
+	Protocol              uint8
+	InternalPort          uint16
+	SuggestedExternalPort uint16
+	SuggestedExternalIP   net.IP
+
+	// If set, the THIRD_PARTY option is sent to map the port to
+	// this address instead of the client address.
+	ThirdPartyIP net.IP
+}
+
+// See https://tools.ietf.org/html/rfc6887#section-7.1
+// and https://tools.ietf.org/html/rfc6887#section-11.1
+func (r *mapRequest) marshal() []byte {
+	size := headerSize + mapPayloadSize
+	if r.ThirdPartyIP != nil {
+		size += optionHeaderSize + net.IPv6len
+	}
+	buf := make([]byte, size)
+
+	buf[0] = Version
+	buf[1] = opcodeMap
+	binary.BigEndian.PutUint32(buf[4:8], r.Lifetime)
+	copy(buf[8:24], ipTo16(r.ClientIP))
+
+	payload := buf[headerSize:]
+	copy(payload[0:12], r.Nonce[:])
+	payload[12] = r.Protocol
+	binary.BigEndian.PutUint16(payload[16:18], r.InternalPort)
+	binary.BigEndian.PutUint16(payload[18:20], r.SuggestedExternalPort)
+	copy(payload[20:36], ipTo16(r.SuggestedExternalIP))
+
+	// See https://tools.ietf.org/html/rfc6887#section-13.1
+	if r.ThirdPartyIP != nil {
+		option := payload[mapPayloadSize:]
+		option[0] = optionThirdParty
+		binary.BigEndian.PutUint16(option[2:4], net.IPv6len)
+		copy(option[4:20], ipTo16(r.ThirdPartyIP))
+	}
+
+	return buf
+}
+
+// See https://tools.ietf.org/html/rfc6887#section-14.1
+func marshalAnnounceRequest(clientIP net.IP) []byte {
+	buf := make([]byte, headerSize)
+	buf[0] = Version
+	buf[1] = opcodeAnnounce
+	copy(buf[8:24], ipTo16(clientIP))
+	return buf
+}
+
+type responseHeader struct {
+	Opcode     uint8
+	ResultCode ResultCode
+	Lifetime   uint32
+	Epoch      uint32
+}
+
+type mapResponse struct {
+	responseHeader
+
+	Nonce                Nonce
+	Protocol             uint8
+	InternalPort         uint16
+	AssignedExternalPort uint16
+	AssignedExternalIP   net.IP
+}
+
+// See https://tools.ietf.org/html/rfc6887#section-7.2
+func parseResponseHeader(data []byte) (*responseHeader, error) {
+	if len(data) < 4 { // nolint: gomnd
+		return nil, ErrShortPacket
+	}
+
+	if data[1]&responseBit == 0 {
+		return nil, ErrNotResponse
+	}
+
+	// Servers that do not support our version (including NAT-PMP servers)
+	// respond with the version they do support, and we don't know
+	// the layout of the rest of the packet.
+	if data[0] != Version {
+		return nil, ErrUnsupportedServer
+	}
+
+	if len(data) < headerSize {
+		return nil, ErrShortPacket
+	}
+
+	return &responseHeader{
+		Opcode:     data[1] & opcodeMask,
+		ResultCode: ResultCode(data[3]),
+		Lifetime:   binary.BigEndian.Uint32(data[4:8]),
+		Epoch:      binary.BigEndian.Uint32(data[8:12]),
+	}, nil
+}
+
+// See https://tools.ietf.org/html/rfc6887#section-11.1
+func parseMapResponse(data []byte) (*mapResponse, error) {
+	header, err := parseResponseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Opcode != opcodeMap {
+		return nil, ErrUnexpectedOpcode
+	}
+
+	if len(data) < headerSize+mapPayloadSize {
+		return nil, ErrShortPacket
+	}
+
+	payload := data[headerSize:]
+	res := &mapResponse{
+		responseHeader:       *header,
+		Protocol:             payload[12],
+		InternalPort:         binary.BigEndian.Uint16(payload[16:18]),
+		AssignedExternalPort: binary.BigEndian.Uint16(payload[18:20]),
+		AssignedExternalIP:   append(net.IP(nil), payload[20:36]...),
+	}
+	copy(res.Nonce[:], payload[0:12])
+
+	return res, nil
+}
+
+// PCP always uses 128-bit addresses, with IPv4 addresses represented as
+// IPv4-mapped IPv6 addresses.
+func ipTo16(ip net.IP) net.IP {
+	if ip16 := ip.To16(); ip16 != nil {
+		return ip16
+	}
+	return net.IPv6zero
+}
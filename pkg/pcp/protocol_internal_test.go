@@ -0,0 +1,150 @@
+package pcp
+
+import (
+	"encoding/binary"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var sampleNonce = Nonce{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+// Builds a MAP response the way a PCP server would.
+func marshalMapResponse(res *mapResponse) []byte {
+	buf := make([]byte, headerSize+mapPayloadSize)
+
+	buf[0] = Version
+	buf[1] = responseBit | opcodeMap
+	buf[3] = byte(res.ResultCode)
+	binary.BigEndian.PutUint32(buf[4:8], res.Lifetime)
+	binary.BigEndian.PutUint32(buf[8:12], res.Epoch)
+
+	payload := buf[headerSize:]
+	copy(payload[0:12], res.Nonce[:])
+	payload[12] = res.Protocol
+	binary.BigEndian.PutUint16(payload[16:18], res.InternalPort)
+	binary.BigEndian.PutUint16(payload[18:20], res.AssignedExternalPort)
+	copy(payload[20:36], ipTo16(res.AssignedExternalIP))
+
+	return buf
+}
+
+var _ = Describe("mapRequest", func() {
+	It("should marshal properly", func() {
+		req := &mapRequest{
+			Lifetime:              120,
+			ClientIP:              net.IPv4(192, 168, 0, 2),
+			Nonce:                 sampleNonce,
+			Protocol:              6,
+			InternalPort:          32100,
+			SuggestedExternalPort: 80,
+			SuggestedExternalIP:   net.IPv4zero,
+		}
+
+		Expect(req.marshal()).To(Equal([]byte{
+			// Header.
+			2, 1, 0, 0,
+			0, 0, 0, 120,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 168, 0, 2,
+			// MAP opcode.
+			1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12,
+			6, 0, 0, 0,
+			0x7d, 0x64, 0, 80,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0, 0, 0, 0,
+		}))
+	})
+
+	It("should append the THIRD_PARTY option", func() {
+		req := &mapRequest{
+			ClientIP:     net.IPv4(192, 168, 0, 2),
+			ThirdPartyIP: net.IPv4(192, 168, 0, 10),
+		}
+
+		data := req.marshal()
+		Expect(data).To(HaveLen(headerSize + mapPayloadSize + 20))
+		Expect(data[headerSize+mapPayloadSize:]).To(Equal([]byte{
+			1, 0, 0, 16,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 168, 0, 10,
+		}))
+	})
+})
+
+var _ = Describe("parseMapResponse", func() {
+	var (
+		data []byte
+		res  *mapResponse
+		err  error
+	)
+
+	JustBeforeEach(func() {
+		res, err = parseMapResponse(data)
+	})
+
+	Context("with a valid response", func() {
+		BeforeEach(func() {
+			data = marshalMapResponse(&mapResponse{
+				responseHeader: responseHeader{
+					ResultCode: ResultSuccess,
+					Lifetime:   120,
+					Epoch:      2228596,
+				},
+				Nonce:                sampleNonce,
+				Protocol:             6,
+				InternalPort:         32100,
+				AssignedExternalPort: 1024,
+				AssignedExternalIP:   net.IPv4(1, 2, 3, 4),
+			})
+		})
+
+		It("should parse properly", func() {
+			Expect(err).To(BeNil())
+			Expect(res).To(Equal(&mapResponse{
+				responseHeader: responseHeader{
+					Opcode:     opcodeMap,
+					ResultCode: ResultSuccess,
+					Lifetime:   120,
+					Epoch:      2228596,
+				},
+				Nonce:                sampleNonce,
+				Protocol:             6,
+				InternalPort:         32100,
+				AssignedExternalPort: 1024,
+				AssignedExternalIP:   net.IPv4(1, 2, 3, 4),
+			}))
+		})
+	})
+
+	Context("with a truncated response", func() {
+		BeforeEach(func() {
+			data = marshalMapResponse(&mapResponse{})[:headerSize+4]
+		})
+
+		It("should produce an expected error", func() {
+			Expect(err).To(MatchError(ErrShortPacket))
+			Expect(res).To(BeNil())
+		})
+	})
+
+	Context("with a request instead of a response", func() {
+		BeforeEach(func() {
+			data = (&mapRequest{}).marshal()
+		})
+
+		It("should produce an expected error", func() {
+			Expect(err).To(MatchError(ErrNotResponse))
+			Expect(res).To(BeNil())
+		})
+	})
+
+	Context("with a NAT-PMP unsupported version response", func() {
+		BeforeEach(func() {
+			data = []byte{0, 0x81, 0, 1, 0, 0, 0, 0}
+		})
+
+		It("should produce an expected error", func() {
+			Expect(err).To(BeIdenticalTo(ErrUnsupportedServer))
+			Expect(res).To(BeNil())
+		})
+	})
+})
@@ -0,0 +1,64 @@
+package pcp
+
+import "fmt"
+
+// ResultCode of the PCP response.
+//
+// See https://tools.ietf.org/html/rfc6887#section-7.4
+type ResultCode uint8
+
+const (
+	ResultSuccess               ResultCode = 0
+	ResultUnsuppVersion         ResultCode = 1
+	ResultNotAuthorized         ResultCode = 2
+	ResultMalformedRequest      ResultCode = 3
+	ResultUnsuppOpcode          ResultCode = 4
+	ResultUnsuppOption          ResultCode = 5
+	ResultMalformedOption       ResultCode = 6
+	ResultNetworkFailure        ResultCode = 7
+	ResultNoResources           ResultCode = 8
+	ResultUnsuppProtocol        ResultCode = 9
+	ResultUserExQuota           ResultCode = 10
+	ResultCannotProvideExternal ResultCode = 11
+	ResultAddressMismatch       ResultCode = 12
+	ResultExcessiveRemotePeers  ResultCode = 13
+)
+
+var resultCodeNames = map[ResultCode]string{
+	ResultSuccess:               "SUCCESS",
+	ResultUnsuppVersion:         "UNSUPP_VERSION",
+	ResultNotAuthorized:         "NOT_AUTHORIZED",
+	ResultMalformedRequest:      "MALFORMED_REQUEST",
+	ResultUnsuppOpcode:          "UNSUPP_OPCODE",
+	ResultUnsuppOption:          "UNSUPP_OPTION",
+	ResultMalformedOption:       "MALFORMED_OPTION",
+	ResultNetworkFailure:        "NETWORK_FAILURE",
+	ResultNoResources:           "NO_RESOURCES",
+	ResultUnsuppProtocol:        "UNSUPP_PROTOCOL",
+	ResultUserExQuota:           "USER_EX_QUOTA",
+	ResultCannotProvideExternal: "CANNOT_PROVIDE_EXTERNAL",
+	ResultAddressMismatch:       "ADDRESS_MISMATCH",
+	ResultExcessiveRemotePeers:  "EXCESSIVE_REMOTE_PEERS",
+}
+
+func (c ResultCode) String() string {
+	if name, ok := resultCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_%d", uint8(c))
+}
+
+// ResultError is returned when the PCP server responds with a non-success
+// result code.
+type ResultError struct {
+	Code ResultCode
+
+	// How long, in seconds, the error is expected to persist.
+	Lifetime uint32
+}
+
+var _ error = (*ResultError)(nil)
+
+func (e *ResultError) Error() string {
+	return fmt.Sprintf("PCP server responded with %s (%d)", e.Code, uint8(e.Code))
+}
@@ -4,86 +4,72 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"os/exec"
 
 	"github.com/MOZGIII/port-map-operator/pkg/portmap"
 )
 
 var (
-	ErrResponseChannelClosed = errors.New("response channel closed")
+	ErrUnsupportedInternalIP = errors.New("PCP CLI can only map ports to the host it runs at")
 )
 
+// PCP runs the CLI for every request as it comes. Wrap it in
+// a `workpool.Mapper` to limit how many of them run at once.
 type PCP struct {
-	control chan opReq
-	cmd     *Command
+	cmd *Command
 }
 
-var _ portmap.Mapper = (*PCP)(nil)
+var _ portmap.BasicMapper = (*PCP)(nil)
+
+// Capabilities of the PCP CLI, to adapt the PCP to `portmap.Mapper` with.
+var Capabilities = portmap.Capabilities{
+	Protocols: []portmap.Protocol{portmap.ProtocolTCP, portmap.ProtocolUDP, portmap.ProtocolSCTP},
+	PortAny:   true,
+}
 
 func New(cmd *Command) *PCP {
 	return &PCP{
-		control: make(chan opReq),
-		cmd:     cmd,
+		cmd: cmd,
 	}
 }
 
-type opRes struct {
-	Response *portmap.Response
-	Error    error
-}
-
-type opReq struct {
-	Request    *portmap.Request
-	Context    context.Context
-	ResponseCh chan<- *opRes
-}
+// Map runs the CLI for the request until it's done or the context is.
+func (p *PCP) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
+	if req.InternalIP != nil {
+		local, err := isHostAddress(req.InternalIP)
+		if err != nil {
+			return nil, err
+		}
+		if !local {
+			return nil, ErrUnsupportedInternalIP
+		}
+	}
 
-func (p *PCP) Run(stopch <-chan struct{}) error {
-	for {
-		select {
-		case <-stopch:
-			close(p.control)
-			return nil
-		case req := <-p.control:
-			res, err := p.cmd.Exec(req.Context, req.Request)
-			if req.Context.Err() != nil {
-				// Context has expired, this means we are no longer interested
-				// in the response, and the response channel should've been
-				// closed.
-				continue
-			}
-			if err != nil {
-				if eerr, ok := err.(*exec.ExitError); ok {
-					req.ResponseCh <- &opRes{Error: fmt.Errorf("PCP CLI failed: %w: %s", eerr, string(eerr.Stderr))}
-				} else {
-					req.ResponseCh <- &opRes{Error: fmt.Errorf("internal PCP error: %w", err)}
-				}
-				continue
-			}
-			req.ResponseCh <- &opRes{Response: res}
+	res, err := p.cmd.Exec(ctx, req)
+	if err != nil {
+		if eerr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("PCP CLI failed: %w: %s", eerr, string(eerr.Stderr))
 		}
+		return nil, fmt.Errorf("internal PCP error: %w", err)
 	}
+	return res, nil
 }
 
-func (p *PCP) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
-	resCh := make(chan *opRes)
-	defer close(resCh)
+// Overridden in the tests.
+var interfaceAddrs = net.InterfaceAddrs
 
-	p.control <- opReq{
-		Context:    ctx,
-		Request:    req,
-		ResponseCh: resCh,
+// Whether the address is one of the host the CLI runs at, which is
+// the one the CLI maps the ports to.
+func isHostAddress(ip net.IP) (bool, error) {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return false, fmt.Errorf("unable to list the host addresses: %w", err)
 	}
-
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case res := <-resCh:
-		if res == nil {
-			// Should not happen, but in case channel was closed without
-			// sending a value - return an error.
-			return nil, ErrResponseChannelClosed
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true, nil
 		}
-		return res.Response, res.Error
 	}
+	return false, nil
 }
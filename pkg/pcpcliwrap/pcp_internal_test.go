@@ -20,21 +20,7 @@ var _ = Describe("PCP", func() {
 	)
 
 	JustBeforeEach(func() {
-		pcp := New(cmd)
-		stopch := make(chan struct{})
-		donech := make(chan struct{})
-
-		go func() {
-			if runerr := pcp.Run(stopch); runerr != nil {
-				Expect(runerr).To(BeNil())
-			}
-			close(donech)
-		}()
-
-		res, err = pcp.Map(context.Background(), req)
-
-		close(stopch)
-		<-donech
+		res, err = New(cmd).Map(context.Background(), req)
 	})
 
 	Context("with a pcp cli simulator", func() {
@@ -80,4 +66,53 @@ var _ = Describe("PCP", func() {
 			Expect(exitErr.Stderr).To(Equal([]byte("Important message\n")))
 		})
 	})
+
+	Context("with the address of another host", func() {
+		BeforeEach(func() {
+			cmd = &Command{
+				CommandName: "testdata/pcpsimulator.sh",
+				ServerAddr:  "127.0.0.1:5351",
+			}
+			req = &portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(80),
+				InternalIP:  net.IPv4(192, 0, 2, 1),
+				Lifetime:    portmap.Lifetime(120),
+			}
+		})
+
+		It("should refuse to map the port", func() {
+			Expect(err).To(MatchError(ErrUnsupportedInternalIP))
+			Expect(res).To(BeNil())
+		})
+	})
+
+	Context("with the address of the host", func() {
+		BeforeEach(func() {
+			interfaceAddrs = func() ([]net.Addr, error) {
+				return []net.Addr{&net.IPNet{IP: net.IPv4(192, 168, 0, 2), Mask: net.CIDRMask(24, 32)}}, nil
+			}
+			cmd = &Command{
+				CommandName: "testdata/pcpsimulator.sh",
+				ServerAddr:  "127.0.0.1:5351",
+			}
+			req = &portmap.Request{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(80),
+				InternalIP:  net.IPv4(192, 168, 0, 2),
+				Lifetime:    portmap.Lifetime(120),
+			}
+		})
+
+		AfterEach(func() {
+			interfaceAddrs = net.InterfaceAddrs
+		})
+
+		It("should map the port", func() {
+			Expect(err).To(BeNil())
+			Expect(res.GatewayPort).To(Equal(portmap.Port(1024)))
+		})
+	})
 })
@@ -26,7 +26,7 @@ type MockMapper struct {
 	res <-chan ResponseWrap
 }
 
-var _ portmap.Mapper = (*MockMapper)(nil)
+var _ portmap.BasicMapper = (*MockMapper)(nil)
 
 func New() (*MockMapper, *Control) {
 	req := make(chan RequestWrap)
@@ -0,0 +1,51 @@
+package portmap
+
+import (
+	"context"
+	"net"
+)
+
+// Adapt returns the Mapper doing the operations the basic mapper lacks
+// the way it's always been done, deleting the mappings with `LifetimeDelete`.
+// The other operations are unsupported. The Mappers are returned as they are.
+//
+// The optional interfaces, such as `RestartNotifier`, are not kept, so
+// the basic mappers implementing them have to be adapted by hand.
+func Adapt(basic BasicMapper, capabilities Capabilities) Mapper {
+	if mapper, ok := basic.(Mapper); ok {
+		return mapper
+	}
+	capabilities.ListMappings = false
+	capabilities.ExternalAddress = false
+	return &adapter{basic: basic, capabilities: capabilities}
+}
+
+type adapter struct {
+	basic        BasicMapper
+	capabilities Capabilities
+}
+
+var _ Mapper = (*adapter)(nil)
+
+func (a *adapter) Map(ctx context.Context, req *Request) (*Response, error) {
+	return a.basic.Map(ctx, req)
+}
+
+func (a *adapter) Unmap(ctx context.Context, req *Request) error {
+	delreq := *req
+	delreq.Lifetime = LifetimeDelete
+	_, err := a.basic.Map(ctx, &delreq)
+	return err
+}
+
+func (a *adapter) ListMappings(ctx context.Context) ([]Mapping, error) {
+	return nil, ErrUnsupported
+}
+
+func (a *adapter) ExternalAddress(ctx context.Context) (net.IP, error) {
+	return nil, ErrUnsupported
+}
+
+func (a *adapter) Capabilities() Capabilities {
+	return a.capabilities
+}
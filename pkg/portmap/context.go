@@ -0,0 +1,22 @@
+package portmap
+
+import (
+	"context"
+	"time"
+)
+
+type expiryKey struct{}
+
+// WithExpiry marks the requests made with the context as the renewals
+// of a mapping that the gateway expires at the given time, so that
+// the mappers queueing the requests can handle them first.
+func WithExpiry(ctx context.Context, expiry time.Time) context.Context {
+	return context.WithValue(ctx, expiryKey{}, expiry)
+}
+
+// ExpiryFrom returns the expiry of the mapping the request made with
+// the context renews, if it's a renewal.
+func ExpiryFrom(ctx context.Context) (time.Time, bool) {
+	expiry, ok := ctx.Value(expiryKey{}).(time.Time)
+	return expiry, ok
+}
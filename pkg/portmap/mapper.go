@@ -2,26 +2,150 @@ package portmap
 
 import (
 	"context"
+	"errors"
 	"net"
 )
 
+var (
+	// ErrUnsupported is returned by the operations the protocol of
+	// the mapper doesn't have.
+	ErrUnsupported = errors.New("the operation is not supported by the port mapping protocol")
+)
+
+// Mapper maps the ports at a gateway. The mappers that only implement
+// `BasicMapper` are turned into the Mappers by `Adapt`.
 type Mapper interface {
+	BasicMapper
+
+	// Unmap deletes the mapping made for the request. Deleting a mapping
+	// that is already gone is not an error.
+	Unmap(ctx context.Context, req *Request) error
+
+	// ListMappings returns the mappings the gateway has, or `ErrUnsupported`
+	// if the protocol can't list them.
+	ListMappings(ctx context.Context) ([]Mapping, error)
+
+	// ExternalAddress returns the external address of the gateway, or
+	// `ErrUnsupported` if the protocol doesn't report it without mapping
+	// a port.
+	ExternalAddress(ctx context.Context) (net.IP, error)
+
+	// Capabilities tells what the protocol of the mapper can do.
+	Capabilities() Capabilities
+}
+
+// BasicMapper only maps the ports, and deletes the mappings on requests
+// with `LifetimeDelete`.
+type BasicMapper interface {
 	Map(ctx context.Context, req *Request) (*Response, error)
 }
 
+// RestartNotifier is implemented by the mappers that can detect
+// the gateway losing its mappings, for instance after a reboot.
+type RestartNotifier interface {
+	Restarts() <-chan struct{}
+}
+
 type Request struct {
+	// The name of the gateway to map the port at, for the mappers of
+	// several gateways. Empty means the default one.
+	Gateway string
+
 	Protocol    Protocol
 	NodePort    Port
 	GatewayPort Port
 
-	// Pass `LifetimeDelete` to request mapping deletion.
+	// The address of the node to map the port to.
+	// If nil, the address of the host the mapper runs at is used.
+	InternalIP net.IP
+
+	// `LifetimeDelete` requests the deletion of the mapping from
+	// the `BasicMapper`s, the Mappers have `Unmap` for that.
 	Lifetime Lifetime
+
+	// Human-readable description of the mapping, for the protocols that
+	// support it.
+	Description string
 }
 
 type Response struct {
+	// The name of the gateway the port is mapped at, see `Request.Gateway`.
+	Gateway string
+
 	Protocol    Protocol
 	NodePort    Port
 	GatewayPort Port
 	GatewayIP   net.IP
 	Lifetime    Lifetime
+
+	// Whether the gateway has mapped the port permanently, rather than
+	// for the lifetime, so the mapping stays until it is deleted.
+	Permanent bool
+}
+
+// Prober is implemented by the mappers that can check the gateway without
+// mapping any ports.
+type Prober interface {
+	Probe(ctx context.Context) (*GatewayInfo, error)
+}
+
+// GatewayInfo is what the gateway tells about itself.
+type GatewayInfo struct {
+	// The external address of the gateway, nil if the protocol doesn't
+	// report it without mapping a port.
+	ExternalIP net.IP
+
+	// The server epoch, nil if the protocol doesn't have one.
+	Epoch *uint32
+
+	// The protocols the ports can be mapped for.
+	Protocols []Protocol
+}
+
+// Mapping is a mapping the gateway has, as listed by `ListMappings`.
+type Mapping struct {
+	Protocol    Protocol
+	GatewayPort Port
+
+	// Where the mapping forwards to.
+	InternalIP net.IP
+	NodePort   Port
+
+	// The lifetime left, `LifetimeDelete` if the mapping is permanent.
+	Lifetime Lifetime
+
+	Description string
+}
+
+// Capabilities is what the protocol of a mapper can do.
+type Capabilities struct {
+	// The protocols the ports can be mapped for, empty if unknown.
+	Protocols []Protocol
+
+	// Whether the ports can be mapped to the other hosts than the one
+	// the mapper runs at, see `Request.InternalIP`.
+	ThirdParty bool
+
+	// Whether the gateway can choose the port, see `PortAny`.
+	PortAny bool
+
+	// Whether `ListMappings` is supported.
+	ListMappings bool
+
+	// Whether `ExternalAddress` is supported.
+	ExternalAddress bool
+}
+
+// Supports tells whether the ports can be mapped for the protocol. Any is
+// assumed to be supported if the protocols are unknown.
+func (c *Capabilities) Supports(protocol Protocol) bool {
+	if len(c.Protocols) == 0 {
+		return true
+	}
+	for _, p := range c.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
 }
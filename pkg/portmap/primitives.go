@@ -1,5 +1,10 @@
 package portmap
 
+import (
+	"math"
+	"time"
+)
+
 // IANA protocol number.
 //
 // See https://www.iana.org/assignments/protocol-numbers/protocol-numbers.xhtml
@@ -37,3 +42,17 @@ const (
 	// Indicate that the removal of the mapping is requested.
 	LifetimeDelete = Lifetime(0)
 )
+
+// LifetimeFromDuration converts the duration to a lifetime, rounding it up
+// to whole seconds, so that a positive duration never means deletion.
+func LifetimeFromDuration(d time.Duration) Lifetime {
+	if d <= 0 {
+		return LifetimeDelete
+	}
+
+	secs := (d + time.Second - 1) / time.Second
+	if secs > math.MaxUint32 {
+		return Lifetime(math.MaxUint32)
+	}
+	return Lifetime(secs)
+}
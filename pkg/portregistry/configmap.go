@@ -0,0 +1,290 @@
+// Package portregistry allocates the gateway ports to the Services
+// cluster-wide, first come first served, so that the Services asking for
+// the same gateway port don't take it from each other at the gateway.
+package portregistry
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The number of handovers that can be pending before they are dropped.
+const handoversBuffer = 64
+
+// Port is a gateway port.
+type Port struct {
+	// The gateway the port is at, for the multi-WAN setups. Empty means
+	// the default one.
+	Gateway string
+
+	Protocol corev1.Protocol
+	Port     int32
+}
+
+func (p Port) String() string {
+	if p.Gateway == "" {
+		return fmt.Sprintf("%s/%d", p.Protocol, p.Port)
+	}
+	return fmt.Sprintf("%s/%d at %s", p.Protocol, p.Port, p.Gateway)
+}
+
+// The ConfigMap keys can't have slashes. The gateway goes last, since
+// its name can have dashes, while the protocol and the port can't.
+func (p Port) key() string {
+	if p.Gateway == "" {
+		return fmt.Sprintf("%s-%d", p.Protocol, p.Port)
+	}
+	return fmt.Sprintf("%s-%d-%s", p.Protocol, p.Port, p.Gateway)
+}
+
+func parseKey(key string) (Port, bool) {
+	split := strings.SplitN(key, "-", 3) // nolint: gomnd
+	if len(split) < 2 {                  // nolint: gomnd
+		return Port{}, false
+	}
+	port, err := strconv.ParseInt(split[1], 10, 32)
+	if err != nil {
+		return Port{}, false
+	}
+	parsed := Port{Protocol: corev1.Protocol(split[0]), Port: int32(port)}
+	if len(split) == 3 { // nolint: gomnd
+		parsed.Gateway = split[2]
+	}
+	return parsed, true
+}
+
+// ConfigMap keeps the registry in a ConfigMap, keyed by the ports,
+// suffixed with the gateway names in the multi-WAN setups,
+// with the `<namespace>/<name>` of the Services holding them as the values.
+// The concurrent updates, from several instances in the per-node mode
+// included, are resolved by the optimistic concurrency of the API.
+type ConfigMap struct {
+	// Used for reading, should not be a cached client, so that
+	// the ConfigMaps of the whole cluster are not cached.
+	Reader client.Reader
+	Writer client.Writer
+
+	Namespace string
+	Name      string
+
+	mu      sync.Mutex
+	waiting map[Port]map[types.NamespacedName]struct{}
+
+	handoversOnce sync.Once
+	handovers     chan types.NamespacedName
+}
+
+// Handovers reports the Services that were denied a port that's been
+// released since. The reports are dropped if nobody keeps up with them,
+// so the denied Services have to be retried anyway.
+func (c *ConfigMap) Handovers() <-chan types.NamespacedName {
+	return c.handoversChan()
+}
+
+func (c *ConfigMap) handoversChan() chan types.NamespacedName {
+	c.handoversOnce.Do(func() {
+		c.handovers = make(chan types.NamespacedName, handoversBuffer)
+	})
+	return c.handovers
+}
+
+// Sync grants the ports to the owner, unless they are held by others,
+// and releases the ports the owner holds but no longer needs.
+// Returns the holders of the ports that were denied.
+func (c *ConfigMap) Sync(
+	ctx context.Context,
+	owner types.NamespacedName,
+	ports []Port,
+) (map[Port]types.NamespacedName, error) {
+	var denied map[Port]types.NamespacedName
+	var released []Port
+
+	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		configMap, exists, err := c.load(ctx)
+		if err != nil {
+			return err
+		}
+
+		var changed bool
+		denied, released, changed = allocate(configMap, owner.String(), ports, true)
+		if !changed {
+			return nil
+		}
+		if !exists {
+			return c.Writer.Create(ctx, configMap)
+		}
+		return c.Writer.Update(ctx, configMap)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.track(owner, denied, released)
+	return denied, nil
+}
+
+// Claim grants the ports to the owner, unless they are held by others,
+// and keeps the rest of the ports the owner holds. Meant for the ports
+// the gateway has picked, that the owner couldn't ask for up front.
+// Returns the holders of the ports that were denied.
+func (c *ConfigMap) Claim(
+	ctx context.Context,
+	owner types.NamespacedName,
+	ports []Port,
+) (map[Port]types.NamespacedName, error) {
+	var denied map[Port]types.NamespacedName
+
+	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		configMap, exists, err := c.load(ctx)
+		if err != nil {
+			return err
+		}
+
+		var changed bool
+		denied, _, changed = allocate(configMap, owner.String(), ports, false)
+		if !changed {
+			return nil
+		}
+		if !exists {
+			return c.Writer.Create(ctx, configMap)
+		}
+		return c.Writer.Update(ctx, configMap)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return denied, nil
+}
+
+// Release releases all the ports of the owner.
+func (c *ConfigMap) Release(ctx context.Context, owner types.NamespacedName) error {
+	_, err := c.Sync(ctx, owner, nil)
+	return err
+}
+
+// Holds reports the ports the owner holds, sorted.
+func (c *ConfigMap) Holds(ctx context.Context, owner types.NamespacedName) ([]Port, error) {
+	configMap, _, err := c.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ports := make([]Port, 0)
+	for key, holder := range configMap.Data {
+		if port, ok := parseKey(key); ok && holder == owner.String() {
+			ports = append(ports, port)
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].key() < ports[j].key() })
+	return ports, nil
+}
+
+// Returns the ConfigMap to update, and whether it exists.
+func (c *ConfigMap) load(ctx context.Context) (*corev1.ConfigMap, bool, error) {
+	var configMap corev1.ConfigMap
+	err := c.Reader.Get(ctx, types.NamespacedName{Namespace: c.Namespace, Name: c.Name}, &configMap)
+	if apierrors.IsNotFound(err) {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: c.Namespace, Name: c.Name},
+		}, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &configMap, true, nil
+}
+
+// Updates the data of the ConfigMap, returning the denied ports
+// with their holders, the released ports, and whether anything changed.
+// The other ports of the owner are released if asked to.
+func allocate(
+	configMap *corev1.ConfigMap,
+	owner string,
+	ports []Port,
+	release bool,
+) (denied map[Port]types.NamespacedName, released []Port, changed bool) {
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+
+	wanted := make(map[string]struct{}, len(ports))
+	denied = make(map[Port]types.NamespacedName)
+	for _, port := range ports {
+		wanted[port.key()] = struct{}{}
+
+		holder, ok := configMap.Data[port.key()]
+		switch {
+		case !ok:
+			configMap.Data[port.key()] = owner
+			changed = true
+		case holder != owner:
+			denied[port] = parseOwner(holder)
+		}
+	}
+
+	if !release {
+		return denied, nil, changed
+	}
+	for key, holder := range configMap.Data {
+		if _, ok := wanted[key]; ok || holder != owner {
+			continue
+		}
+		delete(configMap.Data, key)
+		changed = true
+		if port, ok := parseKey(key); ok {
+			released = append(released, port)
+		}
+	}
+	return denied, released, changed
+}
+
+func parseOwner(data string) types.NamespacedName {
+	split := strings.SplitN(data, "/", 2) // nolint: gomnd
+	if len(split) != 2 {                  // nolint: gomnd
+		return types.NamespacedName{Name: data}
+	}
+	return types.NamespacedName{Namespace: split[0], Name: split[1]}
+}
+
+// Remembers who waits for the denied ports, and hands the released ones
+// over to them.
+func (c *ConfigMap) track(owner types.NamespacedName, denied map[Port]types.NamespacedName, released []Port) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.waiting == nil {
+		c.waiting = make(map[Port]map[types.NamespacedName]struct{})
+	}
+	for port, waiters := range c.waiting {
+		if _, ok := denied[port]; !ok {
+			delete(waiters, owner)
+		}
+	}
+	for port := range denied {
+		if c.waiting[port] == nil {
+			c.waiting[port] = make(map[types.NamespacedName]struct{})
+		}
+		c.waiting[port][owner] = struct{}{}
+	}
+
+	for _, port := range released {
+		for waiter := range c.waiting[port] {
+			select {
+			case c.handoversChan() <- waiter:
+			default:
+			}
+		}
+		delete(c.waiting, port)
+	}
+}
@@ -0,0 +1,141 @@
+package portregistry
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("ConfigMap", func() {
+	var (
+		ctx      context.Context
+		registry *ConfigMap
+	)
+
+	first := types.NamespacedName{Namespace: "default", Name: "first"}
+	second := types.NamespacedName{Namespace: "default", Name: "second"}
+	https := Port{Protocol: corev1.ProtocolTCP, Port: 443}
+	dns := Port{Protocol: corev1.ProtocolUDP, Port: 53}
+	httpsAtWAN2 := Port{Gateway: "wan-2", Protocol: corev1.ProtocolTCP, Port: 443}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		registry = &ConfigMap{
+			Reader:    k8sClient,
+			Writer:    k8sClient,
+			Namespace: "default",
+			Name:      "test-port-registry",
+		}
+	})
+
+	AfterEach(func() {
+		configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: registry.Namespace, Name: registry.Name}}
+		_ = k8sClient.Delete(ctx, configMap)
+	})
+
+	It("should grant the free ports", func() {
+		denied, err := registry.Sync(ctx, first, []Port{https, dns})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(denied).To(BeEmpty())
+
+		Expect(registry.Holds(ctx, first)).To(Equal([]Port{https, dns}))
+	})
+
+	It("should deny the ports held by others", func() {
+		_, err := registry.Sync(ctx, first, []Port{https})
+		Expect(err).NotTo(HaveOccurred())
+
+		denied, err := registry.Sync(ctx, second, []Port{https, dns})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(denied).To(Equal(map[Port]types.NamespacedName{https: first}))
+		Expect(registry.Holds(ctx, second)).To(Equal([]Port{dns}))
+	})
+
+	It("should grant the same port at different gateways", func() {
+		_, err := registry.Sync(ctx, first, []Port{https})
+		Expect(err).NotTo(HaveOccurred())
+
+		denied, err := registry.Sync(ctx, second, []Port{httpsAtWAN2})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(denied).To(BeEmpty())
+		Expect(registry.Holds(ctx, second)).To(Equal([]Port{httpsAtWAN2}))
+	})
+
+	It("should keep the ports of the same owner", func() {
+		_, err := registry.Sync(ctx, first, []Port{https})
+		Expect(err).NotTo(HaveOccurred())
+
+		denied, err := registry.Sync(ctx, first, []Port{https})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(denied).To(BeEmpty())
+	})
+
+	It("should release the ports no longer needed", func() {
+		_, err := registry.Sync(ctx, first, []Port{https, dns})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = registry.Sync(ctx, first, []Port{dns})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(registry.Holds(ctx, first)).To(Equal([]Port{dns}))
+
+		Expect(registry.Release(ctx, first)).To(Succeed())
+		Expect(registry.Holds(ctx, first)).To(BeEmpty())
+	})
+
+	It("should claim the ports on top of the ones held", func() {
+		_, err := registry.Sync(ctx, first, []Port{https})
+		Expect(err).NotTo(HaveOccurred())
+
+		denied, err := registry.Claim(ctx, first, []Port{dns})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(denied).To(BeEmpty())
+		Expect(registry.Holds(ctx, first)).To(Equal([]Port{https, dns}))
+
+		denied, err = registry.Claim(ctx, second, []Port{https})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(denied).To(Equal(map[Port]types.NamespacedName{https: first}))
+		Expect(registry.Holds(ctx, second)).To(BeEmpty())
+
+		Expect(registry.Release(ctx, first)).To(Succeed())
+		Expect(registry.Holds(ctx, first)).To(BeEmpty())
+	})
+
+	It("should hand the released ports over to the ones waiting for them", func() {
+		_, err := registry.Sync(ctx, first, []Port{https})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = registry.Sync(ctx, second, []Port{https})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(registry.Release(ctx, first)).To(Succeed())
+		Eventually(registry.Handovers()).Should(Receive(Equal(second)))
+
+		denied, err := registry.Sync(ctx, second, []Port{https})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(denied).To(BeEmpty())
+	})
+
+	It("should not hand over to the ones that stopped waiting", func() {
+		_, err := registry.Sync(ctx, first, []Port{https})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = registry.Sync(ctx, second, []Port{https})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(registry.Release(ctx, second)).To(Succeed())
+
+		Expect(registry.Release(ctx, first)).To(Succeed())
+		Consistently(registry.Handovers()).ShouldNot(Receive())
+	})
+
+	It("should parse the keys it makes", func() {
+		port, ok := parseKey(https.key())
+		Expect(ok).To(BeTrue())
+		Expect(port).To(Equal(https))
+
+		port, ok = parseKey(httpsAtWAN2.key())
+		Expect(ok).To(BeTrue())
+		Expect(port).To(Equal(httpsAtWAN2))
+	})
+})
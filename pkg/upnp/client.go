@@ -0,0 +1,360 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+)
+
+var (
+	ErrUnsupportedProtocol = errors.New("protocol is not supported by UPnP IGD")
+	ErrUnsupportedPortAny  = errors.New("the IGD doesn't support choosing the external port")
+	ErrInvalidExternalIP   = errors.New("invalid external IP address")
+)
+
+const (
+	// DefaultTimeout is the maximum time spent on a single request,
+	// including the discovery.
+	DefaultTimeout = 30 * time.Second
+)
+
+type Client struct {
+	// The URL of the IGD device description.
+	// If empty, SSDP discovery is used to find it.
+	Location string
+
+	// If empty, `DefaultSSDPAddr` is used.
+	SSDPAddr string
+
+	// If zero, `DefaultTimeout` is used.
+	Timeout time.Duration
+
+	// If nil, `http.DefaultClient` is used.
+	HTTPClient *http.Client
+
+	// Whether to map the ports permanently at the devices that only
+	// support permanent leases, see `portmap.Response.Permanent`.
+	// Such mappings outlive the operator unless it deletes them, so
+	// the devices fail the requests by default.
+	PermanentLeases bool
+
+	mu      sync.Mutex
+	service *connectionService
+}
+
+var (
+	_ portmap.Mapper = (*Client)(nil)
+	_ portmap.Prober = (*Client)(nil)
+)
+
+func New(location string) *Client {
+	return &Client{
+		Location: location,
+	}
+}
+
+func (c *Client) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
+	protocol, err := protocolName(req.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	var res *portmap.Response
+	err = c.withService(ctx, func(ctx context.Context, svc *connectionService) error {
+		res, err = c.mapWith(ctx, svc, protocol, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Unmap deletes the port mapping of the request.
+func (c *Client) Unmap(ctx context.Context, req *portmap.Request) error {
+	protocol, err := protocolName(req.Protocol)
+	if err != nil {
+		return err
+	}
+
+	return c.withService(ctx, func(ctx context.Context, svc *connectionService) error {
+		return c.deletePortMapping(ctx, svc, protocol, req.GatewayPort)
+	})
+}
+
+// ExternalAddress requests the external address of the IGD.
+func (c *Client) ExternalAddress(ctx context.Context) (net.IP, error) {
+	var ip net.IP
+	err := c.withService(ctx, func(ctx context.Context, svc *connectionService) error {
+		var err error
+		ip, err = c.externalAddress(ctx, svc)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
+
+// Probe requests the external address of the IGD.
+func (c *Client) Probe(ctx context.Context) (*portmap.GatewayInfo, error) {
+	ip, err := c.ExternalAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &portmap.GatewayInfo{
+		ExternalIP: ip,
+		Protocols:  []portmap.Protocol{portmap.ProtocolTCP, portmap.ProtocolUDP},
+	}, nil
+}
+
+// Capabilities of UPnP IGD. Only the IGDv2 connection services can choose
+// the port, and map the ports to the other hosts, the IGDv1 ones usually
+// refuse that. Until the device is discovered, it's assumed to be IGDv1.
+func (c *Client) Capabilities() portmap.Capabilities {
+	c.mu.Lock()
+	igdv2 := c.service != nil && c.service.ServiceType == serviceWANIPConnection2
+	c.mu.Unlock()
+
+	return portmap.Capabilities{
+		Protocols:       []portmap.Protocol{portmap.ProtocolTCP, portmap.ProtocolUDP},
+		ThirdParty:      igdv2,
+		PortAny:         igdv2,
+		ListMappings:    true,
+		ExternalAddress: true,
+	}
+}
+
+// Calls the function with the connection service of the device, within
+// the timeout.
+func (c *Client) withService(ctx context.Context, call func(ctx context.Context, svc *connectionService) error) error {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	svc, err := c.connectionService(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = call(ctx, svc)
+	var serr *SOAPError
+	if err != nil && !errors.As(err, &serr) {
+		// The device might have gone away or changed its address,
+		// rediscover it next time.
+		c.forgetConnectionService(svc)
+	}
+	return err
+}
+
+func (c *Client) mapWith(
+	ctx context.Context,
+	svc *connectionService,
+	protocol string,
+	req *portmap.Request,
+) (*portmap.Response, error) {
+	res := &portmap.Response{
+		Protocol:    req.Protocol,
+		NodePort:    req.NodePort,
+		GatewayPort: req.GatewayPort,
+		Lifetime:    req.Lifetime,
+	}
+
+	if req.Lifetime == portmap.LifetimeDelete {
+		if err := c.deletePortMapping(ctx, svc, protocol, req.GatewayPort); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
+	internalClient := req.InternalIP
+	if internalClient == nil {
+		var err error
+		internalClient, err = internalAddress(ctx, svc.ControlURL)
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine the internal address: %w", err)
+		}
+	}
+
+	gatewayPort, permanent, err := c.addPortMapping(ctx, svc, protocol, internalClient, req)
+	if err != nil {
+		return nil, err
+	}
+	res.GatewayPort = gatewayPort
+	res.Permanent = permanent
+
+	res.GatewayIP, err = c.externalAddress(ctx, svc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the external address: %w", err)
+	}
+
+	return res, nil
+}
+
+func (c *Client) addPortMapping(
+	ctx context.Context,
+	svc *connectionService,
+	protocol string,
+	internalClient net.IP,
+	req *portmap.Request,
+) (gatewayPort portmap.Port, permanent bool, err error) {
+	action := "AddPortMapping"
+	if req.GatewayPort == portmap.PortAny {
+		if svc.ServiceType != serviceWANIPConnection2 {
+			return 0, false, ErrUnsupportedPortAny
+		}
+		action = "AddAnyPortMapping"
+	}
+
+	args := []soapArg{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(req.GatewayPort))},
+		{"NewProtocol", protocol},
+		{"NewInternalPort", strconv.Itoa(int(req.NodePort))},
+		{"NewInternalClient", internalClient.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", req.Description},
+		{"NewLeaseDuration", strconv.FormatUint(uint64(req.Lifetime), 10)},
+	}
+
+	values, err := svc.call(ctx, c.httpClient(), action, args)
+	var serr *SOAPError
+	if errors.As(err, &serr) && serr.Code == ErrorCodeOnlyPermanentLeasesSupported && c.PermanentLeases {
+		// Some IGDv1 devices only support permanent leases, we'll be
+		// deleting the mapping explicitly.
+		args[len(args)-1].Value = "0"
+		permanent = true
+		values, err = svc.call(ctx, c.httpClient(), action, args)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	if action == "AddAnyPortMapping" {
+		reserved, err := strconv.ParseUint(values["NewReservedPort"], 10, 16)
+		if err != nil {
+			return 0, false, fmt.Errorf("unable to parse the reserved port: %w", err)
+		}
+		return portmap.Port(reserved), permanent, nil
+	}
+	return req.GatewayPort, permanent, nil
+}
+
+func (c *Client) deletePortMapping(ctx context.Context, svc *connectionService, protocol string, gatewayPort portmap.Port) error {
+	_, err := svc.call(ctx, c.httpClient(), "DeletePortMapping", []soapArg{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(gatewayPort))},
+		{"NewProtocol", protocol},
+	})
+	var serr *SOAPError
+	if errors.As(err, &serr) && serr.Code == ErrorCodeNoSuchEntryInArray {
+		// Already gone.
+		return nil
+	}
+	return err
+}
+
+func (c *Client) externalAddress(ctx context.Context, svc *connectionService) (net.IP, error) {
+	values, err := svc.call(ctx, c.httpClient(), "GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(values["NewExternalIPAddress"])
+	if ip == nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidExternalIP, values["NewExternalIPAddress"])
+	}
+	return ip, nil
+}
+
+func (c *Client) connectionService(ctx context.Context) (*connectionService, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.service != nil {
+		return c.service, nil
+	}
+
+	location := c.Location
+	if location == "" {
+		ssdpAddr := c.SSDPAddr
+		if ssdpAddr == "" {
+			ssdpAddr = DefaultSSDPAddr
+		}
+
+		var err error
+		location, err = Discover(ctx, ssdpAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	svc, err := fetchConnectionService(ctx, c.httpClient(), location)
+	if err != nil {
+		return nil, err
+	}
+
+	c.service = svc
+	return svc, nil
+}
+
+func (c *Client) forgetConnectionService(svc *connectionService) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.service == svc {
+		c.service = nil
+	}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// The address of this host as seen by the device.
+func internalAddress(ctx context.Context, controlURL string) (net.IP, error) {
+	u, err := url.Parse(controlURL)
+	if err != nil {
+		return nil, err
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+
+	// Nothing is sent, this just makes the kernel pick the source address.
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func protocolName(protocol portmap.Protocol) (string, error) {
+	switch protocol { // nolint: exhaustive
+	case portmap.ProtocolTCP:
+		return "TCP", nil
+	case portmap.ProtocolUDP:
+		return "UDP", nil
+	default:
+		return "", fmt.Errorf("%w: %d", ErrUnsupportedProtocol, protocol)
+	}
+}
@@ -0,0 +1,313 @@
+package upnp
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client", func() {
+	var (
+		igd    *fakeIGD
+		client *Client
+		req    *portmap.Request
+		res    *portmap.Response
+		err    error
+	)
+
+	BeforeEach(func() {
+		igd = startFakeIGD(serviceWANIPConnection1)
+		client = &Client{
+			SSDPAddr: igd.SSDPAddr(),
+			Timeout:  5 * time.Second,
+		}
+		req = &portmap.Request{
+			Protocol:    portmap.ProtocolTCP,
+			NodePort:    portmap.Port(32100),
+			GatewayPort: portmap.Port(80),
+			Lifetime:    portmap.Lifetime(120),
+			Description: "default/test-service",
+		}
+	})
+
+	AfterEach(func() {
+		igd.Stop()
+	})
+
+	JustBeforeEach(func() {
+		res, err = client.Map(context.Background(), req)
+	})
+
+	Context("when mapping a port", func() {
+		It("should discover the device via SSDP", func() {
+			Expect(err).To(BeNil())
+			Expect(igd.Searches()).NotTo(BeEmpty())
+			Expect(igd.Searches()[0]).To(HavePrefix("M-SEARCH * HTTP/1.1\r\n"))
+			Expect(igd.Searches()[0]).To(ContainSubstring("MAN: \"ssdp:discover\"\r\n"))
+		})
+
+		It("should add the port mapping", func() {
+			Expect(err).To(BeNil())
+			calls := igd.Calls()
+			Expect(calls).To(HaveLen(2))
+			Expect(calls[0].Action).To(Equal("AddPortMapping"))
+			Expect(calls[0].Body).To(ContainSubstring("<NewExternalPort>80</NewExternalPort>"))
+			Expect(calls[0].Body).To(ContainSubstring("<NewProtocol>TCP</NewProtocol>"))
+			Expect(calls[0].Body).To(ContainSubstring("<NewInternalPort>32100</NewInternalPort>"))
+			Expect(calls[0].Body).To(ContainSubstring("<NewInternalClient>127.0.0.1</NewInternalClient>"))
+			Expect(calls[0].Body).To(ContainSubstring("<NewPortMappingDescription>default/test-service</NewPortMappingDescription>"))
+			Expect(calls[0].Body).To(ContainSubstring("<NewLeaseDuration>120</NewLeaseDuration>"))
+			Expect(calls[1].Action).To(Equal("GetExternalIPAddress"))
+		})
+
+		It("should produce a correct response", func() {
+			Expect(err).To(BeNil())
+			Expect(res).To(Equal(&portmap.Response{
+				Protocol:    portmap.ProtocolTCP,
+				NodePort:    portmap.Port(32100),
+				GatewayPort: portmap.Port(80),
+				GatewayIP:   net.ParseIP("1.2.3.4"),
+				Lifetime:    portmap.Lifetime(120),
+			}))
+		})
+	})
+
+	Context("when the location is known", func() {
+		BeforeEach(func() {
+			client = New(igd.Location())
+		})
+
+		It("should not use SSDP", func() {
+			Expect(err).To(BeNil())
+			Expect(igd.Searches()).To(BeEmpty())
+		})
+	})
+
+	Context("with the internal address of another host", func() {
+		BeforeEach(func() {
+			req.InternalIP = net.IPv4(192, 168, 0, 10)
+		})
+
+		It("should map the port to that address", func() {
+			Expect(err).To(BeNil())
+			Expect(igd.Calls()[0].Body).To(ContainSubstring("<NewInternalClient>192.168.0.10</NewInternalClient>"))
+		})
+	})
+
+	Context("when deleting a mapping", func() {
+		BeforeEach(func() {
+			req.Lifetime = portmap.LifetimeDelete
+		})
+
+		It("should delete the port mapping", func() {
+			Expect(err).To(BeNil())
+			calls := igd.Calls()
+			Expect(calls).To(HaveLen(1))
+			Expect(calls[0].Action).To(Equal("DeletePortMapping"))
+			Expect(calls[0].Body).To(ContainSubstring("<NewExternalPort>80</NewExternalPort>"))
+			Expect(res.Lifetime).To(Equal(portmap.LifetimeDelete))
+		})
+	})
+
+	Context("when the mapping conflicts", func() {
+		BeforeEach(func() {
+			igd.Faults["AddPortMapping"] = ErrorCodeConflictInMappingEntry
+		})
+
+		It("should produce a SOAP error", func() {
+			Expect(err).To(Equal(&SOAPError{Code: ErrorCodeConflictInMappingEntry, Description: "FakeError"}))
+			Expect(res).To(BeNil())
+		})
+	})
+
+	Context("when the device only supports permanent leases", func() {
+		BeforeEach(func() {
+			igd.Faults["AddPortMapping"] = ErrorCodeOnlyPermanentLeasesSupported
+		})
+
+		It("should produce a SOAP error", func() {
+			Expect(err).To(Equal(&SOAPError{Code: ErrorCodeOnlyPermanentLeasesSupported, Description: "FakeError"}))
+			Expect(res).To(BeNil())
+			Expect(igd.Calls()).To(HaveLen(1))
+		})
+
+		Context("and the permanent leases are allowed", func() {
+			BeforeEach(func() {
+				client.PermanentLeases = true
+			})
+
+			It("should retry with a permanent lease", func() {
+				Expect(err).To(BeNil())
+				calls := igd.Calls()
+				Expect(calls).To(HaveLen(3))
+				Expect(calls[1].Action).To(Equal("AddPortMapping"))
+				Expect(calls[1].Body).To(ContainSubstring("<NewLeaseDuration>0</NewLeaseDuration>"))
+				Expect(res.Permanent).To(BeTrue())
+			})
+		})
+	})
+
+	Context("when any gateway port is acceptable", func() {
+		BeforeEach(func() {
+			req.GatewayPort = portmap.PortAny
+		})
+
+		It("should fail on WANIPConnection:1", func() {
+			Expect(err).To(MatchError(ErrUnsupportedPortAny))
+			Expect(res).To(BeNil())
+		})
+
+		Context("with WANIPConnection:2", func() {
+			BeforeEach(func() {
+				igd.ServiceType = serviceWANIPConnection2
+			})
+
+			It("should let the device pick the port", func() {
+				Expect(err).To(BeNil())
+				Expect(igd.Calls()[0].Action).To(Equal("AddAnyPortMapping"))
+				Expect(res.GatewayPort).To(Equal(portmap.Port(40000)))
+			})
+		})
+	})
+
+	Context("with an SCTP request", func() {
+		BeforeEach(func() {
+			req.Protocol = portmap.ProtocolSCTP
+		})
+
+		It("should fail without contacting the device", func() {
+			Expect(err).To(MatchError(ErrUnsupportedProtocol))
+			Expect(igd.Searches()).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("findConnectionService", func() {
+	It("should prefer WANIPConnection over WANPPPConnection", func() {
+		desc := &deviceDescription{Device: device{
+			Services: []service{
+				{ServiceType: serviceWANPPPConnection1, ControlURL: "/ppp"},
+				{ServiceType: serviceWANIPConnection1, ControlURL: "/ip"},
+			},
+		}}
+		svc, err := findConnectionService(desc, "http://192.168.0.1:5000/rootDesc.xml")
+		Expect(err).To(BeNil())
+		Expect(svc).To(Equal(&connectionService{
+			ServiceType: serviceWANIPConnection1,
+			ControlURL:  "http://192.168.0.1:5000/ip",
+		}))
+	})
+
+	It("should respect the URLBase", func() {
+		desc := &deviceDescription{
+			URLBase: "http://192.168.0.1:6000/",
+			Device: device{Services: []service{
+				{ServiceType: serviceWANPPPConnection1, ControlURL: "ppp"},
+			}},
+		}
+		svc, err := findConnectionService(desc, "http://192.168.0.1:5000/rootDesc.xml")
+		Expect(err).To(BeNil())
+		Expect(svc.ControlURL).To(Equal("http://192.168.0.1:6000/ppp"))
+	})
+
+	It("should fail when there is no connection service", func() {
+		svc, err := findConnectionService(&deviceDescription{}, "http://192.168.0.1:5000/rootDesc.xml")
+		Expect(err).To(MatchError(ErrNoConnectionService))
+		Expect(svc).To(BeNil())
+	})
+})
+
+var _ = Describe("Client.Probe", func() {
+	It("should report the external address", func() {
+		igd := startFakeIGD(serviceWANIPConnection1)
+		defer igd.Stop()
+
+		client := &Client{
+			SSDPAddr: igd.SSDPAddr(),
+			Timeout:  5 * time.Second,
+		}
+		info, err := client.Probe(context.Background())
+		Expect(err).To(BeNil())
+		Expect(info.ExternalIP.Equal(net.IPv4(1, 2, 3, 4))).To(BeTrue())
+		Expect(info.Epoch).To(BeNil())
+		Expect(igd.Calls()).To(HaveLen(1))
+		Expect(igd.Calls()[0].Action).To(Equal("GetExternalIPAddress"))
+	})
+})
+
+var _ = Describe("Client operations", func() {
+	var (
+		igd    *fakeIGD
+		client *Client
+	)
+
+	BeforeEach(func() {
+		igd = startFakeIGD(serviceWANIPConnection1)
+		client = New(igd.Location())
+	})
+
+	AfterEach(func() {
+		igd.Stop()
+	})
+
+	It("should unmap the port", func() {
+		err := client.Unmap(context.Background(), &portmap.Request{
+			Protocol:    portmap.ProtocolUDP,
+			NodePort:    portmap.Port(32100),
+			GatewayPort: portmap.Port(53),
+		})
+		Expect(err).To(BeNil())
+		calls := igd.Calls()
+		Expect(calls).To(HaveLen(1))
+		Expect(calls[0].Action).To(Equal("DeletePortMapping"))
+		Expect(calls[0].Body).To(ContainSubstring("<NewExternalPort>53</NewExternalPort>"))
+		Expect(calls[0].Body).To(ContainSubstring("<NewProtocol>UDP</NewProtocol>"))
+	})
+
+	It("should not fail to unmap the ports that are already gone", func() {
+		igd.Faults["DeletePortMapping"] = ErrorCodeNoSuchEntryInArray
+		err := client.Unmap(context.Background(), &portmap.Request{Protocol: portmap.ProtocolTCP, GatewayPort: 80})
+		Expect(err).To(BeNil())
+	})
+
+	It("should list the mappings", func() {
+		mappings, err := client.ListMappings(context.Background())
+		Expect(err).To(BeNil())
+		Expect(mappings).To(HaveLen(1))
+		Expect(mappings[0].InternalIP.Equal(net.IPv4(192, 168, 0, 10))).To(BeTrue())
+		mappings[0].InternalIP = nil
+		Expect(mappings[0]).To(Equal(portmap.Mapping{
+			Protocol:    portmap.ProtocolTCP,
+			GatewayPort: 80,
+			NodePort:    32100,
+			Lifetime:    60,
+			Description: "default/test-service",
+		}))
+		Expect(igd.Calls()).To(HaveLen(2))
+	})
+
+	It("should report the external address", func() {
+		ip, err := client.ExternalAddress(context.Background())
+		Expect(err).To(BeNil())
+		Expect(ip.Equal(net.IPv4(1, 2, 3, 4))).To(BeTrue())
+	})
+
+	It("should only report the IGDv2 capabilities for WANIPConnection:2", func() {
+		Expect(client.Capabilities().PortAny).To(BeFalse())
+		_, err := client.ExternalAddress(context.Background())
+		Expect(err).To(BeNil())
+		Expect(client.Capabilities().PortAny).To(BeFalse())
+		Expect(client.Capabilities().ThirdParty).To(BeFalse())
+
+		igd.ServiceType = serviceWANIPConnection2
+		client = New(igd.Location())
+		_, err = client.ExternalAddress(context.Background())
+		Expect(err).To(BeNil())
+		Expect(client.Capabilities().PortAny).To(BeTrue())
+		Expect(client.Capabilities().ThirdParty).To(BeTrue())
+	})
+})
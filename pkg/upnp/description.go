@@ -0,0 +1,118 @@
+package upnp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+var (
+	ErrNoConnectionService = errors.New("the IGD has no WAN connection service")
+)
+
+const (
+	serviceWANIPConnection2  = "urn:schemas-upnp-org:service:WANIPConnection:2"
+	serviceWANIPConnection1  = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	serviceWANPPPConnection1 = "urn:schemas-upnp-org:service:WANPPPConnection:1"
+)
+
+// Connection services in the order of preference.
+var connectionServiceTypes = []string{
+	serviceWANIPConnection2,
+	serviceWANIPConnection1,
+	serviceWANPPPConnection1,
+}
+
+type deviceDescription struct {
+	URLBase string `xml:"URLBase"`
+	Device  device `xml:"device"`
+}
+
+type device struct {
+	DeviceType string    `xml:"deviceType"`
+	Services   []service `xml:"serviceList>service"`
+	Devices    []device  `xml:"deviceList>device"`
+}
+
+type service struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// The WAN connection service to issue the port mapping actions to.
+type connectionService struct {
+	ServiceType string
+	ControlURL  string
+}
+
+func fetchConnectionService(ctx context.Context, httpClient *http.Client, location string) (*connectionService, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedStatus, res.Status)
+	}
+
+	var desc deviceDescription
+	if err := xml.NewDecoder(res.Body).Decode(&desc); err != nil {
+		return nil, fmt.Errorf("unable to parse the device description: %w", err)
+	}
+
+	return findConnectionService(&desc, location)
+}
+
+func findConnectionService(desc *deviceDescription, location string) (*connectionService, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if desc.URLBase != "" {
+		if base, err = url.Parse(desc.URLBase); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, serviceType := range connectionServiceTypes {
+		svc := findService(&desc.Device, serviceType)
+		if svc == nil {
+			continue
+		}
+
+		controlURL, err := base.Parse(svc.ControlURL)
+		if err != nil {
+			return nil, err
+		}
+
+		return &connectionService{
+			ServiceType: svc.ServiceType,
+			ControlURL:  controlURL.String(),
+		}, nil
+	}
+
+	return nil, ErrNoConnectionService
+}
+
+func findService(dev *device, serviceType string) *service {
+	for i := range dev.Services {
+		if dev.Services[i].ServiceType == serviceType {
+			return &dev.Services[i]
+		}
+	}
+	for i := range dev.Devices {
+		if svc := findService(&dev.Devices[i], serviceType); svc != nil {
+			return svc
+		}
+	}
+	return nil
+}
@@ -0,0 +1,6 @@
+// UPnP Internet Gateway Device client implementing a `portmap.Mapper`
+// via the WANIPConnection and WANPPPConnection services.
+//
+// Ref: http://upnp.org/specs/gw/UPnP-gw-InternetGatewayDevice-v2-Device.pdf
+
+package upnp
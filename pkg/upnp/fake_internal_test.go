@@ -0,0 +1,179 @@
+package upnp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/gomega"
+)
+
+// nolint: lll
+const fakeDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <serviceList>
+      <service>
+        <serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>
+        <controlURL>/ctl/L3F</controlURL>
+      </service>
+    </serviceList>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>%s</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>
+`
+
+const fakeFault = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail>
+</s:Fault></s:Body></s:Envelope>`
+
+const fakeResponse = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`
+
+type fakeCall struct {
+	Action string
+	Body   string
+}
+
+// An in-process fake IGD, serving both SSDP and HTTP.
+type fakeIGD struct {
+	ServiceType string
+	// Action name to UPnP error code to respond with, once.
+	Faults map[string]int
+
+	http *httptest.Server
+	ssdp *net.UDPConn
+
+	mu       sync.Mutex
+	calls    []fakeCall
+	searches []string
+}
+
+func startFakeIGD(serviceType string) *fakeIGD {
+	igd := &fakeIGD{
+		ServiceType: serviceType,
+		Faults:      map[string]int{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, fakeDescription, igd.ServiceType)
+	})
+	mux.HandleFunc("/ctl/IPConn", igd.handleControl)
+	igd.http = httptest.NewServer(mux)
+
+	var err error
+	igd.ssdp, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	Expect(err).NotTo(HaveOccurred())
+	go igd.serveSSDP()
+
+	return igd
+}
+
+func (igd *fakeIGD) Location() string {
+	return igd.http.URL + "/rootDesc.xml"
+}
+
+func (igd *fakeIGD) SSDPAddr() string {
+	return igd.ssdp.LocalAddr().String()
+}
+
+func (igd *fakeIGD) Calls() []fakeCall {
+	igd.mu.Lock()
+	defer igd.mu.Unlock()
+	return append([]fakeCall(nil), igd.calls...)
+}
+
+func (igd *fakeIGD) Searches() []string {
+	igd.mu.Lock()
+	defer igd.mu.Unlock()
+	return append([]string(nil), igd.searches...)
+}
+
+func (igd *fakeIGD) Stop() {
+	igd.ssdp.Close()
+	igd.http.Close()
+}
+
+func (igd *fakeIGD) serveSSDP() {
+	buf := make([]byte, maxSSDPPacketSize)
+	for {
+		n, from, err := igd.ssdp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		igd.mu.Lock()
+		igd.searches = append(igd.searches, string(buf[:n]))
+		igd.mu.Unlock()
+
+		res := "HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=120\r\n" +
+			"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+			"LOCATION: " + igd.Location() + "\r\n" +
+			"\r\n"
+		_, _ = igd.ssdp.WriteToUDP([]byte(res), from)
+	}
+}
+
+func (igd *fakeIGD) handleControl(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	soapAction := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+	action := soapAction[strings.Index(soapAction, "#")+1:]
+
+	igd.mu.Lock()
+	igd.calls = append(igd.calls, fakeCall{Action: action, Body: string(body)})
+	code, fault := igd.Faults[action]
+	delete(igd.Faults, action)
+	igd.mu.Unlock()
+
+	if fault {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, fakeFault, code, "FakeError")
+		return
+	}
+
+	var args string
+	switch action {
+	case "GetExternalIPAddress":
+		args = "<NewExternalIPAddress>1.2.3.4</NewExternalIPAddress>"
+	case "AddAnyPortMapping":
+		args = "<NewReservedPort>40000</NewReservedPort>"
+	case "GetGenericPortMappingEntry":
+		// A single mapping.
+		if !strings.Contains(string(body), "<NewPortMappingIndex>0</NewPortMappingIndex>") {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, fakeFault, ErrorCodeSpecifiedArrayIndexInvalid, "SpecifiedArrayIndexInvalid")
+			return
+		}
+		args = "<NewRemoteHost></NewRemoteHost><NewExternalPort>80</NewExternalPort><NewProtocol>TCP</NewProtocol>" +
+			"<NewInternalPort>32100</NewInternalPort><NewInternalClient>192.168.0.10</NewInternalClient>" +
+			"<NewEnabled>1</NewEnabled><NewPortMappingDescription>default/test-service</NewPortMappingDescription>" +
+			"<NewLeaseDuration>60</NewLeaseDuration>"
+	}
+	fmt.Fprintf(w, fakeResponse, action, igd.ServiceType, args, action)
+}
@@ -0,0 +1,84 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+)
+
+// A guard against the devices that never report the end of the list.
+const maxMappings = 1 << 16
+
+// ListMappings lists the port mappings of the device, one by one.
+func (c *Client) ListMappings(ctx context.Context) ([]portmap.Mapping, error) {
+	var mappings []portmap.Mapping
+	err := c.withService(ctx, func(ctx context.Context, svc *connectionService) error {
+		mappings = make([]portmap.Mapping, 0)
+		for index := 0; index < maxMappings; index++ {
+			values, err := svc.call(ctx, c.httpClient(), "GetGenericPortMappingEntry", []soapArg{
+				{"NewPortMappingIndex", strconv.Itoa(index)},
+			})
+			var serr *SOAPError
+			if errors.As(err, &serr) &&
+				(serr.Code == ErrorCodeSpecifiedArrayIndexInvalid || serr.Code == ErrorCodeNoSuchEntryInArray) {
+				// Past the last one.
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			mapping, err := parseMappingEntry(values)
+			if err != nil {
+				return fmt.Errorf("unable to parse the port mapping %d: %w", index, err)
+			}
+			mappings = append(mappings, *mapping)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+func parseMappingEntry(values map[string]string) (*portmap.Mapping, error) {
+	mapping := &portmap.Mapping{
+		InternalIP:  net.ParseIP(values["NewInternalClient"]),
+		Description: values["NewPortMappingDescription"],
+	}
+
+	switch values["NewProtocol"] {
+	case "TCP":
+		mapping.Protocol = portmap.ProtocolTCP
+	case "UDP":
+		mapping.Protocol = portmap.ProtocolUDP
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedProtocol, values["NewProtocol"])
+	}
+
+	externalPort, err := strconv.ParseUint(values["NewExternalPort"], 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	mapping.GatewayPort = portmap.Port(externalPort)
+
+	internalPort, err := strconv.ParseUint(values["NewInternalPort"], 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	mapping.NodePort = portmap.Port(internalPort)
+
+	if duration := values["NewLeaseDuration"]; duration != "" {
+		lifetime, err := strconv.ParseUint(duration, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		mapping.Lifetime = portmap.Lifetime(lifetime)
+	}
+	return mapping, nil
+}
@@ -0,0 +1,144 @@
+package upnp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnexpectedStatus = errors.New("unexpected HTTP status")
+)
+
+// UPnP error codes relevant to the port mapping.
+//
+// See the WANIPConnection:2 service specification, section 2.4.
+const (
+	ErrorCodeConflictInMappingEntry       = 718
+	ErrorCodeSpecifiedArrayIndexInvalid   = 713
+	ErrorCodeNoSuchEntryInArray           = 714
+	ErrorCodeOnlyPermanentLeasesSupported = 725
+)
+
+// SOAPError is returned when the device responds with a UPnP error.
+type SOAPError struct {
+	Code        int
+	Description string
+}
+
+var _ error = (*SOAPError)(nil)
+
+func (e *SOAPError) Error() string {
+	return fmt.Sprintf("UPnP device responded with error %d: %s", e.Code, e.Description)
+}
+
+// Action arguments have to be sent in the order the service defines them.
+type soapArg struct {
+	Name  string
+	Value string
+}
+
+// Invokes the action and returns the values of the output arguments.
+func (s *connectionService) call(
+	ctx context.Context,
+	httpClient *http.Client,
+	action string,
+	args []soapArg,
+) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.ControlURL, bytes.NewReader(marshalEnvelope(s.ServiceType, action, args)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, s.ServiceType, action))
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	values, err := parseEnvelope(res.Body)
+	if err != nil {
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%w: %s", ErrUnexpectedStatus, res.Status)
+		}
+		return nil, fmt.Errorf("unable to parse the SOAP response: %w", err)
+	}
+
+	if codeText, ok := values["errorCode"]; ok {
+		code, err := strconv.Atoi(strings.TrimSpace(codeText))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the UPnP error code: %w", err)
+		}
+		return nil, &SOAPError{Code: code, Description: values["errorDescription"]}
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedStatus, res.Status)
+	}
+
+	return values, nil
+}
+
+func marshalEnvelope(serviceType, action string, args []soapArg) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body>`)
+	fmt.Fprintf(&buf, `<u:%s xmlns:u="%s">`, action, serviceType)
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "<%s>", arg.Name)
+		_ = xml.EscapeText(&buf, []byte(arg.Value))
+		fmt.Fprintf(&buf, "</%s>", arg.Name)
+	}
+	fmt.Fprintf(&buf, `</u:%s>`, action)
+	buf.WriteString(`</s:Body></s:Envelope>`)
+
+	return buf.Bytes()
+}
+
+// Collects the text of all the leaf elements in the envelope, which is where
+// both the output arguments and the UPnP error details are.
+func parseEnvelope(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	decoder := xml.NewDecoder(r)
+
+	var current string
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			current = t.Name.Local
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if current == t.Name.Local {
+				values[current] = text.String()
+			}
+			current = ""
+		}
+	}
+
+	if len(values) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return values, nil
+}
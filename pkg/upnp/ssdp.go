@@ -0,0 +1,106 @@
+package upnp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrNoDeviceFound = errors.New("no UPnP IGD found")
+)
+
+const (
+	// DefaultSSDPAddr is the SSDP multicast group address.
+	DefaultSSDPAddr = "239.255.255.250:1900"
+
+	// How long devices may delay their responses, in seconds.
+	ssdpMX = 2
+
+	maxSSDPPacketSize = 2048
+)
+
+var searchTargets = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+}
+
+// Discover sends the SSDP M-SEARCH requests for the Internet Gateway Devices
+// to the addr and returns the location of the first device description
+// to respond.
+func Discover(ctx context.Context, addr string) (string, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return "", err
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add((ssdpMX + 1) * time.Second)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return "", err
+	}
+
+	for _, st := range searchTargets {
+		if _, err := conn.WriteTo(marshalSearch(addr, st), raddr); err != nil {
+			return "", err
+		}
+	}
+
+	buf := make([]byte, maxSSDPPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				return "", ErrNoDeviceFound
+			}
+			return "", err
+		}
+
+		location, ok := parseSearchResponse(buf[:n])
+		if ok {
+			return location, nil
+		}
+	}
+}
+
+// See UPnP Device Architecture 1.1, section 1.3.2.
+func marshalSearch(host, st string) []byte {
+	return []byte(fmt.Sprintf(
+		"M-SEARCH * HTTP/1.1\r\n"+
+			"HOST: %s\r\n"+
+			"MAN: \"ssdp:discover\"\r\n"+
+			"MX: %d\r\n"+
+			"ST: %s\r\n"+
+			"\r\n",
+		host, ssdpMX, st,
+	))
+}
+
+func parseSearchResponse(data []byte) (string, bool) {
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	if err != nil {
+		return "", false
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", false
+	}
+
+	location := res.Header.Get("Location")
+	return location, location != ""
+}
@@ -0,0 +1,93 @@
+// Rejects the Services with invalid port-map annotations, so that
+// the mistakes surface when the Services are applied rather than
+// in the operator logs.
+
+package webhooks
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/MOZGIII/port-map-operator/pkg/annotations"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// ServiceValidatorPath is the path the ServiceValidator is served at.
+const ServiceValidatorPath = "/validate-v1-service"
+
+//+kubebuilder:webhook:path=/validate-v1-service,mutating=false,failurePolicy=ignore,sideEffects=None,groups="",resources=services,verbs=create;update,versions=v1,name=vservice.port-map.mzg.io,admissionReviewVersions=v1
+
+// ServiceValidator validates the port-map annotations of the Services.
+type ServiceValidator struct {
+	decoder *admission.Decoder
+}
+
+var (
+	_ admission.Handler         = (*ServiceValidator)(nil)
+	_ admission.DecoderInjector = (*ServiceValidator)(nil)
+)
+
+func (v *ServiceValidator) InjectDecoder(decoder *admission.Decoder) error {
+	v.decoder = decoder
+	return nil
+}
+
+func (v *ServiceValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var service corev1.Service
+	if err := v.decoder.Decode(req, &service); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if !hasInputs(&service) {
+		return admission.Allowed("")
+	}
+
+	if req.Operation == admissionv1.Update {
+		var oldService corev1.Service
+		if err := v.decoder.DecodeRaw(req.OldObject, &oldService); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		// Don't stand in the way of the updates that don't touch what we
+		// validate, the operator's own ones included, even if the Service
+		// was invalid before.
+		if !inputsChanged(&oldService, &service) {
+			return admission.Allowed("")
+		}
+	}
+
+	if err := validate(&service); err != nil {
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+func validate(service *corev1.Service) error {
+	ann, err := annotations.FromService(service)
+	if err != nil {
+		return err
+	}
+	return ann.CheckPortReferences(service.Spec.Ports)
+}
+
+func hasInputs(service *corev1.Service) bool {
+	for _, key := range annotations.InputKeys {
+		if _, ok := service.GetAnnotations()[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func inputsChanged(oldService, service *corev1.Service) bool {
+	for _, key := range annotations.InputKeys {
+		oldValue, oldOk := oldService.GetAnnotations()[key]
+		value, ok := service.GetAnnotations()[key]
+		if oldValue != value || oldOk != ok {
+			return true
+		}
+	}
+	return !equality.Semantic.DeepEqual(oldService.Spec.Ports, service.Spec.Ports)
+}
@@ -0,0 +1,110 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/MOZGIII/port-map-operator/pkg/annotations"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var _ = Describe("Service validator", func() {
+	var validator *ServiceValidator
+
+	BeforeEach(func() {
+		decoder, err := admission.NewDecoder(clientgoscheme.Scheme)
+		Expect(err).ShouldNot(HaveOccurred())
+		validator = &ServiceValidator{}
+		Expect(validator.InjectDecoder(decoder)).To(Succeed())
+	})
+
+	serviceWith := func(ann map[string]string) *corev1.Service {
+		return &corev1.Service{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", Annotations: ann},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{
+					{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+					{Name: "dns", Protocol: corev1.ProtocolUDP, Port: 53},
+				},
+			},
+		}
+	}
+
+	raw := func(service *corev1.Service) runtime.RawExtension {
+		data, err := json.Marshal(service)
+		Expect(err).ShouldNot(HaveOccurred())
+		return runtime.RawExtension{Raw: data}
+	}
+
+	create := func(service *corev1.Service) admission.Response {
+		return validator.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: admissionv1.Create,
+			Object:    raw(service),
+		}})
+	}
+
+	update := func(oldService, service *corev1.Service) admission.Response {
+		return validator.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: admissionv1.Update,
+			Object:    raw(service),
+			OldObject: raw(oldService),
+		}})
+	}
+
+	It("Should allow the Services without the annotations", func() {
+		Expect(create(serviceWith(nil)).Allowed).To(BeTrue())
+	})
+
+	It("Should allow the valid annotations", func() {
+		response := create(serviceWith(map[string]string{
+			annotations.OverridesV2Key: `{"http": {"port": 8080}, "UDP/53": {"policy": "any"}}`,
+			annotations.LifetimeKey:    "1h",
+		}))
+		Expect(response.Allowed).To(BeTrue())
+	})
+
+	It("Should reject the malformed annotations", func() {
+		response := create(serviceWith(map[string]string{annotations.OverridesV1Key: `{"TCP/80": {"port": "80"}}`}))
+		Expect(response.Allowed).To(BeFalse())
+	})
+
+	It("Should reject the overrides of the ports the Service doesn't have", func() {
+		response := create(serviceWith(map[string]string{annotations.OverridesV2Key: `{"https": {"skip": true}}`}))
+		Expect(response.Allowed).To(BeFalse())
+		Expect(string(response.Result.Reason)).To(ContainSubstring("https"))
+
+		response = create(serviceWith(map[string]string{annotations.OverridesV1Key: `{"TCP/53": {"skip": true}}`}))
+		Expect(response.Allowed).To(BeFalse())
+
+		response = create(serviceWith(map[string]string{annotations.OverridesV2Key: `{"TCP/1000-2000": {"skip": true}}`}))
+		Expect(response.Allowed).To(BeFalse())
+	})
+
+	It("Should reject the gateway ports out of range", func() {
+		response := create(serviceWith(map[string]string{annotations.OverridesV2Key: `{"TCP/80": {"port": 65536}}`}))
+		Expect(response.Allowed).To(BeFalse())
+	})
+
+	It("Should reject the updates breaking the annotations", func() {
+		oldService := serviceWith(map[string]string{annotations.OverridesV2Key: `{"http": {"port": 8080}}`})
+		service := oldService.DeepCopy()
+		service.Spec.Ports = service.Spec.Ports[1:]
+		Expect(update(oldService, service).Allowed).To(BeFalse())
+	})
+
+	It("Should allow the updates not touching the invalid annotations", func() {
+		oldService := serviceWith(map[string]string{annotations.OverridesV2Key: `{"https": {"port": 8080}}`})
+		service := oldService.DeepCopy()
+		service.Finalizers = []string{"port-map.mzg.io/finalizer"}
+		Expect(update(oldService, service).Allowed).To(BeTrue())
+	})
+})
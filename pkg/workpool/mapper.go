@@ -0,0 +1,77 @@
+package workpool
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+)
+
+// Mapper makes the requests to the gateway on the workers of the pool.
+// The renewals, marked with `portmap.WithExpiry`, go first, the ones
+// of the mappings that expire sooner before the others.
+//
+// The optional interfaces of the mapper, such as `portmap.RestartNotifier`,
+// are not kept, use the mapper itself for them.
+type Mapper struct {
+	Pool   *Pool
+	Mapper portmap.Mapper
+}
+
+var _ portmap.Mapper = (*Mapper)(nil)
+
+func (m *Mapper) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
+	var res *portmap.Response
+	err := m.Pool.Do(ctx, deadlineOf(ctx), func(ctx context.Context) error {
+		var err error
+		res, err = m.Mapper.Map(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (m *Mapper) Unmap(ctx context.Context, req *portmap.Request) error {
+	return m.Pool.Do(ctx, deadlineOf(ctx), func(ctx context.Context) error {
+		return m.Mapper.Unmap(ctx, req)
+	})
+}
+
+func (m *Mapper) ListMappings(ctx context.Context) ([]portmap.Mapping, error) {
+	var mappings []portmap.Mapping
+	err := m.Pool.Do(ctx, deadlineOf(ctx), func(ctx context.Context) error {
+		var err error
+		mappings, err = m.Mapper.ListMappings(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+func (m *Mapper) ExternalAddress(ctx context.Context) (net.IP, error) {
+	var ip net.IP
+	err := m.Pool.Do(ctx, deadlineOf(ctx), func(ctx context.Context) error {
+		var err error
+		ip, err = m.Mapper.ExternalAddress(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
+
+func (m *Mapper) Capabilities() portmap.Capabilities {
+	return m.Mapper.Capabilities()
+}
+
+// Zero unless the request is a renewal.
+func deadlineOf(ctx context.Context) time.Time {
+	expiry, _ := portmap.ExpiryFrom(ctx)
+	return expiry
+}
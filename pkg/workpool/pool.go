@@ -0,0 +1,234 @@
+// Package workpool runs the port mapping work on a bounded number of workers,
+// so that a single hung request doesn't stall the others, and too many
+// of them don't overwhelm the gateway.
+//
+// The work is prioritized by its deadline: the renewals of the mappings
+// that are about to expire go first, and the work without a deadline,
+// such as the brand new mappings, goes last, in the order it came in.
+package workpool
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrStopped = errors.New("the worker pool is stopped")
+)
+
+const (
+	// DefaultWorkers is the number of the workers by default.
+	DefaultWorkers = 4
+
+	// DefaultTimeout is how long a single piece of work can take by default.
+	DefaultTimeout = 30 * time.Second
+)
+
+// Pool runs the work on its workers while it is started.
+type Pool struct {
+	// If zero, `DefaultWorkers` is used.
+	Workers int
+
+	// If zero, `DefaultTimeout` is used.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	queue   queue
+	seq     uint64
+	stopped bool
+	wakeup  chan struct{}
+}
+
+type job struct {
+	ctx      context.Context
+	deadline time.Time
+	seq      uint64
+	work     func(ctx context.Context) error
+
+	// Receives the outcome of the work, buffered so that the workers
+	// never block on the ones no longer waiting.
+	done  chan error
+	index int
+}
+
+func New(workers int, timeout time.Duration) *Pool {
+	return &Pool{
+		Workers: workers,
+		Timeout: timeout,
+		wakeup:  make(chan struct{}, 1),
+	}
+}
+
+// Do runs the work on one of the workers, and waits for it to be done.
+// The work with an earlier deadline goes first, zero deadline means none.
+// The context of the work is done after the timeout, or when the context
+// passed is.
+func (p *Pool) Do(ctx context.Context, deadline time.Time, work func(ctx context.Context) error) error {
+	j := &job{
+		ctx:      ctx,
+		deadline: deadline,
+		work:     work,
+		done:     make(chan error, 1),
+	}
+
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return ErrStopped
+	}
+	p.seq++
+	j.seq = p.seq
+	heap.Push(&p.queue, j)
+	p.mu.Unlock()
+	p.wake()
+
+	select {
+	case err := <-j.done:
+		return err
+	case <-ctx.Done():
+		p.mu.Lock()
+		if j.index >= 0 {
+			// Not started yet.
+			heap.Remove(&p.queue, j.index)
+		}
+		p.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Start runs the workers until the context is done, and then fails
+// the work that hasn't started. It implements `manager.Runnable`.
+func (p *Pool) Start(ctx context.Context) error {
+	workers := p.Workers
+	if workers == 0 {
+		workers = DefaultWorkers
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx)
+		}()
+	}
+	<-ctx.Done()
+
+	p.mu.Lock()
+	p.stopped = true
+	for p.queue.Len() > 0 {
+		j := heap.Pop(&p.queue).(*job)
+		j.done <- ErrStopped
+	}
+	p.mu.Unlock()
+
+	wg.Wait()
+	return nil
+}
+
+// Run is `Start` for the mappers run until stopch is closed.
+func (p *Pool) Run(stopch <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return p.Start(ctx)
+}
+
+func (p *Pool) work(ctx context.Context) {
+	for {
+		j := p.next()
+		if j == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.wakeup:
+				continue
+			}
+		}
+		j.done <- p.run(j)
+	}
+}
+
+// Takes the most urgent job off the queue, nil if there's none.
+func (p *Pool) next() *job {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.queue.Len() == 0 {
+		return nil
+	}
+	j := heap.Pop(&p.queue).(*job)
+	if p.queue.Len() > 0 {
+		// Let another worker take the next one.
+		p.wake()
+	}
+	return j
+}
+
+func (p *Pool) run(j *job) error {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(j.ctx, timeout)
+	defer cancel()
+	return j.work(ctx)
+}
+
+func (p *Pool) wake() {
+	select {
+	case p.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// The jobs ordered by the deadline, the ones without it last, and then
+// in the order they came in.
+type queue []*job
+
+var _ heap.Interface = (*queue)(nil)
+
+func (q queue) Len() int { return len(q) }
+
+func (q queue) Less(i, j int) bool {
+	a, b := q[i], q[j]
+	switch {
+	case a.deadline.IsZero() != b.deadline.IsZero():
+		return b.deadline.IsZero()
+	case !a.deadline.Equal(b.deadline):
+		return a.deadline.Before(b.deadline)
+	default:
+		return a.seq < b.seq
+	}
+}
+
+func (q queue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *queue) Push(x interface{}) {
+	j := x.(*job)
+	j.index = len(*q)
+	*q = append(*q, j)
+}
+
+func (q *queue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	j := old[n-1]
+	old[n-1] = nil
+	j.index = -1
+	*q = old[:n-1]
+	return j
+}
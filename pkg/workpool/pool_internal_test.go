@@ -0,0 +1,250 @@
+package workpool
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/MOZGIII/port-map-operator/pkg/portmap"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pool", func() {
+	var (
+		pool   *Pool
+		cancel context.CancelFunc
+		donech chan struct{}
+	)
+
+	start := func(workers int, timeout time.Duration) {
+		pool = New(workers, timeout)
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		donech = make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			Expect(pool.Start(ctx)).To(Succeed())
+			close(donech)
+		}()
+	}
+
+	stop := func() {
+		cancel()
+		Eventually(donech).Should(BeClosed())
+	}
+
+	queued := func() int {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return pool.queue.Len()
+	}
+
+	// Occupies a worker until the returned channel is closed.
+	block := func() chan struct{} {
+		releasech := make(chan struct{})
+		startedch := make(chan struct{})
+		go func() {
+			_ = pool.Do(context.Background(), time.Time{}, func(ctx context.Context) error {
+				close(startedch)
+				<-releasech
+				return nil
+			})
+		}()
+		Eventually(startedch).Should(BeClosed())
+		return releasech
+	}
+
+	AfterEach(func() {
+		stop()
+	})
+
+	It("should return the outcome of the work", func() {
+		start(1, time.Minute)
+
+		Expect(pool.Do(context.Background(), time.Time{}, func(ctx context.Context) error {
+			return nil
+		})).To(Succeed())
+		Expect(pool.Do(context.Background(), time.Time{}, func(ctx context.Context) error {
+			return context.DeadlineExceeded
+		})).To(MatchError(context.DeadlineExceeded))
+	})
+
+	It("should run no more work at once than there are workers", func() {
+		start(2, time.Minute)
+
+		var (
+			mu      sync.Mutex
+			running int
+			most    int
+			wg      sync.WaitGroup
+		)
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = pool.Do(context.Background(), time.Time{}, func(ctx context.Context) error {
+					mu.Lock()
+					running++
+					if running > most {
+						most = running
+					}
+					mu.Unlock()
+
+					time.Sleep(20 * time.Millisecond)
+
+					mu.Lock()
+					running--
+					mu.Unlock()
+					return nil
+				})
+			}()
+		}
+		wg.Wait()
+
+		Expect(most).To(Equal(2))
+	})
+
+	It("should run the work with the earlier deadlines first, and the rest in order", func() {
+		start(1, time.Minute)
+		releasech := block()
+
+		var (
+			mu    sync.Mutex
+			order []string
+			wg    sync.WaitGroup
+		)
+		now := time.Now()
+		enqueue := func(name string, deadline time.Time) {
+			n := queued()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = pool.Do(context.Background(), deadline, func(ctx context.Context) error {
+					mu.Lock()
+					defer mu.Unlock()
+					order = append(order, name)
+					return nil
+				})
+			}()
+			Eventually(queued).Should(Equal(n + 1))
+		}
+		enqueue("new 1", time.Time{})
+		enqueue("renewal 2", now.Add(2*time.Minute))
+		enqueue("renewal 1", now.Add(time.Minute))
+		enqueue("new 2", time.Time{})
+
+		close(releasech)
+		wg.Wait()
+
+		Expect(order).To(Equal([]string{"renewal 1", "renewal 2", "new 1", "new 2"}))
+	})
+
+	It("should time the work out", func() {
+		start(1, 10*time.Millisecond)
+
+		Expect(pool.Do(context.Background(), time.Time{}, func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})).To(MatchError(context.DeadlineExceeded))
+	})
+
+	It("should drop the work no longer waited for", func() {
+		start(1, time.Minute)
+		releasech := block()
+
+		ctx, cancelWork := context.WithCancel(context.Background())
+		errch := make(chan error, 1)
+		ran := false
+		go func() {
+			errch <- pool.Do(ctx, time.Time{}, func(ctx context.Context) error {
+				ran = true
+				return nil
+			})
+		}()
+		Eventually(queued).Should(Equal(1))
+
+		cancelWork()
+		Eventually(errch).Should(Receive(MatchError(context.Canceled)))
+		Expect(queued()).To(Equal(0))
+
+		close(releasech)
+		Expect(pool.Do(context.Background(), time.Time{}, func(ctx context.Context) error {
+			return nil
+		})).To(Succeed())
+		Expect(ran).To(BeFalse())
+	})
+
+	It("should fail the queued work when stopped", func() {
+		start(1, time.Minute)
+		releasech := block()
+
+		errch := make(chan error, 1)
+		go func() {
+			errch <- pool.Do(context.Background(), time.Time{}, func(ctx context.Context) error {
+				return nil
+			})
+		}()
+		Eventually(queued).Should(Equal(1))
+
+		cancel()
+		Eventually(errch).Should(Receive(MatchError(ErrStopped)))
+		close(releasech)
+		Eventually(donech).Should(BeClosed())
+
+		Expect(pool.Do(context.Background(), time.Time{}, func(ctx context.Context) error {
+			return nil
+		})).To(MatchError(ErrStopped))
+	})
+})
+
+type fakeMapper struct {
+	portmap.Mapper
+
+	deadline chan time.Time
+}
+
+func (m *fakeMapper) Map(ctx context.Context, req *portmap.Request) (*portmap.Response, error) {
+	deadline, _ := ctx.Deadline()
+	m.deadline <- deadline
+	return &portmap.Response{
+		Protocol:    req.Protocol,
+		NodePort:    req.NodePort,
+		GatewayPort: req.GatewayPort,
+		Lifetime:    req.Lifetime,
+	}, nil
+}
+
+var _ = Describe("Mapper", func() {
+	It("should map the ports on the workers of the pool", func() {
+		pool := New(1, time.Minute)
+		stopch := make(chan struct{})
+		donech := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			Expect(pool.Run(stopch)).To(Succeed())
+			close(donech)
+		}()
+		defer func() {
+			close(stopch)
+			Eventually(donech).Should(BeClosed())
+		}()
+
+		fake := &fakeMapper{deadline: make(chan time.Time, 1)}
+		mapper := &Mapper{Pool: pool, Mapper: fake}
+		ctx := portmap.WithExpiry(context.Background(), time.Now().Add(time.Hour))
+		res, err := mapper.Map(ctx, &portmap.Request{
+			Protocol:    portmap.ProtocolTCP,
+			NodePort:    32100,
+			GatewayPort: 80,
+			Lifetime:    120,
+		})
+
+		Expect(err).To(BeNil())
+		Expect(res.GatewayPort).To(Equal(portmap.Port(80)))
+		// The timeout of the pool applies.
+		var deadline time.Time
+		Expect(fake.deadline).To(Receive(&deadline))
+		Expect(deadline).To(BeTemporally("~", time.Now().Add(time.Minute), time.Second))
+	})
+})